@@ -27,30 +27,58 @@ import (
 var (
 	dir     string
 	version string
+	baseRef string
+	dryRun  bool
+	report  string
+
+	channelOverride string
+
+	webhookURL          string
+	failOnNotifyFailure bool
 )
 
 func main() {
 	flag.StringVar(&dir, "dir", ".", "the directory run in")
 	flag.StringVar(&version, "version", "", "the new version to release")
+	flag.StringVar(&baseRef, "base-ref", DefaultBaseRef, "the ref to create the release branch from")
+	flag.BoolVar(&dryRun, "dry-run", false, "log the changes the release would make without making them")
+	flag.StringVar(&channelOverride, "channel", "", "the channel to publish the release to, inferred from the version when empty")
+	flag.StringVar(&report, "report", "", "the file the duration and outcome of every step are written to as JSON, none when empty")
+	flag.StringVar(&webhookURL, "webhook-url", "", "the webhook notified when the release branch is cut, none when empty")
+	flag.BoolVar(&failOnNotifyFailure, "fail-on-notify-failure", false, "fail the release when the webhook can't be notified")
 	flag.Parse()
 
 	steps := []Step{
+		VerifyCleanWorkingTree(func(cmd *exec.Cmd) error { return cmd.Run() }),
 		ValidateVersion(),
 		EnsureUniqueVersion(func(cmd *exec.Cmd) error { return cmd.Run() }),
-		CreateReleaseBranch(process.ExecJUnit),
+		EnsureVersionIncreases(func(cmd *exec.Cmd) error { return cmd.Run() }),
+		CreateReleaseBranch(process.ExecJUnit, baseRef),
 		UpdateVersion(),
 		UpdateChangelog(os.ReadFile),
 		GenerateFiles(process.ExecJUnit),
 	}
 
+	if webhookURL != "" {
+		steps = append(steps, Notify(WebhookSender{URL: webhookURL}, failOnNotifyFailure))
+	}
+
 	if err := os.Chdir(dir); err != nil {
 		bail(err)
 	}
 
-	for _, step := range steps {
-		if err := step.Apply(version); err != nil {
+	pipeline := &Pipeline{Steps: steps, Options: StepOptions{DryRun: dryRun, Channel: channelOverride}}
+	if report != "" {
+		f, err := os.Create(report)
+		if err != nil {
 			bail(err)
 		}
+		defer f.Close()
+		pipeline.Report = f
+	}
+
+	if _, err := pipeline.Run(version); err != nil {
+		bail(err)
 	}
 }
 
@@ -0,0 +1,215 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Rollbacker is implemented by steps that can undo their changes when a later step of the release fails.
+type Rollbacker interface {
+	Rollback(version string) error
+}
+
+// WithRollback returns a step that applies step and undoes it with rollback.
+func WithRollback(step Step, rollback func(version string) error) Step {
+	return &rollbackStep{Step: step, rollback: rollback}
+}
+
+type rollbackStep struct {
+	Step
+	rollback func(version string) error
+}
+
+// Rollback undoes the step.
+func (s *rollbackStep) Rollback(version string) error {
+	return s.rollback(version)
+}
+
+// Name returns the name of the wrapped step.
+func (s *rollbackStep) Name() string {
+	return stepName(s.Step)
+}
+
+// validationErrors are the errors that applying a step again won't fix.
+var validationErrors = []error{ErrInvalidVersion, ErrVersionExists, ErrDirtyTree}
+
+// isValidationError returns true when err wraps one of the validationErrors.
+func isValidationError(err error) bool {
+	for _, target := range validationErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithRetry returns a step that applies step up to attempts times, e.g. to get over network failures when talking to
+// origin. It waits backoff after the first failure and doubles the wait after every other one. Validation errors, such
+// as ErrInvalidVersion, are returned right away.
+func WithRetry(step Step, attempts int, backoff time.Duration) Step {
+	return &retryStep{Step: step, attempts: attempts, backoff: backoff}
+}
+
+type retryStep struct {
+	Step
+	attempts int
+	backoff  time.Duration
+}
+
+// Apply applies the step until it succeeds, fails with a validation error or runs out of attempts.
+func (s *retryStep) Apply(version string, opts StepOptions) error {
+	wait := s.backoff
+	for attempt := 1; ; attempt++ {
+		err := s.Step.Apply(version, opts)
+		if err == nil || isValidationError(err) || attempt >= s.attempts {
+			return err
+		}
+
+		opts.logf("attempt %d of %d failed: %s, retrying in %s", attempt, s.attempts, err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// Rollback rolls back the step if it implements Rollbacker.
+func (s *retryStep) Rollback(version string) error {
+	if r, ok := s.Step.(Rollbacker); ok {
+		return r.Rollback(version)
+	}
+
+	return nil
+}
+
+// Name returns the name of the wrapped step.
+func (s *retryStep) Name() string {
+	return stepName(s.Step)
+}
+
+// Pipeline applies release steps in order.
+type Pipeline struct {
+	Steps   []Step
+	Options StepOptions
+	// Report is where Run writes the results of the steps as JSON, nowhere when nil.
+	Report io.Writer
+}
+
+// Namer is implemented by steps that have a name to report in a StepResult.
+type Namer interface {
+	Name() string
+}
+
+// StepResult describes how applying a step of a Pipeline went.
+type StepResult struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// MarshalJSON encodes the result with the duration and error as strings.
+func (r StepResult) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Name     string `json:"name"`
+		Duration string `json:"duration"`
+		Error    string `json:"error,omitempty"`
+	}{Name: r.Name, Duration: r.Duration.String()}
+	if r.Err != nil {
+		v.Error = r.Err.Error()
+	}
+
+	return json.Marshal(v)
+}
+
+// stepName returns the name of the step if it implements Namer. Otherwise it returns the name of the function, e.g.
+// ValidateVersion for the StepFn returned by ValidateVersion, or the name of the type of the step.
+func stepName(step Step) string {
+	if n, ok := step.(Namer); ok {
+		return n.Name()
+	}
+
+	v := reflect.ValueOf(step)
+	if v.Kind() == reflect.Func && !v.IsNil() {
+		if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+			name := fn.Name()
+			name = name[strings.LastIndex(name, "/")+1:]
+			// closures are named like main.ValidateVersion.func1
+			parts := strings.Split(name, ".")
+			if len(parts) > 1 {
+				return parts[1]
+			}
+			return name
+		}
+	}
+
+	return reflect.TypeOf(step).String()
+}
+
+// Run applies every step of the pipeline and returns the result of each step that was applied, in order. When a step
+// fails, the steps that were already applied are rolled back in reverse order, if they implement Rollbacker, and the
+// error of the failed step is returned. The results are written to Report even when a step fails.
+func (p *Pipeline) Run(version string) ([]StepResult, error) {
+	var results []StepResult
+	var runErr error
+	for i, step := range p.Steps {
+		start := time.Now()
+		err := step.Apply(version, p.Options)
+		results = append(results, StepResult{Name: stepName(step), Duration: time.Since(start), Err: err})
+
+		if err != nil {
+			runErr = p.rollback(version, p.Steps[:i], err)
+			break
+		}
+	}
+
+	if p.Report != nil {
+		enc := json.NewEncoder(p.Report)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil && runErr == nil {
+			runErr = fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+
+	return results, runErr
+}
+
+// rollback rolls back the applied steps in reverse order. Every step is rolled back even if rolling back another one
+// fails.
+func (p *Pipeline) rollback(version string, applied []Step, cause error) error {
+	var failures []string
+	for i := len(applied) - 1; i >= 0; i-- {
+		r, ok := applied[i].(Rollbacker)
+		if !ok {
+			continue
+		}
+
+		if err := r.Rollback(version); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%w (rollback failed: %s)", cause, strings.Join(failures, "; "))
+	}
+	return cause
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/cockroachdb/cockroach-operator/hack/release"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStep records when it is applied and rolled back in calls.
+type recordingStep struct {
+	name  string
+	err   error
+	calls *[]string
+}
+
+func (s recordingStep) Apply(_ string, _ StepOptions) error {
+	*s.calls = append(*s.calls, "apply "+s.name)
+	return s.err
+}
+
+func (s recordingStep) Rollback(_ string) error {
+	*s.calls = append(*s.calls, "rollback "+s.name)
+	return nil
+}
+
+func TestPipeline(t *testing.T) {
+	t.Run("applies every step", func(t *testing.T) {
+		var calls []string
+		p := &Pipeline{Steps: []Step{
+			recordingStep{name: "one", calls: &calls},
+			recordingStep{name: "two", calls: &calls},
+		}}
+
+		_, err := p.Run("1.2.3")
+		require.NoError(t, err)
+		require.Equal(t, []string{"apply one", "apply two"}, calls)
+	})
+
+	t.Run("rolls back the applied steps in reverse order when a step fails", func(t *testing.T) {
+		var calls []string
+		p := &Pipeline{Steps: []Step{
+			recordingStep{name: "one", calls: &calls},
+			StepFn(func(_ string, _ StepOptions) error { calls = append(calls, "apply no rollback"); return nil }),
+			recordingStep{name: "two", calls: &calls},
+			recordingStep{name: "three", calls: &calls, err: fmt.Errorf("boom")},
+			recordingStep{name: "four", calls: &calls},
+		}}
+
+		_, err := p.Run("1.2.3")
+		require.EqualError(t, err, "boom")
+		require.Equal(t, []string{
+			"apply one",
+			"apply no rollback",
+			"apply two",
+			"apply three",
+			"rollback two",
+			"rollback one",
+		}, calls)
+	})
+
+	t.Run("when rolling back fails", func(t *testing.T) {
+		var calls []string
+		p := &Pipeline{Steps: []Step{
+			recordingStep{name: "one", calls: &calls},
+			WithRollback(
+				StepFn(func(_ string, _ StepOptions) error { return nil }),
+				func(_ string) error { return fmt.Errorf("stuck") },
+			),
+			StepFn(func(_ string, _ StepOptions) error { return fmt.Errorf("boom") }),
+		}}
+
+		_, err := p.Run("1.2.3")
+		require.EqualError(t, err, "boom (rollback failed: stuck)")
+		require.Equal(t, []string{"apply one", "rollback one"}, calls, "every step must be rolled back")
+	})
+}
+
+// Name implements Namer.
+func (s recordingStep) Name() string {
+	return s.name
+}
+
+func TestPipelineResults(t *testing.T) {
+	var calls []string
+	report := new(bytes.Buffer)
+	p := &Pipeline{
+		Steps: []Step{
+			recordingStep{name: "one", calls: &calls},
+			ValidateVersion(),
+			WithRollback(recordingStep{name: "two", calls: &calls}, func(_ string) error { return nil }),
+			recordingStep{name: "three", calls: &calls, err: fmt.Errorf("boom")},
+			recordingStep{name: "four", calls: &calls},
+		},
+		Report: report,
+	}
+
+	results, err := p.Run("1.2.3")
+	require.EqualError(t, err, "boom")
+
+	var names []string
+	for _, r := range results {
+		names = append(names, r.Name)
+	}
+	require.Equal(t, []string{"one", "ValidateVersion", "two", "three"}, names, "the steps after the failing one must not be recorded")
+	require.NoError(t, results[0].Err)
+	require.EqualError(t, results[3].Err, "boom")
+
+	var summary []map[string]string
+	require.NoError(t, json.Unmarshal(report.Bytes(), &summary))
+	require.Len(t, summary, 4)
+	require.Equal(t, "one", summary[0]["name"])
+	require.NotEmpty(t, summary[0]["duration"])
+	require.NotContains(t, summary[0], "error")
+	require.Equal(t, "boom", summary[3]["error"])
+}
+
+func TestWithRetry(t *testing.T) {
+	opts := StepOptions{Out: io.Discard}
+
+	t.Run("retries until the step succeeds", func(t *testing.T) {
+		calls := 0
+		flaky := func(_ string, _, _ []string) error {
+			calls++
+			if calls < 3 {
+				return fmt.Errorf("connection reset")
+			}
+			return nil
+		}
+
+		require.NoError(t, WithRetry(GenerateFiles(flaky), 3, time.Millisecond).Apply("1.2.3", opts))
+		require.Equal(t, 3, calls)
+	})
+
+	t.Run("gives up after the last attempt", func(t *testing.T) {
+		calls := 0
+		step := StepFn(func(_ string, _ StepOptions) error {
+			calls++
+			return fmt.Errorf("connection reset %d", calls)
+		})
+
+		require.EqualError(t, WithRetry(step, 2, time.Millisecond).Apply("1.2.3", opts), "connection reset 2")
+		require.Equal(t, 2, calls)
+	})
+
+	t.Run("does not retry validation errors", func(t *testing.T) {
+		calls := 0
+		step := StepFn(func(version string, opts StepOptions) error {
+			calls++
+			return ValidateVersion().Apply(version, opts)
+		})
+
+		require.ErrorIs(t, WithRetry(step, 3, time.Millisecond).Apply("v1.2.3", opts), ErrInvalidVersion)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("rolls back the step", func(t *testing.T) {
+		var calls []string
+		step := WithRetry(recordingStep{name: "one", calls: &calls}, 3, time.Millisecond)
+
+		require.NoError(t, step.(Rollbacker).Rollback("1.2.3"))
+		require.Equal(t, []string{"rollback one"}, calls)
+	})
+}
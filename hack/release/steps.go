@@ -17,28 +17,88 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+
+	semver "github.com/Masterminds/semver/v3"
+	"github.com/pmezard/go-difflib/difflib"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	versionRegxp = regexp.MustCompile(`^\d+\.\d+\.\d+(-(beta|rc)\.\d+)?(\+[0-9A-Za-z-.]+)?$`)
+	channelRegxp = regexp.MustCompile(`-(beta|rc)\.\d+(\+.*)?$`)
+	commitRegxp  = regexp.MustCompile(`^(\w+)(\(([^)]*)\))?!?: (.+)$`)
 )
 
 var (
-	versionRegxp = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+	// ErrInvalidVersion is returned when the version to release is not a valid release version.
+	ErrInvalidVersion = errors.New("invalid version")
+	// ErrVersionExists is returned when the version to release has already been tagged.
+	ErrVersionExists = errors.New("version already exists")
+	// ErrDirtyTree is returned when the working tree has uncommitted changes.
+	ErrDirtyTree = errors.New("working tree has uncommitted changes")
 )
 
 // Step defines an action to be taken during the release process
 type Step interface {
-	Apply(version string) error
+	Apply(version string, opts StepOptions) error
 }
 
 // StepFn is a function that implements Step.
-type StepFn func(version string) error
+type StepFn func(version string, opts StepOptions) error
 
 // Apply applies the function.
-func (fn StepFn) Apply(version string) error {
-	return fn(version)
+func (fn StepFn) Apply(version string, opts StepOptions) error {
+	return fn(version, opts)
+}
+
+// StepOptions configures how steps are applied.
+type StepOptions struct {
+	// DryRun makes steps log the changes they would make, such as writing files or creating branches, instead of
+	// making them. Read-only commands are still run.
+	DryRun bool
+	// Out is where steps log, os.Stdout when nil.
+	Out io.Writer
+	// Channel is the channel GenerateFiles publishes the release to, e.g. to publish a beta build to the stable channel
+	// for a hotfix. It must be one of knownChannels, the channel inferred from the version is used when empty.
+	Channel string
+	// FailFast makes steps that act on several targets, such as PushTagToRemotes, stop at the first failure instead of
+	// carrying on with the other targets and returning every failure.
+	FailFast bool
+	// SkipSigning makes SignArtifacts log the artifacts it would sign instead of signing them, e.g. for dev releases
+	// that aren't published.
+	SkipSigning bool
+}
+
+// logf logs a message to Out.
+func (o StepOptions) logf(format string, args ...interface{}) {
+	out := o.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, format+"\n", args...)
+}
+
+// dryRun logs the message and returns true when this is a dry run, in which case the caller must not make the change
+// described by the message.
+func (o StepOptions) dryRun(format string, args ...interface{}) bool {
+	if !o.DryRun {
+		return false
+	}
+
+	o.logf("[dry-run] "+format, args...)
+	return true
 }
 
 // CmdFn describes a function that runs a Cmd.
@@ -50,11 +110,75 @@ type ExecFn func(cmd string, args, env []string) error
 // FileFn describes a function that reads a file and returns it's contents
 type FileFn func(path string) ([]byte, error)
 
+// GitHubClient describes the GitHub API calls used to publish a release.
+type GitHubClient interface {
+	// CreateRelease creates a release for an existing tag and returns the ID of the release.
+	CreateRelease(tag string, prerelease bool) (int64, error)
+	// UploadAsset uploads the file at path as an asset of the release.
+	UploadAsset(releaseID int64, path string) error
+	// CreatePullRequest opens a pull request merging head into base and returns the number of the pull request.
+	CreatePullRequest(head, base, title, body string) (int, error)
+}
+
+// RegistryClient describes the container registry API calls used to check the images of a release.
+type RegistryClient interface {
+	// ManifestExists returns true if the manifest of the image, of the form repository:tag, has been pushed.
+	ManifestExists(image string) (bool, error)
+}
+
+// Signer signs the artifacts of a release, e.g. with cosign.
+type Signer interface {
+	// Sign signs the artifact ref, such as an image reference or the path of a manifest.
+	Sign(ref string) error
+}
+
+// releaseAssets are the files generated by GenerateFiles that are attached to the GitHub release.
+var releaseAssets = []string{"install/crds.yaml", "install/operator.yaml"}
+
+// gitOutput runs git with the given arguments using fn and returns its stdout.
+func gitOutput(fn CmdFn, args ...string) (string, error) {
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := fn(cmd); err != nil {
+		return "", fmt.Errorf("failed to run git %s: %s - %s", args[0], stderr.String(), err)
+	}
+
+	return stdout.String(), nil
+}
+
+// VerifyCleanWorkingTree ensures there are no uncommitted changes that would end up in the generated files.
+func VerifyCleanWorkingTree(fn CmdFn) Step {
+	return StepFn(func(_ string, _ StepOptions) error {
+		status, err := gitOutput(fn, "status", "--porcelain")
+		if err != nil {
+			return err
+		}
+
+		var files []string
+		for _, line := range strings.Split(status, "\n") {
+			// each line is formatted as `XY path`, where XY is the status of the file
+			if len(line) > 3 {
+				files = append(files, line[3:])
+			}
+		}
+
+		if len(files) > 0 {
+			return fmt.Errorf("%w: %s", ErrDirtyTree, strings.Join(files, ", "))
+		}
+
+		return nil
+	})
+}
+
 // ValidateVersion ensures the supplied version matches our expected version regexp.
 func ValidateVersion() Step {
-	return StepFn(func(version string) error {
+	return StepFn(func(version string, _ StepOptions) error {
 		if !versionRegxp.MatchString(version) {
-			return fmt.Errorf("invalid version '%s'. Must be of the form N.N.N", version)
+			return fmt.Errorf("%w '%s'. Must be of the form N.N.N, N.N.N-beta.N or N.N.N-rc.N, optionally followed by +<build metadata>", ErrInvalidVersion, version)
 		}
 
 		return nil
@@ -63,7 +187,7 @@ func ValidateVersion() Step {
 
 // EnsureUniqueVersion verifies that this is a new version by checking the existing tags.
 func EnsureUniqueVersion(fn CmdFn) Step {
-	return StepFn(func(version string) error {
+	return StepFn(func(version string, _ StepOptions) error {
 		stdout := new(bytes.Buffer)
 		stderr := new(bytes.Buffer)
 
@@ -75,13 +199,16 @@ func EnsureUniqueVersion(fn CmdFn) Step {
 		}
 
 		for _, v := range strings.Split(stdout.String(), "\n") {
-			if v == "" {
+			// release tags have a `v` prefix, but some legacy tags don't
+			tag := strings.TrimPrefix(strings.TrimSpace(v), "v")
+
+			// skip empty lines and tags that aren't versions, such as nightly
+			if _, err := semver.StrictNewVersion(tag); err != nil {
 				continue
 			}
 
-			// tags have a `v` prefix, so we remove it for comparison
-			if v[1:] == version {
-				return fmt.Errorf("version already exists")
+			if tag == version {
+				return fmt.Errorf("%w: %s", ErrVersionExists, version)
 			}
 		}
 
@@ -89,50 +216,884 @@ func EnsureUniqueVersion(fn CmdFn) Step {
 	})
 }
 
+// EnsureVersionIncreases verifies that the version is greater than the highest version that has been tagged so far,
+// taking pre-releases into account, e.g. 2.12.0-beta.1 is lower than 2.12.0.
+func EnsureVersionIncreases(fn CmdFn) Step {
+	return StepFn(func(version string, _ StepOptions) error {
+		proposed, err := semver.StrictNewVersion(version)
+		if err != nil {
+			return fmt.Errorf("%w '%s': %s", ErrInvalidVersion, version, err)
+		}
+
+		latest, err := latestVersion(fn, nil)
+		if err != nil {
+			return err
+		}
+
+		if latest != nil && !proposed.GreaterThan(latest) {
+			return fmt.Errorf("version %s must be greater than the latest version %s", version, latest)
+		}
+
+		return nil
+	})
+}
+
+// latestVersion returns the highest version that has been tagged, or nil when there is none. When below is set, only
+// the versions lower than below are considered.
+func latestVersion(fn CmdFn, below *semver.Version) (*semver.Version, error) {
+	tags, err := gitOutput(fn, "tag")
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *semver.Version
+	for _, v := range strings.Split(tags, "\n") {
+		tagged, err := semver.StrictNewVersion(strings.TrimPrefix(strings.TrimSpace(v), "v"))
+		if err != nil {
+			continue
+		}
+		if below != nil && !tagged.LessThan(below) {
+			continue
+		}
+
+		if latest == nil || tagged.GreaterThan(latest) {
+			latest = tagged
+		}
+	}
+
+	return latest, nil
+}
+
 // UpdateVersion sets the version in version.txt
 func UpdateVersion() Step {
-	return StepFn(func(version string) error {
+	const fileName = "version.txt"
+
+	// the previous contents are restored on rollback, nil when the file didn't exist
+	var prev []byte
+	written := false
+
+	apply := StepFn(func(version string, opts StepOptions) error {
+		if opts.dryRun("write %s to %s", version, fileName) {
+			return nil
+		}
+
+		data, err := os.ReadFile(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		prev = data
+
 		// setting the mode to 0644 to match the existing permissions: r/w for current user, read-only for everyone else.
-		return os.WriteFile("version.txt", []byte(version), 0644)
+		if err := os.WriteFile(fileName, []byte(version), 0644); err != nil {
+			return err
+		}
+		written = true
+		return nil
+	})
+
+	return WithRollback(apply, func(_ string) error {
+		if !written {
+			return nil
+		}
+		written = false
+
+		if prev == nil {
+			return os.Remove(fileName)
+		}
+		return os.WriteFile(fileName, prev, 0644)
 	})
 }
 
-// CreateReleaseBranch creates a new branch for the release named release-<version>.
-func CreateReleaseBranch(fn ExecFn) Step {
-	return StepFn(func(version string) error {
-		return fn(
+// DefaultBaseRef is the ref release branches are created from unless another one is specified.
+const DefaultBaseRef = "origin/master"
+
+// CreateReleaseBranch creates a new branch for the release named release-<version> from baseRef, or from
+// DefaultBaseRef when baseRef is empty. Backports are released from a release branch such as origin/release-23.1.
+func CreateReleaseBranch(fn ExecFn, baseRef string) Step {
+	if baseRef == "" {
+		baseRef = DefaultBaseRef
+	}
+
+	created := false
+	apply := StepFn(func(version string, opts StepOptions) error {
+		if err := fn("git", []string{"rev-parse", "--verify", baseRef}, os.Environ()); err != nil {
+			return fmt.Errorf("base ref %s does not exist: %s", baseRef, err)
+		}
+
+		args := []string{"checkout", "-b", fmt.Sprintf("release-%s", version), baseRef}
+		if opts.dryRun("git %s", strings.Join(args, " ")) {
+			return nil
+		}
+
+		if err := fn("git", args, os.Environ()); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+
+	return WithRollback(apply, func(version string) error {
+		if !created {
+			return nil
+		}
+		created = false
+
+		// switch back to the branch the release was started from before deleting the release branch
+		if err := fn("git", []string{"checkout", "-"}, os.Environ()); err != nil {
+			return err
+		}
+		return fn("git", []string{"branch", "-D", fmt.Sprintf("release-%s", version)}, os.Environ())
+	})
+}
+
+// PushTag creates the annotated tag v<version> on the release branch and pushes it to the given remote. It fails
+// without pushing anything if the tag already exists.
+func PushTag(fn ExecFn, remote string) Step {
+	return PushTagToRemotes(fn, []string{remote})
+}
+
+// PushTagToRemotes creates the annotated tag v<version> on the release branch and pushes it to each of the remotes, e.g.
+// GitHub and a mirror. A failed push doesn't stop the tag from being pushed to the other remotes, unless FailFast is
+// set, and the failures are returned together. It fails without pushing anything if the tag already exists.
+func PushTagToRemotes(fn ExecFn, remotes []string) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		tag := "v" + version
+		if opts.dryRun("create tag %s on release-%s and push it to %s", tag, version, strings.Join(remotes, ", ")) {
+			return nil
+		}
+
+		if err := fn(
 			"git",
-			[]string{"checkout", "-b", fmt.Sprintf("release-%s", version), "origin/master"},
+			[]string{"tag", "-a", tag, "-m", fmt.Sprintf("Release %s", tag), fmt.Sprintf("release-%s", version)},
 			os.Environ(),
-		)
+		); err != nil {
+			return fmt.Errorf("failed to create tag %s: %s", tag, err)
+		}
+
+		var problems []string
+		for _, remote := range remotes {
+			err := fn("git", []string{"push", remote, tag}, os.Environ())
+			if err == nil {
+				continue
+			}
+			if opts.FailFast || len(remotes) == 1 {
+				return fmt.Errorf("failed to push tag %s to %s: %s", tag, remote, err)
+			}
+			problems = append(problems, fmt.Sprintf("%s: %s", remote, err))
+		}
+
+		if len(problems) > 0 {
+			return fmt.Errorf("failed to push tag %s to %d of %d remotes:\n%s", tag, len(problems), len(remotes),
+				strings.Join(problems, "\n"))
+		}
+
+		return nil
+	})
+}
+
+// CreateGitHubRelease creates a GitHub release for the tag v<version> and uploads the generated manifests as assets.
+// Beta and release candidate versions are marked as prereleases.
+func CreateGitHubRelease(client GitHubClient) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		tag := "v" + version
+		prerelease := strings.Contains(version, "-beta") || strings.Contains(version, "-rc")
+		if opts.dryRun("create release %s (prerelease: %t) with assets %s", tag, prerelease, strings.Join(releaseAssets, ", ")) {
+			return nil
+		}
+
+		id, err := client.CreateRelease(tag, prerelease)
+		if err != nil {
+			return fmt.Errorf("failed to create release %s: %s", tag, err)
+		}
+
+		for _, path := range releaseAssets {
+			if err := client.UploadAsset(id, path); err != nil {
+				return fmt.Errorf("failed to upload %s to release %s: %s", path, tag, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// BackportBaseBranch is the branch the version bump of a release branch is merged back into.
+const BackportBaseBranch = "master"
+
+// OpenBackportPR opens a pull request merging the release branch release-<version>, which holds the version bump of
+// version.txt, back into BackportBaseBranch.
+func OpenBackportPR(client GitHubClient) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		head := fmt.Sprintf("release-%s", version)
+		title := fmt.Sprintf("Bump version to %s", version)
+		body := fmt.Sprintf("Updates version.txt to %s, merging back the release branch %s.", version, head)
+		if opts.dryRun("open pull request %q from %s to %s", title, head, BackportBaseBranch) {
+			return nil
+		}
+
+		number, err := client.CreatePullRequest(head, BackportBaseBranch, title, body)
+		if err != nil {
+			return fmt.Errorf("failed to open pull request from %s to %s: %s", head, BackportBaseBranch, err)
+		}
+
+		opts.logf("opened pull request #%d from %s to %s", number, head, BackportBaseBranch)
+		return nil
+	})
+}
+
+// SignArtifacts signs each of the published artifacts of the release, such as the operator image and the generated
+// manifests. A failure doesn't stop the other artifacts from being signed, unless FailFast is set, and the failures are
+// returned together. Signing is skipped when SkipSigning is set.
+func SignArtifacts(signer Signer, refs []string) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		if opts.SkipSigning {
+			opts.logf("skipping signing of %s", strings.Join(refs, ", "))
+			return nil
+		}
+		if opts.dryRun("sign %s", strings.Join(refs, ", ")) {
+			return nil
+		}
+
+		var problems []string
+		for _, ref := range refs {
+			err := signer.Sign(ref)
+			if err == nil {
+				continue
+			}
+			if opts.FailFast {
+				return fmt.Errorf("failed to sign %s: %s", ref, err)
+			}
+			problems = append(problems, fmt.Sprintf("%s: %s", ref, err))
+		}
+
+		if len(problems) > 0 {
+			return fmt.Errorf("failed to sign %d of %d artifacts:\n%s", len(problems), len(refs), strings.Join(problems, "\n"))
+		}
+
+		return nil
 	})
 }
 
-// GenerateFiles runs make release/gen-files passing the appropriate channel options based on the version.
+// VerifyImagesExist ensures the images of the release have been pushed to the registry before it is published. An image
+// without a tag is checked with the tag v<version>, e.g. the operator image, others are checked as is, e.g. the image of
+// the CockroachDB version deployed by default. All the missing images are listed in the returned error.
+func VerifyImagesExist(registry RegistryClient, images []string) Step {
+	return StepFn(func(version string, _ StepOptions) error {
+		var problems []string
+		for _, image := range images {
+			if imageRepository(image) == image {
+				image = fmt.Sprintf("%s:%s", image, imageTag(version))
+			}
+
+			exists, err := registry.ManifestExists(image)
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("%s: %s", image, err))
+			case !exists:
+				problems = append(problems, fmt.Sprintf("%s: not found", image))
+			}
+		}
+
+		if len(problems) > 0 {
+			return fmt.Errorf("missing images:\n%s", strings.Join(problems, "\n"))
+		}
+
+		return nil
+	})
+}
+
+// knownChannels are the channels a release can be published to.
+var knownChannels = []string{"stable", "beta", "rc"}
+
+// channel returns the channel the version is published to: beta or rc for pre-releases, stable otherwise. Build metadata
+// doesn't change the channel.
+func channel(version string) string {
+	if m := channelRegxp.FindStringSubmatch(version); m != nil {
+		return m[1]
+	}
+	return "stable"
+}
+
+// imageTag returns the tag of the images of the version, v<version> without the build metadata, e.g. v2.12.0 for
+// 2.12.0+sha.abc, since a "+" is allowed neither in an image tag nor in the name of a Kubernetes object.
+func imageTag(version string) string {
+	if i := strings.Index(version, "+"); i >= 0 {
+		version = version[:i]
+	}
+	return "v" + version
+}
+
+// releaseChannel returns the channel the version is published to, Channel if set or the one inferred from the version
+// otherwise.
+func (o StepOptions) releaseChannel(version string) (string, error) {
+	if o.Channel == "" {
+		return channel(version), nil
+	}
+
+	for _, ch := range knownChannels {
+		if o.Channel == ch {
+			return ch, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown channel '%s'. Must be one of %s", o.Channel, strings.Join(knownChannels, ", "))
+}
+
+// GenerateFiles runs make release/gen-files passing the appropriate channel options based on the version. Betas and
+// release candidates are published to the beta and rc channels, which are not the default one, unless another channel
+// is set in the options.
 func GenerateFiles(fn ExecFn) Step {
-	return StepFn(func(version string) error {
-		ch := "stable"
+	return StepFn(func(version string, opts StepOptions) error {
+		ch, err := opts.releaseChannel(version)
+		if err != nil {
+			return err
+		}
 		defaultCh := "stable"
 
-		return fn(
-			"make",
-			[]string{"release/gen-files", "CHANNELS=" + ch, "DEFAULT_CHANNEL=" + defaultCh},
-			os.Environ(),
-		)
+		args := []string{"release/gen-files", "CHANNELS=" + ch, "DEFAULT_CHANNEL=" + defaultCh}
+		if opts.dryRun("make %s", strings.Join(args, " ")) {
+			return nil
+		}
+
+		return fn("make", args, os.Environ())
+	})
+}
+
+// CRDDocsDir is where the CRD reference docs are committed, relative to the root of the repository.
+const CRDDocsDir = "docs/crds"
+
+// VerifyCRDDocsUpToDate regenerates the CRD reference docs with make dev/generate-crd-docs into a temporary directory
+// and compares them to the docs committed in CRDDocsDir. It fails with the diff when they differ, which means the docs
+// were not regenerated after the CRDs changed.
+func VerifyCRDDocsUpToDate(fn ExecFn) Step {
+	return StepFn(func(_ string, _ StepOptions) error {
+		dir, err := os.MkdirTemp("", "crd-docs")
+		if err != nil {
+			return fmt.Errorf("failed to create a directory for the CRD docs: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := fn("make", []string{"dev/generate-crd-docs", "CRD_DOCS_DIR=" + dir}, os.Environ()); err != nil {
+			return fmt.Errorf("failed to generate the CRD docs: %s", err)
+		}
+
+		diff, err := diffDirs(CRDDocsDir, dir)
+		if err != nil {
+			return fmt.Errorf("failed to compare the CRD docs: %s", err)
+		}
+		if diff != "" {
+			return fmt.Errorf("CRD docs in %s are out of date, run make dev/generate-crd-docs:\n%s", CRDDocsDir, diff)
+		}
+
+		return nil
+	})
+}
+
+// diffDirs returns the unified diff of the files in dir a and dir b, or an empty string if they have the same files with
+// the same contents.
+func diffDirs(a, b string) (string, error) {
+	files := map[string]bool{}
+	for _, dir := range []string{a, b} {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			files[rel] = true
+			return err
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diff strings.Builder
+	for _, name := range names {
+		before, err := readIfExists(filepath.Join(a, name))
+		if err != nil {
+			return "", err
+		}
+		after, err := readIfExists(filepath.Join(b, name))
+		if err != nil {
+			return "", err
+		}
+		if before == after {
+			continue
+		}
+
+		d, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        difflib.SplitLines(before),
+			B:        difflib.SplitLines(after),
+			FromFile: filepath.Join(a, name),
+			ToFile:   "generated/" + name,
+			Context:  3,
+		})
+		if err != nil {
+			return "", err
+		}
+		diff.WriteString(d)
+	}
+
+	return diff.String(), nil
+}
+
+// readIfExists returns the contents of the file at path, or an empty string if it doesn't exist.
+func readIfExists(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// manifest holds the fields of a Kubernetes object that ValidateGeneratedManifests checks.
+type manifest struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Template struct {
+			Spec struct {
+				Containers []struct {
+					Name  string `yaml:"name"`
+					Image string `yaml:"image"`
+				} `yaml:"containers"`
+			} `yaml:"spec"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+// ValidateGeneratedManifests ensures every YAML file in dir, the output directory of GenerateFiles, is made of
+// well-formed Kubernetes objects, that the CRDs use apiextensions.k8s.io/v1 and that the operator Deployment runs the
+// image of the version being released. All the malformed files are listed in the returned error.
+func ValidateGeneratedManifests(dir string) Step {
+	return StepFn(func(version string, _ StepOptions) error {
+		var problems []string
+		foundDeployment := false
+
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+				return nil
+			}
+
+			deployments, err := validateManifest(path, version)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", path, err))
+			}
+			foundDeployment = foundDeployment || deployments > 0
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read manifests in %s: %s", dir, err)
+		}
+
+		if !foundDeployment {
+			problems = append(problems, fmt.Sprintf("%s: no operator Deployment found", dir))
+		}
+
+		if len(problems) > 0 {
+			sort.Strings(problems)
+			return fmt.Errorf("malformed manifests:\n%s", strings.Join(problems, "\n"))
+		}
+
+		return nil
+	})
+}
+
+// validateManifest checks every object in the YAML file at path and returns the number of Deployments it contains.
+func validateManifest(path, version string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	deployments := 0
+	dec := yaml.NewDecoder(f)
+	for i := 0; ; i++ {
+		var m manifest
+		if err := dec.Decode(&m); err == io.EOF {
+			return deployments, nil
+		} else if err != nil {
+			return deployments, fmt.Errorf("document %d: %s", i, err)
+		}
+
+		switch {
+		case m.APIVersion == "" && m.Kind == "":
+			// empty document, e.g. after a trailing ---
+		case m.APIVersion == "" || m.Kind == "":
+			return deployments, fmt.Errorf("document %d: missing apiVersion or kind", i)
+		case m.Kind == "CustomResourceDefinition" && m.APIVersion != "apiextensions.k8s.io/v1":
+			return deployments, fmt.Errorf("CRD %s has apiVersion %s, expected apiextensions.k8s.io/v1", m.Metadata.Name, m.APIVersion)
+		case m.Kind == "Deployment":
+			if m.APIVersion != "apps/v1" {
+				return deployments, fmt.Errorf("Deployment %s has apiVersion %s, expected apps/v1", m.Metadata.Name, m.APIVersion)
+			}
+			if !runsVersion(m, version) {
+				return deployments, fmt.Errorf("Deployment %s does not run version %s", m.Metadata.Name, version)
+			}
+			deployments++
+		}
+	}
+}
+
+// runsVersion returns true when one of the containers of the Deployment runs an image tagged with the version.
+func runsVersion(m manifest, version string) bool {
+	for _, c := range m.Spec.Template.Spec.Containers {
+		if strings.HasSuffix(c.Image, ":"+imageTag(version)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetOperatorImageTag points the operator Deployment in the manifest at manifestPath to the imageRepo:v<version>
+// image. The container to update is the one running an image of imageRepo, whatever its tag. The rest of the manifest
+// is left untouched.
+func SetOperatorImageTag(manifestPath, imageRepo string) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		image := fmt.Sprintf("%s:%s", imageRepo, imageTag(version))
+
+		data, err := os.ReadFile(manifestPath)
+		if err != nil {
+			return err
+		}
+
+		foundDeployment, foundContainer := false, false
+		docs := strings.Split(string(data), "\n---")
+		for i, doc := range docs {
+			var m manifest
+			if err := yaml.Unmarshal([]byte(doc), &m); err != nil {
+				return fmt.Errorf("%s: document %d: %s", manifestPath, i, err)
+			}
+			if m.Kind != "Deployment" {
+				continue
+			}
+
+			foundDeployment = true
+			for _, c := range m.Spec.Template.Spec.Containers {
+				if imageRepository(c.Image) == imageRepo {
+					docs[i] = replaceImage(docs[i], c.Image, image)
+					foundContainer = true
+				}
+			}
+		}
+
+		if !foundDeployment {
+			return fmt.Errorf("%s: no operator Deployment found", manifestPath)
+		}
+		if !foundContainer {
+			return fmt.Errorf("%s: no container running %s found in the operator Deployment", manifestPath, imageRepo)
+		}
+
+		if opts.dryRun("set the operator image in %s to %s", manifestPath, image) {
+			return nil
+		}
+
+		return os.WriteFile(manifestPath, []byte(strings.Join(docs, "\n---")), 0644)
+	})
+}
+
+// imageRepository strips the tag and digest from image, e.g. cockroachdb/cockroach-operator:v2.14.0 becomes
+// cockroachdb/cockroach-operator.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	return image
+}
+
+// replaceImage replaces the value of the image fields set to from with to in the YAML document doc, keeping quotes.
+func replaceImage(doc, from, to string) string {
+	re := regexp.MustCompile(`(?m)^(\s*-?\s*image:\s*["']?)` + regexp.QuoteMeta(from) + `(["']?\s*)$`)
+	return re.ReplaceAllString(doc, "${1}"+strings.ReplaceAll(to, "$", "$$")+"${2}")
+}
+
+// UpdateCSV prepares the OLM ClusterServiceVersion at csvPath for the release: spec.version is set to the version,
+// spec.replaces to the CSV of the previous release, found from the latest tag lower than the version, and every
+// reference to the operator image, the image of the containerImage annotation, is tagged with the version. The name
+// of the CSV is updated to match the version.
+func UpdateCSV(fn CmdFn, csvPath string) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		proposed, err := semver.StrictNewVersion(version)
+		if err != nil {
+			return fmt.Errorf("%w '%s': %s", ErrInvalidVersion, version, err)
+		}
+
+		previous, err := latestVersion(fn, proposed)
+		if err != nil {
+			return err
+		}
+		if previous == nil {
+			return fmt.Errorf("no release before %s to replace", version)
+		}
+
+		data, err := os.ReadFile(csvPath)
+		if err != nil {
+			return err
+		}
+
+		var csv yaml.MapSlice
+		if err := yaml.Unmarshal(data, &csv); err != nil {
+			return fmt.Errorf("%s: %s", csvPath, err)
+		}
+		if kind, _ := mapValue(csv, "kind").(string); kind != "ClusterServiceVersion" {
+			return fmt.Errorf("%s: not a ClusterServiceVersion", csvPath)
+		}
+
+		name, _ := mapValue(csv, "metadata", "name").(string)
+		image, _ := mapValue(csv, "metadata", "annotations", "containerImage").(string)
+		if name == "" || image == "" {
+			return fmt.Errorf("%s: metadata.name or the containerImage annotation is missing", csvPath)
+		}
+
+		// CSVs are named <package>.v<version>
+		pkg := strings.SplitN(name, ".v", 2)[0]
+		repo := imageRepository(image)
+		csv = setMapValue(csv, fmt.Sprintf("%s.%s", pkg, imageTag(version)), "metadata", "name")
+		csv = setMapValue(csv, version, "spec", "version")
+		csv = setMapValue(csv, fmt.Sprintf("%s.%s", pkg, imageTag(previous.String())), "spec", "replaces")
+		replaceImages(csv, repo, fmt.Sprintf("%s:%s", repo, imageTag(version)))
+
+		out, err := yaml.Marshal(csv)
+		if err != nil {
+			return err
+		}
+		if opts.dryRun("update %s for v%s, replacing v%s", csvPath, version, previous) {
+			return nil
+		}
+
+		return os.WriteFile(csvPath, out, 0644)
+	})
+}
+
+// mapValue returns the value at the path of keys in m, or nil when there is none.
+func mapValue(m yaml.MapSlice, keys ...string) interface{} {
+	for _, item := range m {
+		if item.Key != keys[0] {
+			continue
+		}
+		if len(keys) == 1 {
+			return item.Value
+		}
+		if nested, ok := item.Value.(yaml.MapSlice); ok {
+			return mapValue(nested, keys[1:]...)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// setMapValue sets the value at the path of keys in m, adding the missing keys, and returns the updated map.
+func setMapValue(m yaml.MapSlice, value interface{}, keys ...string) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key != keys[0] {
+			continue
+		}
+		if len(keys) == 1 {
+			m[i].Value = value
+		} else {
+			nested, _ := item.Value.(yaml.MapSlice)
+			m[i].Value = setMapValue(nested, value, keys[1:]...)
+		}
+		return m
+	}
+
+	if len(keys) == 1 {
+		return append(m, yaml.MapItem{Key: keys[0], Value: value})
+	}
+	return append(m, yaml.MapItem{Key: keys[0], Value: setMapValue(nil, value, keys[1:]...)})
+}
+
+// replaceImages sets every image and containerImage field of v that runs an image of repo to image.
+func replaceImages(v interface{}, repo, image string) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			if s, ok := item.Value.(string); ok && (item.Key == "image" || item.Key == "containerImage") {
+				if imageRepository(s) == repo {
+					v[i].Value = image
+				}
+				continue
+			}
+			replaceImages(item.Value, repo, image)
+		}
+	case []interface{}:
+		for _, item := range v {
+			replaceImages(item, repo, image)
+		}
+	}
+}
+
+// NotificationSender sends a message to the release engineers, e.g. to a Slack channel.
+type NotificationSender interface {
+	Send(msg string) error
+}
+
+// WebhookSender is a NotificationSender that posts messages to a Slack compatible incoming webhook.
+type WebhookSender struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send posts the message to the webhook.
+func (w WebhookSender) Send(msg string) error {
+	body, err := json.Marshal(map[string]string{"text": msg})
+	if err != nil {
+		return err
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Notify lets the release engineers know that the release branch for the version has been cut. When failOnError is
+// false, failing to send the notification is logged and doesn't fail the release.
+func Notify(sender NotificationSender, failOnError bool) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		ch, err := opts.releaseChannel(version)
+		if err != nil {
+			return err
+		}
+
+		msg := fmt.Sprintf("Release branch release-%s has been cut for v%s (channel: %s)", version, version, ch)
+		if opts.dryRun("send notification %q", msg) {
+			return nil
+		}
+
+		if err := sender.Send(msg); err != nil {
+			if failOnError {
+				return fmt.Errorf("failed to send notification: %s", err)
+			}
+			opts.logf("failed to send notification, continuing: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// changelogSections are the conventional commit types that get their own section in the changelog, in order. Commits of
+// any other type, or that don't follow the convention, are listed under "Other Changes".
+var changelogSections = []struct {
+	commitType string
+	title      string
+}{
+	{commitType: "feat", title: "Features"},
+	{commitType: "fix", title: "Bug Fixes"},
+	{commitType: "chore", title: "Chores"},
+}
+
+// GenerateChangelog writes the commits since the previous tag to CHANGELOG-<version>.md, grouped by conventional commit
+// type.
+func GenerateChangelog(fn CmdFn) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		prevTag, err := gitOutput(fn, "describe", "--tags", "--abbrev=0")
+		if err != nil {
+			return err
+		}
+
+		log, err := gitOutput(fn, "log", fmt.Sprintf("%s..HEAD", strings.TrimSpace(prevTag)), "--pretty=format:%s")
+		if err != nil {
+			return err
+		}
+
+		sections := map[string][]string{}
+		for _, s := range changelogSections {
+			sections[s.commitType] = nil
+		}
+
+		var other []string
+		for _, subject := range strings.Split(log, "\n") {
+			subject = strings.TrimSpace(subject)
+			if subject == "" {
+				continue
+			}
+
+			commitType, entry := "", subject
+			if m := commitRegxp.FindStringSubmatch(subject); m != nil {
+				commitType, entry = m[1], m[4]
+				if m[3] != "" {
+					entry = fmt.Sprintf("**%s:** %s", m[3], entry)
+				}
+			}
+			if _, ok := sections[commitType]; ok {
+				sections[commitType] = append(sections[commitType], entry)
+			} else {
+				other = append(other, subject)
+			}
+		}
+
+		out := new(bytes.Buffer)
+		fmt.Fprintf(out, "# [v%s]\n", version)
+		writeSection := func(title string, entries []string) {
+			if len(entries) == 0 {
+				return
+			}
+			fmt.Fprintf(out, "\n## %s\n\n", title)
+			for _, e := range entries {
+				fmt.Fprintf(out, "* %s\n", e)
+			}
+		}
+
+		for _, s := range changelogSections {
+			writeSection(s.title, sections[s.commitType])
+		}
+		writeSection("Other Changes", other)
+
+		fileName := fmt.Sprintf("CHANGELOG-%s.md", version)
+		if opts.dryRun("write %s:\n%s", fileName, out.String()) {
+			return nil
+		}
+
+		return os.WriteFile(fileName, out.Bytes(), 0644)
 	})
 }
 
 // UpdateChangelog ensures that the release is setup correctly in the changelog and that a new [Unreleased] section is
-// added appropriately.
+// added appropriately. The previous changelog is restored on rollback.
 func UpdateChangelog(fn FileFn) Step {
 	const fileName = "CHANGELOG.md"
 	const urlFmt = "https://github.com/cockroachdb/cockroach-operator/compare/v%s...%s"
 
-	return StepFn(func(version string) error {
+	// the previous contents are restored on rollback
+	var prev []byte
+	written := false
+
+	apply := StepFn(func(version string, opts StepOptions) error {
 		data, err := fn(fileName)
 		if err != nil {
 			return err
 		}
+		prev = data
 
 		// get the existing and new [Unreleased] lines
 		start := bytes.Index(data, []byte("[Unreleased]"))
@@ -147,7 +1108,41 @@ func UpdateChangelog(fn FileFn) Step {
 		// update to include the new and previous versions
 		newUnreleased = append(newUnreleased, append([]byte("\n\n"), latestRelease...)...)
 		data = bytes.Replace(data, prevUnreleased, newUnreleased, 1)
+		if opts.dryRun("update the [Unreleased] section of %s for v%s", fileName, version) {
+			return nil
+		}
+
+		if err := os.WriteFile(fileName, data, 0644); err != nil {
+			return err
+		}
+		written = true
+		return nil
+	})
 
-		return os.WriteFile(fileName, data, 0644)
+	return WithRollback(apply, func(_ string) error {
+		if !written {
+			return nil
+		}
+		written = false
+		return os.WriteFile(fileName, prev, 0644)
+	})
+}
+
+// VerifyChangelogEntry ensures that the changelog at changelogPath has a heading for the version being released, so
+// that it isn't shipped without release notes. Headings in the style of UpdateChangelog, # [v2.12.0](...), as well as
+// ## [2.12.0] and ## 2.12.0 are recognized.
+func VerifyChangelogEntry(changelogPath string) Step {
+	return StepFn(func(version string, opts StepOptions) error {
+		data, err := os.ReadFile(changelogPath)
+		if err != nil {
+			return err
+		}
+
+		heading := regexp.MustCompile(`(?m)^#+[ \t]+\[?v?` + regexp.QuoteMeta(version) + `(\]|[ \t]|$)`)
+		if !heading.Match(data) {
+			return fmt.Errorf("no entry for version %s found in %s", version, changelogPath)
+		}
+
+		return nil
 	})
 }
@@ -16,14 +16,21 @@ limitations under the License.
 package main_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/cockroachdb/cockroach-operator/hack/release"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
 type mockExecFn struct {
@@ -40,26 +47,124 @@ func (m *mockExecFn) exec(cmd string, args, env []string) error {
 	return m.err
 }
 
+// recordingExecFn records every command it executes and fails the ones whose arguments start with failOn.
+type recordingExecFn struct {
+	cmds   [][]string
+	failOn string
+}
+
+func (r *recordingExecFn) exec(cmd string, args, _ []string) error {
+	r.cmds = append(r.cmds, append([]string{cmd}, args...))
+	if r.failOn != "" && len(args) > 0 && args[0] == r.failOn {
+		return fmt.Errorf("%s failed", r.failOn)
+	}
+	return nil
+}
+
+type mockGitHubClient struct {
+	tag        string
+	prerelease bool
+	assets     []string
+	err        error
+
+	head, base, title, body string
+}
+
+func (m *mockGitHubClient) CreateRelease(tag string, prerelease bool) (int64, error) {
+	m.tag = tag
+	m.prerelease = prerelease
+	return 42, m.err
+}
+
+func (m *mockGitHubClient) UploadAsset(releaseID int64, path string) error {
+	if releaseID != 42 {
+		return fmt.Errorf("unknown release %d", releaseID)
+	}
+	m.assets = append(m.assets, path)
+	return nil
+}
+
+func (m *mockGitHubClient) CreatePullRequest(head, base, title, body string) (int, error) {
+	m.head, m.base, m.title, m.body = head, base, title, body
+	return 7, m.err
+}
+
+type mockSigner struct {
+	signed []string
+	failed map[string]error
+}
+
+func (m *mockSigner) Sign(ref string) error {
+	if err := m.failed[ref]; err != nil {
+		return err
+	}
+	m.signed = append(m.signed, ref)
+	return nil
+}
+
+type mockRegistryClient struct {
+	pushed  map[string]bool
+	checked []string
+}
+
+func (m *mockRegistryClient) ManifestExists(image string) (bool, error) {
+	m.checked = append(m.checked, image)
+	if image == "cockroachdb/broken:v1" {
+		return false, fmt.Errorf("unauthorized")
+	}
+	return m.pushed[image], nil
+}
+
+func TestVerifyCleanWorkingTree(t *testing.T) {
+	cmdFn := func(output string) CmdFn {
+		return func(cmd *exec.Cmd) error {
+			require.Equal(t, []string{"git", "status", "--porcelain"}, cmd.Args)
+
+			_, err := io.WriteString(cmd.Stdout, output)
+			return err
+		}
+	}
+
+	require.NoError(t, VerifyCleanWorkingTree(cmdFn("")).Apply("1.2.3", StepOptions{}))
+	require.EqualError(
+		t,
+		VerifyCleanWorkingTree(cmdFn(" M Makefile\n?? install/crds.yaml\n")).Apply("1.2.3", StepOptions{}),
+		"working tree has uncommitted changes: Makefile, install/crds.yaml",
+	)
+	require.ErrorIs(t, VerifyCleanWorkingTree(cmdFn(" M Makefile\n")).Apply("1.2.3", StepOptions{}), ErrDirtyTree)
+}
+
 func TestValidateVersion(t *testing.T) {
 	tests := []struct {
 		version string
 		isErr   bool
 	}{
 		{version: "20.1.3"},
-		{version: "20.1.3-beta.1", isErr: true},
+		{version: "20.1.3-beta.1"},
 		{version: "v20.1.3", isErr: true},
 		{version: "20.1.3-beta", isErr: true},
 		{version: "2.3.2-beta.A", isErr: true},
 		{version: "2.3.2-beta.1A", isErr: true},
 		{version: "v20.1.3-beta.1", isErr: true},
 		{version: "20.1.3a", isErr: true},
-		{version: "20.1.3-rc.1", isErr: true},
+		{version: "20.1.3-rc.1"},
+		{version: "2.12.0-rc.12"},
+		{version: "20.1.3-rc", isErr: true},
+		{version: "20.1.3-rc.", isErr: true},
+		{version: "20.1.3-rc.A", isErr: true},
+		{version: "v20.1.3-rc.1", isErr: true},
+		{version: "2.12.0+sha.abc"},
+		{version: "2.12.0-beta.1+sha"},
+		{version: "2.12.0-rc.1+abc-1234"},
+		{version: "2.12.0+", isErr: true},
+		{version: "2.12.0+sha+abc", isErr: true},
+		{version: "2.12.0-beta+sha", isErr: true},
 	}
 
 	for _, tt := range tests {
-		err := ValidateVersion().Apply(tt.version)
+		err := ValidateVersion().Apply(tt.version, StepOptions{})
 		if tt.isErr {
-			require.Error(t, err)
+			require.ErrorIs(t, err, ErrInvalidVersion)
 			continue
 		}
 
@@ -75,8 +180,19 @@ func TestEnsureUniqueVersion(t *testing.T) {
 		return err
 	}
 
-	require.NoError(t, EnsureUniqueVersion(cmdFn).Apply("0.1.0"))
-	require.Error(t, EnsureUniqueVersion(cmdFn).Apply("2.1.0"))
+	require.NoError(t, EnsureUniqueVersion(cmdFn).Apply("0.1.0", StepOptions{}))
+	require.ErrorIs(t, EnsureUniqueVersion(cmdFn).Apply("2.1.0", StepOptions{}), ErrVersionExists)
+
+	t.Run("with legacy and non-version tags", func(t *testing.T) {
+		cmdFn := func(cmd *exec.Cmd) error {
+			_, err := io.WriteString(cmd.Stdout, "v\nnightly\n2.1.0\nv2.2.0\nvnext\n")
+			return err
+		}
+
+		require.ErrorIs(t, EnsureUniqueVersion(cmdFn).Apply("2.1.0", StepOptions{}), ErrVersionExists)
+		require.ErrorIs(t, EnsureUniqueVersion(cmdFn).Apply("2.2.0", StepOptions{}), ErrVersionExists)
+		require.NoError(t, EnsureUniqueVersion(cmdFn).Apply("2.3.0", StepOptions{}))
+	})
 
 	t.Run("when executing command fails", func(t *testing.T) {
 		cmdFn := func(cmd *exec.Cmd) error {
@@ -86,14 +202,53 @@ func TestEnsureUniqueVersion(t *testing.T) {
 
 		require.EqualError(
 			t,
-			EnsureUniqueVersion(cmdFn).Apply("2.1.0"),
+			EnsureUniqueVersion(cmdFn).Apply("2.1.0", StepOptions{}),
 			"failed to get tags: command error - boom",
 		)
 	})
 }
 
+func TestEnsureVersionIncreases(t *testing.T) {
+	cmdFn := func(tags string) CmdFn {
+		return func(cmd *exec.Cmd) error {
+			require.Equal(t, []string{"git", "tag"}, cmd.Args)
+
+			_, err := io.WriteString(cmd.Stdout, tags)
+			return err
+		}
+	}
+
+	tests := []struct {
+		name    string
+		tags    string
+		version string
+		isErr   bool
+	}{
+		{name: "greater version", tags: "v2.9.0\nv2.11.0\n", version: "2.12.0"},
+		{name: "lower version", tags: "v2.9.0\nv2.11.0\n", version: "2.9.1", isErr: true},
+		{name: "same version", tags: "v2.11.0\n", version: "2.11.0", isErr: true},
+		{name: "beta before stable", tags: "v2.11.0\n", version: "2.12.0-beta.1"},
+		{name: "stable after beta", tags: "v2.11.0\nv2.12.0-beta.1\n", version: "2.12.0"},
+		{name: "beta after stable", tags: "v2.12.0\n", version: "2.12.0-beta.1", isErr: true},
+		{name: "first release", tags: "", version: "0.1.0"},
+		{name: "non-version tags are ignored", tags: "nightly\nlatest\nv2.11.0\n", version: "2.12.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := EnsureVersionIncreases(cmdFn(tt.tags)).Apply(tt.version, StepOptions{})
+			if tt.isErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
 func TestUpdateVersion(t *testing.T) {
-	require.NoError(t, UpdateVersion().Apply("1.2.3"))
+	require.NoError(t, UpdateVersion().Apply("1.2.3", StepOptions{}))
 
 	v, err := os.ReadFile("version.txt")
 	require.NoError(t, err)
@@ -104,13 +259,295 @@ func TestUpdateVersion(t *testing.T) {
 	require.Equal(t, os.FileMode(0644), info.Mode())
 }
 
+func TestUpdateVersionRollback(t *testing.T) {
+	require.NoError(t, os.WriteFile("version.txt", []byte("1.2.2"), 0644))
+
+	step := UpdateVersion()
+	require.NoError(t, step.Apply("1.2.3", StepOptions{}))
+	require.NoError(t, step.(Rollbacker).Rollback("1.2.3"))
+
+	v, err := os.ReadFile("version.txt")
+	require.NoError(t, err)
+	require.Equal(t, "1.2.2", string(v))
+}
+
+func TestUpdateVersionDryRun(t *testing.T) {
+	require.NoError(t, os.RemoveAll("version.txt"))
+
+	out := new(bytes.Buffer)
+	require.NoError(t, UpdateVersion().Apply("1.2.3", StepOptions{DryRun: true, Out: out}))
+	require.Equal(t, "[dry-run] write 1.2.3 to version.txt\n", out.String())
+
+	_, err := os.Stat("version.txt")
+	require.True(t, os.IsNotExist(err), "version.txt must not be written")
+}
+
 func TestCreateReleaseBranch(t *testing.T) {
 	fn := new(mockExecFn)
-	require.NoError(t, CreateReleaseBranch(fn.exec).Apply("1.2.3"))
+	require.NoError(t, CreateReleaseBranch(fn.exec, "").Apply("1.2.3", StepOptions{}))
 
 	require.Equal(t, "git", fn.cmd)
 	require.Equal(t, []string{"checkout", "-b", "release-1.2.3", "origin/master"}, fn.args)
 	require.Equal(t, os.Environ(), fn.env)
+
+	t.Run("with a base ref", func(t *testing.T) {
+		fn := new(recordingExecFn)
+		require.NoError(t, CreateReleaseBranch(fn.exec, "origin/release-23.1").Apply("1.2.3", StepOptions{}))
+		require.Equal(t, [][]string{
+			{"git", "rev-parse", "--verify", "origin/release-23.1"},
+			{"git", "checkout", "-b", "release-1.2.3", "origin/release-23.1"},
+		}, fn.cmds)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		fn := new(recordingExecFn)
+		step := CreateReleaseBranch(fn.exec, "")
+		require.NoError(t, step.(Rollbacker).Rollback("1.2.3"))
+		require.Empty(t, fn.cmds, "nothing must be rolled back before the branch is created")
+
+		require.NoError(t, step.Apply("1.2.3", StepOptions{}))
+		require.NoError(t, step.(Rollbacker).Rollback("1.2.3"))
+		require.Equal(t, [][]string{
+			{"git", "rev-parse", "--verify", "origin/master"},
+			{"git", "checkout", "-b", "release-1.2.3", "origin/master"},
+			{"git", "checkout", "-"},
+			{"git", "branch", "-D", "release-1.2.3"},
+		}, fn.cmds)
+	})
+
+	t.Run("with dry run", func(t *testing.T) {
+		fn := new(recordingExecFn)
+		out := new(bytes.Buffer)
+		require.NoError(t, CreateReleaseBranch(fn.exec, "").Apply("1.2.3", StepOptions{DryRun: true, Out: out}))
+		require.Equal(t, [][]string{{"git", "rev-parse", "--verify", "origin/master"}}, fn.cmds, "only the base ref must be verified")
+		require.Equal(t, "[dry-run] git checkout -b release-1.2.3 origin/master\n", out.String())
+	})
+
+	t.Run("when the base ref does not exist", func(t *testing.T) {
+		fn := &recordingExecFn{failOn: "rev-parse"}
+		require.EqualError(
+			t,
+			CreateReleaseBranch(fn.exec, "origin/release-0.1").Apply("1.2.3", StepOptions{}),
+			"base ref origin/release-0.1 does not exist: rev-parse failed",
+		)
+		require.Len(t, fn.cmds, 1, "no branch must be created")
+	})
+}
+
+func TestPushTag(t *testing.T) {
+	fn := new(recordingExecFn)
+	require.NoError(t, PushTag(fn.exec, "upstream").Apply("1.2.3", StepOptions{}))
+	require.Equal(t, [][]string{
+		{"git", "tag", "-a", "v1.2.3", "-m", "Release v1.2.3", "release-1.2.3"},
+		{"git", "push", "upstream", "v1.2.3"},
+	}, fn.cmds)
+
+	t.Run("when the tag already exists", func(t *testing.T) {
+		fn := &recordingExecFn{failOn: "tag"}
+		require.EqualError(t, PushTag(fn.exec, "origin").Apply("1.2.3", StepOptions{}), "failed to create tag v1.2.3: tag failed")
+		require.Len(t, fn.cmds, 1, "nothing must be pushed")
+	})
+
+	t.Run("when pushing fails", func(t *testing.T) {
+		fn := &recordingExecFn{failOn: "push"}
+		require.EqualError(t, PushTag(fn.exec, "origin").Apply("1.2.3", StepOptions{}), "failed to push tag v1.2.3 to origin: push failed")
+	})
+}
+
+func TestPushTagToRemotes(t *testing.T) {
+	// failingPush records the commands and fails the pushes to the gerrit remote.
+	var cmds [][]string
+	failingPush := func(cmd string, args, _ []string) error {
+		cmds = append(cmds, append([]string{cmd}, args...))
+		if args[0] == "push" && args[1] == "gerrit" {
+			return fmt.Errorf("permission denied")
+		}
+		return nil
+	}
+
+	fn := new(recordingExecFn)
+	require.NoError(t, PushTagToRemotes(fn.exec, []string{"origin", "gerrit"}).Apply("1.2.3", StepOptions{}))
+	require.Equal(t, [][]string{
+		{"git", "tag", "-a", "v1.2.3", "-m", "Release v1.2.3", "release-1.2.3"},
+		{"git", "push", "origin", "v1.2.3"},
+		{"git", "push", "gerrit", "v1.2.3"},
+	}, fn.cmds)
+
+	t.Run("when pushing to a remote fails", func(t *testing.T) {
+		cmds = nil
+		err := PushTagToRemotes(failingPush, []string{"gerrit", "origin"}).Apply("1.2.3", StepOptions{})
+		require.EqualError(t, err, "failed to push tag v1.2.3 to 1 of 2 remotes:\ngerrit: permission denied")
+		require.Contains(t, cmds, []string{"git", "push", "origin", "v1.2.3"}, "the other remotes must still be pushed")
+	})
+
+	t.Run("with FailFast", func(t *testing.T) {
+		cmds = nil
+		err := PushTagToRemotes(failingPush, []string{"gerrit", "origin"}).Apply("1.2.3", StepOptions{FailFast: true})
+		require.EqualError(t, err, "failed to push tag v1.2.3 to gerrit: permission denied")
+		require.NotContains(t, cmds, []string{"git", "push", "origin", "v1.2.3"})
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		fn := new(recordingExecFn)
+		out := new(bytes.Buffer)
+		require.NoError(t, PushTagToRemotes(fn.exec, []string{"origin", "gerrit"}).Apply("1.2.3", StepOptions{DryRun: true, Out: out}))
+		require.Empty(t, fn.cmds)
+		require.Equal(t, "[dry-run] create tag v1.2.3 on release-1.2.3 and push it to origin, gerrit\n", out.String())
+	})
+}
+
+func TestVerifyCRDDocsUpToDate(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(t.TempDir()))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+
+	require.NoError(t, os.MkdirAll(CRDDocsDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(CRDDocsDir, "crdbcluster.md"), []byte("# CrdbCluster\nimage\n"), 0644))
+
+	// generate fakes make dev/generate-crd-docs, writing docs into CRD_DOCS_DIR.
+	generate := func(docs map[string]string) ExecFn {
+		return func(cmd string, args, _ []string) error {
+			require.Equal(t, "make", cmd)
+			require.Equal(t, "dev/generate-crd-docs", args[0])
+			dir := strings.TrimPrefix(args[1], "CRD_DOCS_DIR=")
+			for name, content := range docs {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	step := VerifyCRDDocsUpToDate(generate(map[string]string{"crdbcluster.md": "# CrdbCluster\nimage\n"}))
+	require.NoError(t, step.Apply("1.2.3", StepOptions{}))
+
+	t.Run("when the docs drift", func(t *testing.T) {
+		step := VerifyCRDDocsUpToDate(generate(map[string]string{
+			"crdbcluster.md": "# CrdbCluster\nimage\nnodes\n",
+			"crdbtenant.md":  "# CrdbTenant\n",
+		}))
+
+		err := step.Apply("1.2.3", StepOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "CRD docs in docs/crds are out of date, run make dev/generate-crd-docs")
+		require.Contains(t, err.Error(), "+++ generated/crdbcluster.md")
+		require.Contains(t, err.Error(), "\n+nodes\n")
+		require.Contains(t, err.Error(), "+++ generated/crdbtenant.md")
+	})
+
+	t.Run("when the docs can't be generated", func(t *testing.T) {
+		step := VerifyCRDDocsUpToDate(func(string, []string, []string) error { return fmt.Errorf("no such target") })
+		require.EqualError(t, step.Apply("1.2.3", StepOptions{}), "failed to generate the CRD docs: no such target")
+	})
+}
+
+func TestCreateGitHubRelease(t *testing.T) {
+	tests := []struct {
+		version    string
+		prerelease bool
+	}{
+		{version: "2.1.0"},
+		{version: "2.1.0-beta.1", prerelease: true},
+		{version: "2.1.0-rc.1", prerelease: true},
+	}
+
+	for _, tt := range tests {
+		client := new(mockGitHubClient)
+		require.NoError(t, CreateGitHubRelease(client).Apply(tt.version, StepOptions{}))
+		require.Equal(t, "v"+tt.version, client.tag)
+		require.Equal(t, tt.prerelease, client.prerelease)
+		require.Equal(t, []string{"install/crds.yaml", "install/operator.yaml"}, client.assets)
+	}
+
+	t.Run("when creating the release fails", func(t *testing.T) {
+		client := &mockGitHubClient{err: fmt.Errorf("boom")}
+		require.EqualError(t, CreateGitHubRelease(client).Apply("2.1.0", StepOptions{}), "failed to create release v2.1.0: boom")
+		require.Empty(t, client.assets)
+	})
+}
+
+func TestOpenBackportPR(t *testing.T) {
+	client := new(mockGitHubClient)
+	require.NoError(t, OpenBackportPR(client).Apply("2.1.0", StepOptions{}))
+	require.Equal(t, "release-2.1.0", client.head)
+	require.Equal(t, "master", client.base)
+	require.Contains(t, client.title, "2.1.0")
+	require.Contains(t, client.body, "2.1.0")
+
+	t.Run("when opening the pull request fails", func(t *testing.T) {
+		client := &mockGitHubClient{err: fmt.Errorf("boom")}
+		require.EqualError(t, OpenBackportPR(client).Apply("2.1.0", StepOptions{}),
+			"failed to open pull request from release-2.1.0 to master: boom")
+	})
+
+	t.Run("in dry run mode", func(t *testing.T) {
+		client := new(mockGitHubClient)
+		require.NoError(t, OpenBackportPR(client).Apply("2.1.0", StepOptions{DryRun: true}))
+		require.Empty(t, client.head)
+	})
+}
+
+func TestSignArtifacts(t *testing.T) {
+	refs := []string{"cockroachdb/cockroach-operator:v2.1.0", "install/crds.yaml", "install/operator.yaml"}
+
+	signer := new(mockSigner)
+	require.NoError(t, SignArtifacts(signer, refs).Apply("2.1.0", StepOptions{}))
+	require.Equal(t, refs, signer.signed)
+
+	t.Run("lists the artifacts that failed to sign", func(t *testing.T) {
+		signer := &mockSigner{failed: map[string]error{
+			"cockroachdb/cockroach-operator:v2.1.0": fmt.Errorf("no identity token"),
+			"install/crds.yaml":                     fmt.Errorf("boom"),
+		}}
+		err := SignArtifacts(signer, refs).Apply("2.1.0", StepOptions{})
+		require.EqualError(t, err, "failed to sign 2 of 3 artifacts:\n"+
+			"cockroachdb/cockroach-operator:v2.1.0: no identity token\n"+
+			"install/crds.yaml: boom")
+		require.Equal(t, []string{"install/operator.yaml"}, signer.signed)
+	})
+
+	t.Run("stops at the first failure with FailFast", func(t *testing.T) {
+		signer := &mockSigner{failed: map[string]error{"install/crds.yaml": fmt.Errorf("boom")}}
+		err := SignArtifacts(signer, refs).Apply("2.1.0", StepOptions{FailFast: true})
+		require.EqualError(t, err, "failed to sign install/crds.yaml: boom")
+		require.Equal(t, []string{"cockroachdb/cockroach-operator:v2.1.0"}, signer.signed)
+	})
+
+	t.Run("skips signing for dev releases", func(t *testing.T) {
+		var out bytes.Buffer
+		signer := new(mockSigner)
+		require.NoError(t, SignArtifacts(signer, refs).Apply("2.1.0", StepOptions{SkipSigning: true, Out: &out}))
+		require.Empty(t, signer.signed)
+		require.Contains(t, out.String(), "skipping signing of cockroachdb/cockroach-operator:v2.1.0")
+	})
+}
+
+func TestVerifyImagesExist(t *testing.T) {
+	registry := &mockRegistryClient{pushed: map[string]bool{
+		"cockroachdb/cockroach-operator:v2.14.0": true,
+		"cockroachdb/cockroach:v23.1.11":         true,
+	}}
+	images := []string{"cockroachdb/cockroach-operator", "cockroachdb/cockroach:v23.1.11"}
+
+	require.NoError(t, VerifyImagesExist(registry, images).Apply("2.14.0", StepOptions{}))
+	require.Equal(t, []string{"cockroachdb/cockroach-operator:v2.14.0", "cockroachdb/cockroach:v23.1.11"}, registry.checked)
+
+	t.Run("with build metadata", func(t *testing.T) {
+		registry := &mockRegistryClient{pushed: registry.pushed}
+
+		require.NoError(t, VerifyImagesExist(registry, images).Apply("2.14.0+sha.abc", StepOptions{}))
+		require.Equal(t, []string{"cockroachdb/cockroach-operator:v2.14.0", "cockroachdb/cockroach:v23.1.11"}, registry.checked)
+	})
+
+	t.Run("lists the missing images", func(t *testing.T) {
+		images := append(images, "cockroachdb/broken:v1")
+		err := VerifyImagesExist(registry, images).Apply("2.15.0", StepOptions{})
+		require.EqualError(t, err, "missing images:\n"+
+			"cockroachdb/cockroach-operator:v2.15.0: not found\n"+
+			"cockroachdb/broken:v1: unauthorized")
+	})
 }
 
 func TestGenerateFiles(t *testing.T) {
@@ -121,16 +558,337 @@ func TestGenerateFiles(t *testing.T) {
 		args    []string
 	}{
 		{version: "2.1.0", args: []string{"release/gen-files", "CHANNELS=stable", "DEFAULT_CHANNEL=stable"}},
+		{version: "2.12.0-rc.1", args: []string{"release/gen-files", "CHANNELS=rc", "DEFAULT_CHANNEL=stable"}},
+		{version: "2.12.0-beta.1", args: []string{"release/gen-files", "CHANNELS=beta", "DEFAULT_CHANNEL=stable"}},
+		{version: "2.12.0+sha.abc", args: []string{"release/gen-files", "CHANNELS=stable", "DEFAULT_CHANNEL=stable"}},
+		{version: "2.12.0-rc.1+sha.abc", args: []string{"release/gen-files", "CHANNELS=rc", "DEFAULT_CHANNEL=stable"}},
 	}
 
 	for _, tt := range tests {
-		require.NoError(t, GenerateFiles(fn.exec).Apply(tt.version))
+		require.NoError(t, GenerateFiles(fn.exec).Apply(tt.version, StepOptions{}))
 		require.Equal(t, "make", fn.cmd)
 		require.Equal(t, tt.args, fn.args)
 		require.Equal(t, os.Environ(), fn.env)
 	}
 }
 
+func TestGenerateFilesChannelOverride(t *testing.T) {
+	fn := new(mockExecFn)
+
+	require.NoError(t, GenerateFiles(fn.exec).Apply("2.12.0-beta.1", StepOptions{Channel: "stable"}))
+	require.Equal(t, []string{"release/gen-files", "CHANNELS=stable", "DEFAULT_CHANNEL=stable"}, fn.args)
+
+	require.NoError(t, GenerateFiles(fn.exec).Apply("2.12.0", StepOptions{Channel: "rc"}))
+	require.Equal(t, []string{"release/gen-files", "CHANNELS=rc", "DEFAULT_CHANNEL=stable"}, fn.args)
+
+	fn = new(mockExecFn)
+	require.EqualError(
+		t,
+		GenerateFiles(fn.exec).Apply("2.12.0", StepOptions{Channel: "nightly"}),
+		"unknown channel 'nightly'. Must be one of stable, beta, rc",
+	)
+	require.Empty(t, fn.cmd, "make must not run with an unknown channel")
+}
+
+type mockSender struct {
+	msgs []string
+	err  error
+}
+
+func (m *mockSender) Send(msg string) error {
+	m.msgs = append(m.msgs, msg)
+	return m.err
+}
+
+func TestValidateGeneratedManifests(t *testing.T) {
+	t.Run("lists the malformed manifests", func(t *testing.T) {
+		err := ValidateGeneratedManifests("testdata/manifests").Apply("2.14.0", StepOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "broken.yaml")
+		require.NotContains(t, err.Error(), "crds.yaml")
+		require.NotContains(t, err.Error(), "operator.yaml")
+	})
+
+	dir := t.TempDir()
+	for _, f := range []string{"crds.yaml", "operator.yaml"} {
+		content, err := os.ReadFile(filepath.Join("testdata/manifests", f))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), content, 0644))
+	}
+
+	t.Run("with well-formed manifests", func(t *testing.T) {
+		require.NoError(t, ValidateGeneratedManifests(dir).Apply("2.14.0", StepOptions{}))
+	})
+
+	t.Run("when the operator runs another version", func(t *testing.T) {
+		err := ValidateGeneratedManifests(dir).Apply("2.15.0", StepOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "Deployment cockroach-operator-manager does not run version 2.15.0")
+	})
+
+	t.Run("with build metadata", func(t *testing.T) {
+		// the image of the operator is tagged without the build metadata
+		require.NoError(t, ValidateGeneratedManifests(dir).Apply("2.14.0+sha.abc", StepOptions{}))
+	})
+
+	t.Run("without an operator Deployment", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(dir, "operator.yaml")))
+
+		err := ValidateGeneratedManifests(dir).Apply("2.14.0", StepOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "no operator Deployment found")
+	})
+}
+
+func TestSetOperatorImageTag(t *testing.T) {
+	const repo = "cockroachdb/cockroach-operator"
+
+	content, err := os.ReadFile("testdata/bundle.yaml")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "bundle.yaml")
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	t.Run("dry run", func(t *testing.T) {
+		require.NoError(t, SetOperatorImageTag(path, repo).Apply("2.14.0", StepOptions{DryRun: true}))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, string(content), string(data))
+	})
+
+	require.NoError(t, SetOperatorImageTag(path, repo).Apply("2.14.0", StepOptions{}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	want := strings.Replace(string(content), `"cockroachdb/cockroach-operator:v2.13.0"`, `"cockroachdb/cockroach-operator:v2.14.0"`, 1)
+	require.Equal(t, want, string(data))
+
+	t.Run("with build metadata", func(t *testing.T) {
+		require.NoError(t, SetOperatorImageTag(path, repo).Apply("2.15.0+sha.abc", StepOptions{}))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Contains(t, string(data), `"cockroachdb/cockroach-operator:v2.15.0"`)
+		require.NotContains(t, string(data), "sha.abc")
+	})
+
+	t.Run("without the operator container", func(t *testing.T) {
+		err := SetOperatorImageTag(path, "cockroachdb/other").Apply("2.14.0", StepOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "no container running cockroachdb/other found")
+	})
+
+	t.Run("without an operator Deployment", func(t *testing.T) {
+		err := SetOperatorImageTag("testdata/manifests/crds.yaml", repo).Apply("2.14.0", StepOptions{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "no operator Deployment found")
+	})
+}
+
+func TestUpdateCSV(t *testing.T) {
+	const operatorImage = "registry.connect.redhat.com/cockroachdb/cockroachdb-operator"
+
+	tags := func(tags string) CmdFn {
+		return func(cmd *exec.Cmd) error {
+			require.Equal(t, []string{"git", "tag"}, cmd.Args)
+
+			_, err := io.WriteString(cmd.Stdout, tags)
+			return err
+		}
+	}
+
+	content, err := os.ReadFile("testdata/csv.yaml")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "csv.yaml")
+	require.NoError(t, os.WriteFile(path, content, 0644))
+
+	// v2.14.0-beta.1 was tagged before the release
+	require.NoError(t, UpdateCSV(tags("v2.12.0\nv2.13.0\nnightly\nv2.14.0-beta.1\n"), path).Apply("2.14.0", StepOptions{}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var csv struct {
+		Metadata struct {
+			Name        string            `yaml:"name"`
+			Annotations map[string]string `yaml:"annotations"`
+		} `yaml:"metadata"`
+		Spec struct {
+			Version  string `yaml:"version"`
+			Replaces string `yaml:"replaces"`
+			Install  struct {
+				Spec struct {
+					Deployments []struct {
+						Spec struct {
+							Template struct {
+								Spec struct {
+									Containers []struct {
+										Image string `yaml:"image"`
+									} `yaml:"containers"`
+								} `yaml:"spec"`
+							} `yaml:"template"`
+						} `yaml:"spec"`
+					} `yaml:"deployments"`
+				} `yaml:"spec"`
+			} `yaml:"install"`
+			RelatedImages []struct {
+				Image string `yaml:"image"`
+			} `yaml:"relatedImages"`
+		} `yaml:"spec"`
+	}
+	require.NoError(t, yaml.Unmarshal(data, &csv))
+
+	require.Equal(t, "cockroach-operator.v2.14.0", csv.Metadata.Name)
+	require.Equal(t, "2.14.0", csv.Spec.Version)
+	require.Equal(t, "cockroach-operator.v2.14.0-beta.1", csv.Spec.Replaces)
+	require.Equal(t, operatorImage+":v2.14.0", csv.Metadata.Annotations["containerImage"])
+	require.Equal(t, operatorImage+":v2.14.0", csv.Spec.Install.Spec.Deployments[0].Spec.Template.Spec.Containers[0].Image)
+	require.Equal(t, operatorImage+":v2.14.0", csv.Spec.RelatedImages[1].Image)
+	// the images of CockroachDB are left untouched
+	require.Contains(t, csv.Spec.RelatedImages[0].Image, "cockroachdb/cockroach@sha256:")
+
+	t.Run("with build metadata", func(t *testing.T) {
+		require.NoError(t, UpdateCSV(tags("v2.13.0\nv2.14.0\n"), path).Apply("2.15.0+sha.abc", StepOptions{}))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, yaml.Unmarshal(data, &csv))
+
+		// the build metadata is only kept in the version, it isn't allowed in names nor image tags
+		require.Equal(t, "cockroach-operator.v2.15.0", csv.Metadata.Name)
+		require.Equal(t, "2.15.0+sha.abc", csv.Spec.Version)
+		require.Equal(t, "cockroach-operator.v2.14.0", csv.Spec.Replaces)
+		require.Equal(t, operatorImage+":v2.15.0", csv.Metadata.Annotations["containerImage"])
+		require.Equal(t, operatorImage+":v2.15.0", csv.Spec.Install.Spec.Deployments[0].Spec.Template.Spec.Containers[0].Image)
+		require.Equal(t, operatorImage+":v2.15.0", csv.Spec.RelatedImages[1].Image)
+	})
+
+	t.Run("without a previous release", func(t *testing.T) {
+		err := UpdateCSV(tags("nightly\n"), path).Apply("2.14.0", StepOptions{})
+		require.EqualError(t, err, "no release before 2.14.0 to replace")
+	})
+
+	t.Run("with another kind of manifest", func(t *testing.T) {
+		err := UpdateCSV(tags("v2.13.0\n"), "testdata/bundle.yaml").Apply("2.14.0", StepOptions{})
+		require.Error(t, err)
+	})
+}
+
+func TestNotify(t *testing.T) {
+	sender := new(mockSender)
+	require.NoError(t, Notify(sender, true).Apply("2.12.0-rc.1", StepOptions{}))
+	require.Equal(t, []string{"Release branch release-2.12.0-rc.1 has been cut for v2.12.0-rc.1 (channel: rc)"}, sender.msgs)
+
+	t.Run("channel override", func(t *testing.T) {
+		sender := new(mockSender)
+		require.NoError(t, Notify(sender, true).Apply("2.12.0-beta.1", StepOptions{Channel: "stable"}))
+		require.Equal(t, []string{"Release branch release-2.12.0-beta.1 has been cut for v2.12.0-beta.1 (channel: stable)"}, sender.msgs)
+	})
+
+	t.Run("unknown channel", func(t *testing.T) {
+		sender := new(mockSender)
+		require.Error(t, Notify(sender, true).Apply("2.12.0", StepOptions{Channel: "nightly"}))
+		require.Empty(t, sender.msgs)
+	})
+
+	t.Run("fail soft", func(t *testing.T) {
+		sender := &mockSender{err: fmt.Errorf("boom")}
+		out := new(bytes.Buffer)
+		require.NoError(t, Notify(sender, false).Apply("2.12.0", StepOptions{Out: out}))
+		require.Equal(t, "failed to send notification, continuing: boom\n", out.String())
+	})
+
+	t.Run("fail hard", func(t *testing.T) {
+		sender := &mockSender{err: fmt.Errorf("boom")}
+		require.EqualError(t, Notify(sender, true).Apply("2.12.0", StepOptions{}), "failed to send notification: boom")
+	})
+}
+
+func TestWebhookSender(t *testing.T) {
+	var body map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, WebhookSender{URL: srv.URL}.Send("hello"))
+	require.Equal(t, map[string]string{"text": "hello"}, body)
+
+	t.Run("when the webhook fails", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer srv.Close()
+
+		require.EqualError(t, WebhookSender{URL: srv.URL}.Send("hello"), "webhook returned 404 Not Found")
+	})
+}
+
+func TestGenerateChangelog(t *testing.T) {
+	cmdFn := func(cmd *exec.Cmd) error {
+		switch cmd.Args[1] {
+		case "describe":
+			require.Equal(t, []string{"git", "describe", "--tags", "--abbrev=0"}, cmd.Args)
+			_, err := io.WriteString(cmd.Stdout, "v2.0.0\n")
+			return err
+		case "log":
+			require.Equal(t, []string{"git", "log", "v2.0.0..HEAD", "--pretty=format:%s"}, cmd.Args)
+			_, err := io.WriteString(cmd.Stdout, strings.Join([]string{
+				"feat: add rc channel",
+				"fix(update): handle tags without a v prefix",
+				"Merge pull request #42 from some/branch",
+				"chore: bump dependencies",
+				"feat(release)!: push tags",
+				"docs: fix typo",
+			}, "\n"))
+			return err
+		}
+		return fmt.Errorf("unexpected command %v", cmd.Args)
+	}
+
+	expected := `# [v2.1.0]
+
+## Features
+
+* add rc channel
+* **release:** push tags
+
+## Bug Fixes
+
+* **update:** handle tags without a v prefix
+
+## Chores
+
+* bump dependencies
+
+## Other Changes
+
+* Merge pull request #42 from some/branch
+* docs: fix typo
+`
+
+	t.Cleanup(func() { _ = os.Remove("CHANGELOG-2.1.0.md") })
+	require.NoError(t, GenerateChangelog(cmdFn).Apply("2.1.0", StepOptions{}))
+
+	data, err := os.ReadFile("CHANGELOG-2.1.0.md")
+	require.NoError(t, err)
+	require.Equal(t, expected, string(data))
+
+	t.Run("when there is no previous tag", func(t *testing.T) {
+		cmdFn := func(cmd *exec.Cmd) error {
+			_, _ = io.WriteString(cmd.Stderr, "No names found")
+			return fmt.Errorf("exit status 128")
+		}
+
+		require.EqualError(
+			t,
+			GenerateChangelog(cmdFn).Apply("2.1.0", StepOptions{}),
+			"failed to run git describe: No names found - exit status 128",
+		)
+	})
+}
+
 func TestUpdateChangelog(t *testing.T) {
 	input := `
 # CHANGELOG yada yada yada
@@ -158,10 +916,62 @@ func TestUpdateChangelog(t *testing.T) {
 # [v0.9.0](https://github.com/cockroachdb/cockroach-operator/compare/v0.8.0...v0.9.0)
 `
 
-	err := UpdateChangelog(func(_ string) ([]byte, error) { return []byte(input), nil }).Apply("1.1.0")
+	err := UpdateChangelog(func(_ string) ([]byte, error) { return []byte(input), nil }).Apply("1.1.0", StepOptions{})
 	require.NoError(t, err)
 
 	data, err := os.ReadFile("CHANGELOG.md")
 	require.NoError(t, err)
 	require.Equal(t, string(data), expected)
 }
+
+func TestUpdateChangelogRollback(t *testing.T) {
+	input := `# CHANGELOG
+# [Unreleased](https://github.com/cockroachdb/cockroach-operator/compare/v1.0.0...master)
+
+* Some unreleased content
+`
+	require.NoError(t, os.RemoveAll("CHANGELOG.md"))
+
+	step := UpdateChangelog(func(_ string) ([]byte, error) { return []byte(input), nil })
+	require.NoError(t, step.(Rollbacker).Rollback("1.1.0"))
+	_, err := os.Stat("CHANGELOG.md")
+	require.True(t, os.IsNotExist(err), "nothing must be rolled back before the changelog is written")
+
+	require.NoError(t, step.Apply("1.1.0", StepOptions{}))
+	require.NoError(t, step.(Rollbacker).Rollback("1.1.0"))
+
+	data, err := os.ReadFile("CHANGELOG.md")
+	require.NoError(t, err)
+	require.Equal(t, input, string(data))
+}
+
+func TestVerifyChangelogEntry(t *testing.T) {
+	changelog := filepath.Join(t.TempDir(), "CHANGELOG.md")
+	require.NoError(t, os.WriteFile(changelog, []byte(`# CHANGELOG
+
+# [Unreleased](https://github.com/cockroachdb/cockroach-operator/compare/v2.12.0...master)
+
+## [2.12.0]
+
+* Some content
+
+## 2.11.0
+
+# [v2.10.0](https://github.com/cockroachdb/cockroach-operator/compare/v2.9.0...v2.10.0)
+
+## 2.9.0-rc.1
+`), 0644))
+
+	for _, version := range []string{"2.12.0", "2.11.0", "2.10.0", "2.9.0-rc.1"} {
+		require.NoError(t, VerifyChangelogEntry(changelog).Apply(version, StepOptions{}))
+	}
+
+	for _, version := range []string{"2.13.0", "2.1.0", "2.9.0"} {
+		require.EqualError(t, VerifyChangelogEntry(changelog).Apply(version, StepOptions{}),
+			fmt.Sprintf("no entry for version %s found in %s", version, changelog))
+	}
+
+	t.Run("when the changelog is missing", func(t *testing.T) {
+		require.Error(t, VerifyChangelogEntry(filepath.Join(t.TempDir(), "CHANGELOG.md")).Apply("2.12.0", StepOptions{}))
+	})
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// VerificationFailuresAnnotation counts, across reconciles, the consecutive
+// times the verification of an updated pod gave up. It is only maintained when
+// the strategy has a maximum of consecutive failures.
+const VerificationFailuresAnnotation = "crdb.cockroachlabs.com/verification-failures"
+
+// ErrAutoPaused is returned when the update was paused by setting the
+// PauseUpdateAnnotation because the verification of the updated pods failed
+// too many times in a row. The update resumes once the annotation is removed.
+var ErrAutoPaused = errors.New("update paused after repeated verification failures")
+
+// recordVerificationFailure increments the VerificationFailuresAnnotation of
+// the StatefulSet and, once it reaches maxFailures, resets it and pauses the
+// update. It returns true when the update was paused.
+func recordVerificationFailure(updateSts *UpdateSts, maxFailures int, l logr.Logger) (bool, error) {
+	paused := false
+	err := updateSts.retryOnConflict(func() error {
+		stsClient, err := updateSts.statefulSets(updateSts.ctx)
+		if err != nil {
+			return err
+		}
+		sts, err := stsClient.Get(updateSts.ctx, updateSts.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		// A corrupted count starts over.
+		failures, _ := strconv.Atoi(sts.Annotations[VerificationFailuresAnnotation])
+		failures++
+		if sts.Annotations == nil {
+			sts.Annotations = map[string]string{}
+		}
+		paused = failures >= maxFailures
+		if paused {
+			delete(sts.Annotations, VerificationFailuresAnnotation)
+			sts.Annotations[PauseUpdateAnnotation] = "true"
+		} else {
+			sts.Annotations[VerificationFailuresAnnotation] = strconv.Itoa(failures)
+		}
+
+		if stsClient, err = updateSts.statefulSets(updateSts.ctx); err != nil {
+			return err
+		}
+		sts, err = stsClient.Update(updateSts.ctx, sts, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		updateSts.sts = sts
+		l.Info("verification failed", logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace,
+			"consecutiveFailures", failures, "maxConsecutiveFailures", maxFailures, "paused", paused)
+		return nil
+	})
+	if err != nil {
+		return false, handleStsError(err, l, updateSts.name, updateSts.namespace)
+	}
+	return paused, nil
+}
+
+// resetVerificationFailures removes the VerificationFailuresAnnotation of sts,
+// once a batch of pods has been verified.
+func resetVerificationFailures(updateSts *UpdateSts, sts *v1.StatefulSet, l logr.Logger) error {
+	if _, ok := sts.Annotations[VerificationFailuresAnnotation]; !ok {
+		return nil
+	}
+	return updateStatefulSet(updateSts, sts, func(sts *v1.StatefulSet) {
+		delete(sts.Annotations, VerificationFailuresAnnotation)
+	}, l)
+}
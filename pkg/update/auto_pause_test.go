@@ -0,0 +1,77 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPartitionedRollingUpdateStrategyMaxConsecutiveFailures(t *testing.T) {
+	annotations := func(t *testing.T, clientset *fake.Clientset) map[string]string {
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+		require.NoError(t, err)
+		return sts.Annotations
+	}
+
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+	updateTimer.podUpdateTimeout = 20 * time.Millisecond
+	failing := func(*UpdateSts, int, logr.Logger) error { return errors.New("pod not ready") }
+	strategy := PartitionedRollingUpdateStrategy(failing, WithMaxConsecutiveFailures(3))
+
+	// Every reconcile gives up verifying the first pod.
+	for i := 1; i < 3; i++ {
+		_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrAutoPaused))
+		require.Equal(t, map[string]string{VerificationFailuresAnnotation: fmt.Sprint(i)}, annotations(t, clientset))
+	}
+
+	_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.True(t, errors.Is(err, ErrAutoPaused))
+	require.Contains(t, err.Error(), "pod not ready")
+	require.Equal(t, map[string]string{PauseUpdateAnnotation: "true"}, annotations(t, clientset))
+	require.Empty(t, hc.calls)
+
+	// The next reconcile leaves the paused update alone.
+	skipSleep, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.True(t, skipSleep)
+
+	t.Run("a verified batch resets the count", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		updateSts.sts.Annotations[VerificationFailuresAnnotation] = "2"
+		_, err := clientset.AppsV1().StatefulSets(testStsNamespace).Update(context.Background(), updateSts.sts, metav1.UpdateOptions{})
+		require.NoError(t, err)
+
+		strategy := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset), WithMaxConsecutiveFailures(3))
+		_, err = strategy(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Empty(t, annotations(t, clientset))
+		require.Equal(t, int32(0), currentPartition(t, clientset))
+	})
+}
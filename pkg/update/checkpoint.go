@@ -0,0 +1,82 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"strconv"
+
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/apps/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LastUpdatedPartitionAnnotation records the last partition that was updated,
+// verified and probed by PartitionedRollingUpdateStrategy, so that a rollout
+// spanning several reconciles resumes below it. It is removed once the rollout
+// completes.
+const LastUpdatedPartitionAnnotation = "crdb.cockroachlabs.com/last-updated-partition"
+
+// checkpointPartition returns the partition recorded in the
+// LastUpdatedPartitionAnnotation of the StatefulSet being updated. The
+// checkpoint is only trusted when the StatefulSet already has the desired pod
+// template, otherwise it belongs to a previous update.
+func checkpointPartition(updateSts *UpdateSts, replicas int32) (int32, bool) {
+	sts := updateSts.sts
+	val, ok := sts.Annotations[LastUpdatedPartitionAnnotation]
+	if !ok || updateSts.preUpdateTemplate == nil ||
+		!apiequality.Semantic.DeepEqual(*updateSts.preUpdateTemplate, sts.Spec.Template) {
+		return 0, false
+	}
+
+	partition, err := strconv.Atoi(val)
+	if err != nil || partition < 0 || int32(partition) >= replicas {
+		return 0, false
+	}
+	return int32(partition), true
+}
+
+// recordCheckpoint sets the LastUpdatedPartitionAnnotation of the StatefulSet
+// being updated to partition. The StatefulSet is read again first so that
+// annotations set while the partition was being updated are kept.
+func recordCheckpoint(updateSts *UpdateSts, partition int32, l logr.Logger) error {
+	stsClient, err := updateSts.statefulSets(updateSts.ctx)
+	if err != nil {
+		return err
+	}
+	sts, err := stsClient.Get(updateSts.ctx, updateSts.name, metav1.GetOptions{})
+	if err != nil {
+		return handleStsError(err, l, updateSts.name, updateSts.namespace)
+	}
+	return updateStatefulSet(updateSts, sts, func(sts *v1.StatefulSet) {
+		if sts.Annotations == nil {
+			sts.Annotations = map[string]string{}
+		}
+		sts.Annotations[LastUpdatedPartitionAnnotation] = strconv.Itoa(int(partition))
+	}, l)
+}
+
+// clearCheckpoint removes the LastUpdatedPartitionAnnotation of the StatefulSet
+// being updated, once the rollout has completed.
+func clearCheckpoint(updateSts *UpdateSts, l logr.Logger) error {
+	if _, ok := updateSts.sts.Annotations[LastUpdatedPartitionAnnotation]; !ok {
+		return nil
+	}
+	return updateStatefulSet(updateSts, updateSts.sts.DeepCopy(), func(sts *v1.StatefulSet) {
+		delete(sts.Annotations, LastUpdatedPartitionAnnotation)
+	}, l)
+}
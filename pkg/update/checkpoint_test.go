@@ -0,0 +1,150 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPartitionedRollingUpdateStrategyCheckpoint(t *testing.T) {
+	refresh := func(t *testing.T, clientset *fake.Clientset, updateSts *UpdateSts) {
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+		require.NoError(t, err)
+		updateSts.sts = sts
+	}
+
+	hc := &fakeHealthChecker{failAfter: 1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 4, hc)
+	// simulate UpdateRegionStatefulSet applying updateFunc
+	updateSts.preUpdateTemplate = updateSts.sts.Spec.Template.DeepCopy()
+	var verified []int
+	verify := partitionVerificationFunc(clientset)
+	strategy := PartitionedRollingUpdateStrategy(func(update *UpdateSts, podNumber int, l logr.Logger) error {
+		verified = append(verified, podNumber)
+		return verify(update, podNumber, l)
+	})
+
+	// The probe fails after pod 2 was updated, pod 3 is the last one done.
+	_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.Error(t, err)
+	require.Equal(t, []int{3, 2}, hc.calls)
+	refresh(t, clientset, updateSts)
+	require.Equal(t, "3", updateSts.sts.Annotations[LastUpdatedPartitionAnnotation])
+
+	// The next invocation resumes below the checkpoint: pod 3 isn't looked at
+	// again and pod 2, already rolled, is skipped.
+	hc.failAfter = -1
+	hc.calls = nil
+	verified = nil
+	clientset.ClearActions()
+	skipSleep, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.False(t, skipSleep)
+	require.NotContains(t, verified, 3)
+	require.Equal(t, []int{1, 0}, hc.calls)
+	require.Equal(t, []int32{1, 0}, updatedPartitions(clientset))
+	refresh(t, clientset, updateSts)
+	require.NotContains(t, updateSts.sts.Annotations, LastUpdatedPartitionAnnotation)
+
+	t.Run("a checkpoint at partition 0 has nothing left to update", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		updateSts.preUpdateTemplate = updateSts.sts.Spec.Template.DeepCopy()
+		updateSts.sts.Annotations = map[string]string{LastUpdatedPartitionAnnotation: "0"}
+
+		skipSleep, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.True(t, skipSleep)
+		require.Empty(t, updatedPartitions(clientset))
+		require.Empty(t, hc.calls)
+		refresh(t, clientset, updateSts)
+		require.NotContains(t, updateSts.sts.Annotations, LastUpdatedPartitionAnnotation)
+	})
+
+	t.Run("a checkpoint of a previous update is ignored", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		updateSts.preUpdateTemplate = updateSts.sts.Spec.Template.DeepCopy()
+		updateSts.sts.Annotations = map[string]string{LastUpdatedPartitionAnnotation: "1"}
+		updateSts.sts.Spec.Template.Spec.Containers[0].Image = "cockroachdb/cockroach:v21.1.0"
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []int32{2, 1, 0}, updatedPartitions(clientset))
+		require.Equal(t, []int{2, 1, 0}, hc.calls)
+	})
+
+	t.Run("an out of range checkpoint is ignored", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		updateSts.preUpdateTemplate = updateSts.sts.Spec.Template.DeepCopy()
+		updateSts.sts.Annotations = map[string]string{LastUpdatedPartitionAnnotation: "5"}
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []int32{2, 1, 0}, updatedPartitions(clientset))
+	})
+}
+
+func TestPartitionedRollingUpdateStrategyMaxPodsPerInvocation(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxConcurrent  int
+		maxPods        int
+		wantPartitions [][]int32
+	}{
+		{name: "one pod per invocation", maxConcurrent: 1, maxPods: 1, wantPartitions: [][]int32{{4}, {3}, {2}, {1}, {0}}},
+		{name: "two pods per invocation", maxConcurrent: 1, maxPods: 2, wantPartitions: [][]int32{{4, 3}, {2, 1}, {0}}},
+		{name: "the last batch is shrunk", maxConcurrent: 2, maxPods: 3, wantPartitions: [][]int32{{3, 2}, {0}}},
+		{name: "more than the replicas", maxConcurrent: 1, maxPods: 10, wantPartitions: [][]int32{{4, 3, 2, 1, 0}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, updateSts, updateTimer := newTestUpdate(t, 5, hc)
+			updateSts.preUpdateTemplate = updateSts.sts.Spec.Template.DeepCopy()
+			strategy := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset),
+				WithMaxConcurrent(tt.maxConcurrent), WithMaxPodsPerInvocation(tt.maxPods))
+
+			for i, want := range tt.wantPartitions {
+				clientset.ClearActions()
+				_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+				require.NoError(t, err)
+				require.Equal(t, want, updatedPartitions(clientset))
+
+				last := i == len(tt.wantPartitions)-1
+				require.Equal(t, !last, updateSts.incomplete)
+				sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+				require.NoError(t, err)
+				if last {
+					require.NotContains(t, sts.Annotations, LastUpdatedPartitionAnnotation)
+				} else {
+					require.Contains(t, sts.Annotations, LastUpdatedPartitionAnnotation)
+				}
+				updateSts.sts = sts
+			}
+		})
+	}
+}
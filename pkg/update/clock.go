@@ -0,0 +1,149 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/cockroachdb/errors"
+)
+
+// Clock tells the time and waits, it is an interface so that tests can control
+// time instead of waiting for it to pass. See WithClock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock of the time package.
+type realClock struct{}
+
+var _ Clock = realClock{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// defaultClock is the Clock used when none was set with WithClock.
+var defaultClock Clock = realClock{}
+
+// getClock returns the clock of the UpdateTimer, or defaultClock if it has none.
+func (ut *UpdateTimer) getClock() Clock {
+	if ut.clock == nil {
+		return defaultClock
+	}
+	return ut.clock
+}
+
+// clockKey is the context key of the Clock set with WithClock.
+type clockKey struct{}
+
+// withClock returns a copy of ctx that carries clock, so that the health
+// checkers, hooks and wait functions that are given ctx by the update wait on
+// clock as well.
+func withClock(ctx context.Context, clock Clock) context.Context {
+	return context.WithValue(ctx, clockKey{}, clock)
+}
+
+// clockFrom returns the Clock carried by ctx, or defaultClock if it has none.
+func clockFrom(ctx context.Context) Clock {
+	if clock, ok := ctx.Value(clockKey{}).(Clock); ok {
+		return clock
+	}
+	return defaultClock
+}
+
+// withClockTimeout is context.WithTimeout, except that the timeout elapses on
+// clock. The returned context is done with context.DeadlineExceeded once it
+// has. Unlike context.WithTimeout, it reports no deadline unless clock is the
+// real clock, since a deadline on another clock can't be compared to the time
+// of the network connections that use it.
+func withClockTimeout(parent context.Context, clock Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok {
+		return context.WithTimeout(parent, timeout)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	c := &clockTimeoutCtx{Context: ctx}
+	go func() {
+		select {
+		case <-clock.After(timeout):
+			c.mu.Lock()
+			if ctx.Err() == nil {
+				c.err = context.DeadlineExceeded
+			}
+			c.mu.Unlock()
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return c, cancel
+}
+
+// clockTimeoutCtx is the context returned by withClockTimeout.
+type clockTimeoutCtx struct {
+	context.Context
+	mu  sync.Mutex
+	err error
+}
+
+func (c *clockTimeoutCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	return c.Context.Err()
+}
+
+// retryNotify is backoff.RetryNotify, except that it waits between attempts
+// using clock, which also has to be the clock of b.
+func retryNotify(ctx context.Context, clock Clock, b backoff.BackOff, operation backoff.Operation, notify backoff.Notify) error {
+	b.Reset()
+	for {
+		err := operation()
+		if err == nil {
+			return nil
+		}
+		var permanent *backoff.PermanentError
+		if errors.As(err, &permanent) {
+			// A wrapped permanent error keeps the context it was wrapped with.
+			if err == error(permanent) {
+				return permanent.Err
+			}
+			return err
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return err
+		}
+		if notify != nil {
+			notify(err, next)
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-clock.After(next):
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeClock is a Clock that only moves when it is advanced. Sleep advances the
+// clock right away and records the duration.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	slept   []time.Duration
+	waiters []fakeWaiter
+	// waiting is signalled every time After is called.
+	waiting chan struct{}
+}
+
+type fakeWaiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+var _ Clock = &fakeClock{}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), waiting: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.slept = append(c.slept, d)
+	c.mu.Unlock()
+	c.Advance(d)
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := fakeWaiter{until: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, w)
+	}
+	c.waiting <- struct{}{}
+	return w.c
+}
+
+// Advance moves the clock forward by d and fires the waiters that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.until.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiters
+}
+
+// advanceToNextWaiter moves the clock forward to when the earliest waiter is
+// due. It is called after receiving from waiting.
+func (c *fakeClock) advanceToNextWaiter() {
+	c.mu.Lock()
+	var d time.Duration
+	for i, w := range c.waiters {
+		if until := w.until.Sub(c.now); i == 0 || until < d {
+			d = until
+		}
+	}
+	c.mu.Unlock()
+	c.Advance(d)
+}
+
+func TestWaitUntilPerPodVerificationFuncVerifiesFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	_, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	updateTimer.clock = clock
+	updateTimer.podUpdateTimeout = time.Hour
+	updateTimer.podMaxPollingInterval = time.Minute
+
+	attempts := 0
+	verify := func(*UpdateSts, int, logr.Logger) error {
+		attempts++
+		return errors.New("pod not updated")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- waitUntilPerPodVerificationFuncVerifies(context.Background(), updateSts, verify, 0, updateTimer, log.NullLogger{})
+	}()
+
+	start := clock.Now()
+	for {
+		select {
+		case err := <-done:
+			require.Error(t, err)
+			elapsed := clock.Now().Sub(start)
+			require.GreaterOrEqual(t, int64(elapsed), int64(time.Hour), "the verification must be retried until the timeout")
+			require.Less(t, int64(elapsed), int64(time.Hour+2*time.Minute))
+			require.Greater(t, attempts, 60)
+			return
+		case <-clock.waiting:
+			clock.advanceToNextWaiter()
+		}
+	}
+}
+
+func TestWaitUntilPerPodVerificationFuncVerifiesLogInterval(t *testing.T) {
+	run := func(t *testing.T, logInterval time.Duration, succeedAfter int) (int, []observer.LoggedEntry) {
+		clock := newFakeClock()
+		_, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		updateTimer.clock = clock
+		updateTimer.podUpdateTimeout = time.Hour
+		updateTimer.podMaxPollingInterval = time.Minute
+		updateTimer.verificationLogInterval = logInterval
+		l, logs := newObservedLogger()
+
+		attempts := 0
+		verify := func(*UpdateSts, int, logr.Logger) error {
+			attempts++
+			if succeedAfter > 0 && attempts > succeedAfter {
+				return nil
+			}
+			return errors.New("pod not updated")
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- waitUntilPerPodVerificationFuncVerifies(context.Background(), updateSts, verify, 0, updateTimer, l)
+		}()
+		for {
+			select {
+			case <-done:
+				return attempts, logs.All()
+			case <-clock.waiting:
+				clock.advanceToNextWaiter()
+			}
+		}
+	}
+
+	t.Run("logs at most once per interval", func(t *testing.T) {
+		attempts, entries := run(t, 10*time.Minute, 0)
+		require.Greater(t, attempts, 60)
+		// The first attempt, one per 10 minutes of the hour and the last one.
+		require.GreaterOrEqual(t, len(entries), 6)
+		require.LessOrEqual(t, len(entries), 8)
+		requireLogFields(t, entries[0], map[string]interface{}{"attempt": 1})
+		last := entries[len(entries)-1]
+		require.Equal(t, "verification attempt failed", last.Message)
+		requireLogFields(t, last, map[string]interface{}{"attempt": attempts})
+	})
+
+	t.Run("logs the attempt that succeeds", func(t *testing.T) {
+		attempts, entries := run(t, 10*time.Minute, 5)
+		require.Equal(t, 6, attempts)
+		require.Len(t, entries, 2)
+		requireLogFields(t, entries[0], map[string]interface{}{"attempt": 1})
+		require.Equal(t, "verification attempt succeeded", entries[1].Message)
+		requireLogFields(t, entries[1], map[string]interface{}{"attempt": 6})
+	})
+
+	t.Run("logs every attempt without an interval", func(t *testing.T) {
+		attempts, entries := run(t, 0, 0)
+		// The last attempt has no next attempt to announce.
+		require.Len(t, entries, attempts-1)
+	})
+}
+
+func TestWithClock(t *testing.T) {
+	clock := newFakeClock()
+	o := newUpdateOptions(context.Background(), nil, WithClock(clock))
+	require.Equal(t, Clock(clock), o.updateTimer.getClock())
+	require.Equal(t, Clock(clock), clockFrom(o.updateSts.ctx))
+
+	o = newUpdateOptions(context.Background(), nil)
+	require.Equal(t, defaultClock, o.updateTimer.getClock())
+	require.Equal(t, defaultClock, clockFrom(o.updateSts.ctx))
+}
+
+func TestWithClockTimeout(t *testing.T) {
+	t.Run("times out on the clock", func(t *testing.T) {
+		clock := newFakeClock()
+		ctx, cancel := withClockTimeout(context.Background(), clock, time.Hour)
+		defer cancel()
+
+		<-clock.waiting
+		clock.Advance(time.Hour - time.Second)
+		require.NoError(t, ctx.Err())
+
+		clock.Advance(time.Second)
+		<-ctx.Done()
+		require.Equal(t, context.DeadlineExceeded, ctx.Err())
+	})
+
+	t.Run("is cancelled", func(t *testing.T) {
+		clock := newFakeClock()
+		ctx, cancel := withClockTimeout(context.Background(), clock, time.Hour)
+		cancel()
+
+		<-ctx.Done()
+		require.Equal(t, context.Canceled, ctx.Err())
+	})
+}
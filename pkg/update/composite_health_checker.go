@@ -0,0 +1,64 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/go-logr/logr"
+)
+
+// CompositeHealthChecker is a HealthChecker that requires every one of the
+// wrapped HealthCheckers to pass, for example to check both that all the pods
+// are ready and that no node is draining between pod updates.
+type CompositeHealthChecker struct {
+	checkers []healthchecker.HealthChecker
+	// probeAll probes every checker and reports all the failures, instead of
+	// stopping at the first one.
+	probeAll bool
+}
+
+var _ healthchecker.HealthChecker = &CompositeHealthChecker{}
+
+// NewCompositeHealthChecker returns a CompositeHealthChecker that probes the
+// checkers in order. When probeAll is false, it stops at the first failure.
+func NewCompositeHealthChecker(probeAll bool, checkers ...healthchecker.HealthChecker) *CompositeHealthChecker {
+	return &CompositeHealthChecker{
+		checkers: checkers,
+		probeAll: probeAll,
+	}
+}
+
+// Probe probes the wrapped HealthCheckers and returns a HealthCheckError if any
+// of them fails.
+func (hc *CompositeHealthChecker) Probe(ctx context.Context, l logr.Logger, logSuffix string, partition int) error {
+	var errs []error
+	for _, checker := range hc.checkers {
+		if err := checker.Probe(ctx, l, logSuffix, partition); err != nil {
+			errs = append(errs, err)
+			if !hc.probeAll {
+				break
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return HealthCheckError{Errs: errs}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompositeHealthChecker(t *testing.T) {
+	newCheckers := func() (*fakeHealthChecker, *fakeHealthChecker, *fakeHealthChecker) {
+		return &fakeHealthChecker{failAfter: -1}, &fakeHealthChecker{failAfter: 0}, &fakeHealthChecker{failAfter: 0}
+	}
+
+	t.Run("passes when every checker passes", func(t *testing.T) {
+		a, b := &fakeHealthChecker{failAfter: -1}, &fakeHealthChecker{failAfter: -1}
+		hc := NewCompositeHealthChecker(false, a, b)
+
+		require.NoError(t, hc.Probe(context.Background(), log.NullLogger{}, "test", 1))
+		require.Equal(t, []int{1}, a.calls)
+		require.Equal(t, []int{1}, b.calls)
+	})
+
+	t.Run("reports the first failing checker", func(t *testing.T) {
+		ok, failing, notProbed := newCheckers()
+		hc := NewCompositeHealthChecker(false, ok, failing, notProbed)
+
+		err := hc.Probe(context.Background(), log.NullLogger{}, "test", 2)
+		var hcErr HealthCheckError
+		require.True(t, errors.As(err, &hcErr))
+		require.Len(t, hcErr.Errs, 1)
+		require.EqualError(t, err, "1 health checks failed: probe failed")
+		require.Equal(t, []int{2}, failing.calls)
+		require.Empty(t, notProbed.calls)
+	})
+
+	t.Run("reports every failing checker", func(t *testing.T) {
+		ok, a, b := newCheckers()
+		hc := NewCompositeHealthChecker(true, a, ok, b)
+
+		err := hc.Probe(context.Background(), log.NullLogger{}, "test", 0)
+		var hcErr HealthCheckError
+		require.True(t, errors.As(err, &hcErr))
+		require.Len(t, hcErr.Errs, 2)
+		require.EqualError(t, err, "2 health checks failed: probe failed; probe failed")
+		require.Equal(t, []int{0}, ok.calls)
+		require.Equal(t, []int{0}, b.calls)
+	})
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"github.com/cenkalti/backoff"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+	v1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// waitUntilDisruptionAllowed waits until the PodDisruptionBudget configured on
+// updateSts allows at least one more pod to be disrupted, so that restarting a
+// pod does not violate the budget. The check is skipped when no budget is
+// configured.
+func waitUntilDisruptionAllowed(updateSts *UpdateSts, updateTimer *UpdateTimer, sts *v1.StatefulSet, l logr.Logger) error {
+	if updateSts.pdbName == "" {
+		return nil
+	}
+
+	f := func() error {
+		pdb, err := updateSts.clientset.PolicyV1().PodDisruptionBudgets(sts.Namespace).Get(updateSts.ctx, updateSts.pdbName, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "error getting pod disruption budget %s", updateSts.pdbName)
+		}
+
+		// A budget that does not select the pods of the StatefulSet can't
+		// protect them, retrying won't change that.
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil {
+			return backoff.Permanent(errors.Wrapf(err, "invalid selector on pod disruption budget %s", pdb.Name))
+		}
+		if selector.Empty() || !selector.Matches(labels.Set(sts.Spec.Template.Labels)) {
+			return backoff.Permanent(errors.Newf("pod disruption budget %s does not select the pods of %s", pdb.Name, sts.Name))
+		}
+
+		if pdb.Status.DisruptionsAllowed < 1 {
+			l.V(int(zapcore.DebugLevel)).Info("pod disruption budget does not allow disruptions", "pdb", pdb.Name)
+			return errors.Newf("pod disruption budget %s does not allow any disruptions", pdb.Name)
+		}
+		return nil
+	}
+
+	return retryNotify(updateSts.ctx, updateTimer.getClock(), updateTimer.newBackOff(), f, nil)
+}
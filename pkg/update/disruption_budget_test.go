@@ -0,0 +1,98 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testPDBName = "cockroachdb-budget"
+
+func newTestPDB(disruptionsAllowed int32, matchLabels map[string]string) *policyv1.PodDisruptionBudget {
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testPDBName,
+			Namespace: testStsNamespace,
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: matchLabels},
+		},
+		Status: policyv1.PodDisruptionBudgetStatus{
+			DisruptionsAllowed: disruptionsAllowed,
+		},
+	}
+}
+
+func newTestUpdateWithPDB(t *testing.T, pdb *policyv1.PodDisruptionBudget) (*fake.Clientset, *UpdateSts, *UpdateTimer) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+	updateSts.sts.Spec.Template.Labels = map[string]string{"app": "cockroachdb"}
+	updateSts.pdbName = testPDBName
+	updateTimer.podUpdateTimeout = 100 * time.Millisecond
+
+	_, err := clientset.PolicyV1().PodDisruptionBudgets(testStsNamespace).Create(context.Background(), pdb, metav1.CreateOptions{})
+	require.NoError(t, err)
+	return clientset, updateSts, updateTimer
+}
+
+func TestPartitionedRollingUpdateStrategyDisruptionAllowed(t *testing.T) {
+	clientset, updateSts, updateTimer := newTestUpdateWithPDB(t, newTestPDB(1, map[string]string{"app": "cockroachdb"}))
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.Equal(t, []int32{2, 1, 0}, updatedPartitions(clientset))
+}
+
+func TestPartitionedRollingUpdateStrategyDisruptionBlocked(t *testing.T) {
+	clientset, updateSts, updateTimer := newTestUpdateWithPDB(t, newTestPDB(0, map[string]string{"app": "cockroachdb"}))
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not allow any disruptions")
+	// no pod was restarted
+	require.Empty(t, updatedPartitions(clientset))
+}
+
+func TestPartitionedRollingUpdateStrategyDisruptionBudgetSelector(t *testing.T) {
+	clientset, updateSts, updateTimer := newTestUpdateWithPDB(t, newTestPDB(1, map[string]string{"app": "other"}))
+	// a misconfigured budget fails straight away instead of after the timeout
+	updateTimer.podUpdateTimeout = time.Minute
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not select the pods")
+	require.Empty(t, updatedPartitions(clientset))
+}
+
+func TestPartitionedRollingUpdateStrategyNoDisruptionBudget(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	for _, action := range clientset.Actions() {
+		require.NotEqual(t, "poddisruptionbudgets", action.GetResource().Resource)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+)
+
+// openSessionsQuery returns the number of sessions of a node, except for the
+// session running the query.
+const openSessionsQuery = "SELECT count(*) FROM [SHOW CLUSTER SESSIONS] " +
+	"WHERE node_id = $1 AND session_id != (SELECT session_id FROM [SHOW session_id])"
+
+// cancelIdleSessionsStatement closes the sessions of a node that neither run a
+// query nor have a transaction open, except for the session running the
+// statement. Their clients have no work in flight on the node and reconnect to
+// another one, while the sessions in a transaction are left to finish it.
+const cancelIdleSessionsStatement = "CANCEL SESSIONS (SELECT session_id FROM [SHOW CLUSTER SESSIONS] " +
+	"WHERE node_id = $1 AND active_queries = '' AND kv_txn IS NULL " +
+	"AND session_id != (SELECT session_id FROM [SHOW session_id]))"
+
+// drainPollingInterval is the maximum interval between two checks of the
+// sessions that are still open on a draining node.
+var drainPollingInterval = 5 * time.Second
+
+// ErrDrainTimeout is returned by DrainNode when the node still had open
+// connections once the timeout elapsed.
+var ErrDrainTimeout = errors.New("timed out draining node connections")
+
+// DrainNode drains the SQL connections of the node with the given ID. Every
+// time it polls the node it closes the sessions that are idle outside of a
+// transaction, including the ones opened since the last poll, and the sessions
+// that are running a query or have a transaction open are left to finish. No
+// transaction of a client is aborted. DrainNode returns once no connection is
+// left or returns an ErrDrainTimeout when the timeout elapses first.
+func DrainNode(ctx context.Context, sqlConn *sql.DB, nodeID int, timeout time.Duration) error {
+	err := pollFor(ctx, timeout, drainPollingInterval, func() error {
+		if _, err := sqlConn.ExecContext(ctx, cancelIdleSessionsStatement, nodeID); err != nil {
+			return backoff.Permanent(errors.Wrapf(err, "error closing idle sessions of node %d", nodeID))
+		}
+
+		var open int
+		if err := sqlConn.QueryRowContext(ctx, openSessionsQuery, nodeID).Scan(&open); err != nil {
+			return backoff.Permanent(errors.Wrapf(err, "error counting sessions of node %d", nodeID))
+		}
+		if open > 0 {
+			return errors.Mark(errors.Newf("node %d still has %d open connections", nodeID, open), ErrDrainTimeout)
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "draining node %d", nodeID)
+	}
+	return err
+}
+
+// nodeIDQuery returns the ID of the node serving the connection.
+const nodeIDQuery = "SELECT crdb_internal.node_id()"
+
+// drainConnectionsHook returns an UpdateHook that connects to the pod of the
+// partition about to be updated and drains the connections of its node, see
+// DrainNode. A node that still has connections once the timeout elapses is
+// updated anyway.
+func drainConnectionsHook(updateSts *UpdateSts, connFactory SQLConnFactory, timeout time.Duration) UpdateHook {
+	return func(ctx context.Context, partition int, l logr.Logger) error {
+		podName := updateSts.PodName(partition)
+		db, err := connFactory.Open(ctx, updateSts.namespace, podName)
+		if err != nil {
+			return errors.Wrapf(err, "error connecting to pod %s", podName)
+		}
+		defer db.Close()
+
+		var nodeID int
+		if err := db.QueryRowContext(ctx, nodeIDQuery).Scan(&nodeID); err != nil {
+			return errors.Wrapf(err, "error getting node id of pod %s", podName)
+		}
+
+		l.Info("draining node connections", "podName", podName, "nodeID", nodeID)
+		err = DrainNode(ctx, db, nodeID, timeout)
+		if errors.Is(err, ErrDrainTimeout) {
+			l.Info("connections still open, updating the pod anyway", "podName", podName, "reason", err.Error())
+			return nil
+		}
+		return err
+	}
+}
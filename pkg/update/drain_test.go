@@ -0,0 +1,116 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cockroachdb/errors"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// expectOpenSessions expects the idle sessions of the node to be closed, then
+// its open sessions to be counted, once for each of the counts.
+func expectOpenSessions(nodeID int, counts ...int) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		for _, count := range counts {
+			mock.ExpectExec(cancelIdleSessionsStatement).WithArgs(nodeID).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(openSessionsQuery).WithArgs(nodeID).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+		}
+	}
+}
+
+func TestDrainNode(t *testing.T) {
+	defer func(d time.Duration) { drainPollingInterval = d }(drainPollingInterval)
+	drainPollingInterval = time.Millisecond
+
+	newDB := func(t *testing.T, expectations func(sqlmock.Sqlmock)) *sql.DB {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		require.NoError(t, err)
+		expectations(mock)
+		t.Cleanup(func() { require.NoError(t, mock.ExpectationsWereMet()) })
+		return db
+	}
+
+	t.Run("closes the idle sessions until every connection is closed", func(t *testing.T) {
+		db := newDB(t, expectOpenSessions(3, 5, 2, 0))
+		require.NoError(t, DrainNode(context.Background(), db, 3, time.Second))
+	})
+
+	t.Run("returns ErrDrainTimeout when connections are left", func(t *testing.T) {
+		db := newDB(t, expectOpenSessions(3, 5))
+		err := DrainNode(context.Background(), db, 3, time.Nanosecond)
+		require.True(t, errors.Is(err, ErrDrainTimeout))
+		require.Contains(t, err.Error(), "node 3 still has 5 open connections")
+	})
+
+	t.Run("does not retry when the sessions cannot be counted", func(t *testing.T) {
+		db := newDB(t, func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec(cancelIdleSessionsStatement).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(openSessionsQuery).WithArgs(3).WillReturnError(errors.New("permission denied"))
+		})
+		err := DrainNode(context.Background(), db, 3, time.Second)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrDrainTimeout))
+	})
+
+	t.Run("does not retry when the idle sessions cannot be closed", func(t *testing.T) {
+		db := newDB(t, func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec(cancelIdleSessionsStatement).WithArgs(3).WillReturnError(errors.New("permission denied"))
+		})
+		err := DrainNode(context.Background(), db, 3, time.Second)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "error closing idle sessions of node 3")
+		require.False(t, errors.Is(err, ErrDrainTimeout))
+	})
+}
+
+func TestDrainConnectionsHook(t *testing.T) {
+	defer func(d time.Duration) { drainPollingInterval = d }(drainPollingInterval)
+	drainPollingInterval = time.Millisecond
+
+	expectNodeID := func(nodeID int, counts ...int) func(sqlmock.Sqlmock) {
+		return func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(nodeIDQuery).WillReturnRows(sqlmock.NewRows([]string{"node_id"}).AddRow(nodeID))
+			expectOpenSessions(nodeID, counts...)(mock)
+		}
+	}
+
+	t.Run("drains the node of the partition", func(t *testing.T) {
+		_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		// the connection is opened with the name of the pod, not its DNS name
+		updateSts.sts.Spec.ServiceName = "cockroachdb"
+		sqlConn, pods := newTestSQLConn(t, expectNodeID(2, 1, 0))
+
+		hook := drainConnectionsHook(updateSts, sqlConn, time.Second)
+		require.NoError(t, hook(context.Background(), 1, log.NullLogger{}))
+		require.Equal(t, []string{"cockroachdb-1"}, *pods)
+	})
+
+	t.Run("updates the pod when connections are left", func(t *testing.T) {
+		_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		sqlConn, _ := newTestSQLConn(t, expectNodeID(2, 4))
+
+		hook := drainConnectionsHook(updateSts, sqlConn, time.Nanosecond)
+		require.NoError(t, hook(context.Background(), 1, log.NullLogger{}))
+	})
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetryableError wraps a transient error returned by the Kubernetes API, such as
+// a server timeout or rate limiting. Callers may retry the whole region update.
+type RetryableError struct {
+	Err error
+}
+
+var _ error = RetryableError{}
+
+func (e RetryableError) Error() string {
+	return "retryable error: " + e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// FatalError wraps an error returned by the Kubernetes API that will not go away
+// by retrying, such as missing permissions.
+type FatalError struct {
+	Err error
+}
+
+var _ error = FatalError{}
+
+func (e FatalError) Error() string {
+	return "fatal error: " + e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e FatalError) Unwrap() error {
+	return e.Err
+}
+
+// RegionUpdateTimeoutError is returned when rolling out an update to a region
+// takes longer than the regionUpdateTimeout of the UpdateTimer. The pods that
+// were not updated yet are left untouched.
+type RegionUpdateTimeoutError struct {
+	StatefulSet string
+	Timeout     time.Duration
+	// CompletedPartitions is the number of pods that were updated, or found
+	// already updated, before the timeout was exceeded.
+	CompletedPartitions int
+}
+
+var _ error = RegionUpdateTimeoutError{}
+
+func (e RegionUpdateTimeoutError) Error() string {
+	return fmt.Sprintf("update of %s did not complete within %s, %d partitions completed",
+		e.StatefulSet, e.Timeout, e.CompletedPartitions)
+}
+
+// PreflightError is returned when a preflight check fails before an update
+// starts. No pod has been updated when it is returned.
+type PreflightError struct {
+	// Check is the name of the check that failed.
+	Check string
+	Err   error
+}
+
+var _ error = PreflightError{}
+
+func (e PreflightError) Error() string {
+	return fmt.Sprintf("preflight check %q failed: %s", e.Check, e.Err)
+}
+
+// Unwrap returns the wrapped error.
+func (e PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// InterruptedError is returned when the context of an update is cancelled, for
+// example because the operator received a SIGTERM, while pods are being
+// updated. The pods of the batch that was being verified when the context was
+// cancelled are given the shutdown grace period of the UpdateTimer to be
+// verified before the update returns, so that the next update can safely pick
+// up where this one stopped.
+type InterruptedError struct {
+	StatefulSet string
+	// LastCompletedPartition is the partition of the last batch of pods that was
+	// verified, or found already updated, before the update was interrupted. It
+	// is -1 when no pod was updated.
+	LastCompletedPartition int
+	Err                    error
+}
+
+var _ error = InterruptedError{}
+
+func (e InterruptedError) Error() string {
+	return fmt.Sprintf("update of %s interrupted after partition %d: %s",
+		e.StatefulSet, e.LastCompletedPartition, e.Err)
+}
+
+// Unwrap returns the wrapped error.
+func (e InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// HealthCheckError is returned by a CompositeHealthChecker with the errors of
+// the health checkers that failed, in the order in which they were probed.
+type HealthCheckError struct {
+	Errs []error
+}
+
+var _ error = HealthCheckError{}
+
+func (e HealthCheckError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d health checks failed: %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the first error.
+func (e HealthCheckError) Unwrap() error {
+	if len(e.Errs) == 0 {
+		return nil
+	}
+	return e.Errs[0]
+}
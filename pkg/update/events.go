@@ -0,0 +1,65 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the events emitted while updating a StatefulSet.
+const (
+	PodUpdateStartedReason        = "PodUpdateStarted"
+	PodUpdateCompletedReason      = "PodUpdateCompleted"
+	HealthProbeFailedReason       = "HealthProbeFailed"
+	PartitionAlreadyUpdatedReason = "PartitionAlreadyUpdated"
+	UpdateAutoPausedReason        = "UpdateAutoPaused"
+)
+
+// WithEventRecorder sets the recorder used to emit an event for each update
+// milestone. Events are attached to obj, which is typically the CrdbCluster
+// being updated. When obj is nil, events are attached to the StatefulSet.
+// Default: no events are emitted
+func WithEventRecorder(recorder record.EventRecorder, obj runtime.Object) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) {
+		o.updateSts.eventRecorder = recorder
+		o.updateSts.eventObject = obj
+	})
+}
+
+// normalEvent emits a Normal event if an event recorder has been configured.
+func (u *UpdateSts) normalEvent(reason, messageFmt string, args ...interface{}) {
+	u.event(corev1.EventTypeNormal, reason, messageFmt, args...)
+}
+
+// warningEvent emits a Warning event if an event recorder has been configured.
+func (u *UpdateSts) warningEvent(reason, messageFmt string, args ...interface{}) {
+	u.event(corev1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+func (u *UpdateSts) event(eventType, reason, messageFmt string, args ...interface{}) {
+	if u.eventRecorder == nil {
+		return
+	}
+
+	obj := u.eventObject
+	if obj == nil {
+		obj = u.sts
+	}
+	u.eventRecorder.Eventf(obj, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UpdateHistoryAnnotation is the StatefulSet annotation holding the JSON
+// encoded history of the completed updates, oldest first.
+const UpdateHistoryAnnotation = "crdb.cockroachlabs.com/update-history"
+
+// maxUpdateHistoryEntries is the number of updates kept in the history.
+const maxUpdateHistoryEntries = 10
+
+// UpdateHistoryEntry records a completed update of a StatefulSet.
+type UpdateHistoryEntry struct {
+	Timestamp       metav1.Time `json:"timestamp"`
+	FromImage       string      `json:"fromImage"`
+	ToImage         string      `json:"toImage"`
+	OperatorVersion string      `json:"operatorVersion,omitempty"`
+	// TemplateHash identifies the pod template the StatefulSet was updated to,
+	// so that updates that don't change the image are told apart.
+	TemplateHash string `json:"templateHash,omitempty"`
+}
+
+// UpdateHistory returns the update history recorded on the StatefulSet.
+func UpdateHistory(sts *v1.StatefulSet) ([]UpdateHistoryEntry, error) {
+	val, ok := sts.Annotations[UpdateHistoryAnnotation]
+	if !ok || val == "" {
+		return nil, nil
+	}
+
+	var history []UpdateHistoryEntry
+	if err := json.Unmarshal([]byte(val), &history); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s annotation of %s", UpdateHistoryAnnotation, sts.Name)
+	}
+	return history, nil
+}
+
+// recordUpdateHistory appends the update that just completed to the history
+// annotation of the StatefulSet, keeping the last maxUpdateHistoryEntries
+// updates. Nothing is recorded if the last entry already is for the current pod
+// template, which happens when an update that already completed is run again.
+func recordUpdateHistory(updateSts *UpdateSts, l logr.Logger) error {
+	var fromImage string
+	if updateSts.preUpdateTemplate != nil {
+		fromImage = dbContainerImage(updateSts.preUpdateTemplate)
+	}
+
+	err := updateSts.retryOnConflict(func() error {
+		stsClient, err := updateSts.statefulSets(updateSts.ctx)
+		if err != nil {
+			return err
+		}
+		sts, err := stsClient.Get(updateSts.ctx, updateSts.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		history, err := UpdateHistory(sts)
+		if err != nil {
+			// A corrupted history should not fail the update, start over.
+			l.Error(err, "discarding update history")
+			history = nil
+		}
+
+		templateHash, err := podTemplateHash(&sts.Spec.Template)
+		if err != nil {
+			return err
+		}
+		if len(history) > 0 && history[len(history)-1].TemplateHash == templateHash {
+			return nil
+		}
+
+		history = append(history, UpdateHistoryEntry{
+			Timestamp:       metav1.Now(),
+			FromImage:       fromImage,
+			ToImage:         dbContainerImage(&sts.Spec.Template),
+			OperatorVersion: updateSts.operatorVersion,
+			TemplateHash:    templateHash,
+		})
+		if len(history) > maxUpdateHistoryEntries {
+			history = history[len(history)-maxUpdateHistoryEntries:]
+		}
+
+		val, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		if sts.Annotations == nil {
+			sts.Annotations = map[string]string{}
+		}
+		sts.Annotations[UpdateHistoryAnnotation] = string(val)
+		if stsClient, err = updateSts.statefulSets(updateSts.ctx); err != nil {
+			return err
+		}
+		_, err = stsClient.Update(updateSts.ctx, sts, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return handleStsError(err, l, updateSts.name, updateSts.namespace)
+	}
+	return nil
+}
+
+// podTemplateHash returns a hash of the pod template, which changes whenever the
+// StatefulSet controller would roll the pods.
+func podTemplateHash(template *corev1.PodTemplateSpec) (string, error) {
+	val, err := json.Marshal(template)
+	if err != nil {
+		return "", errors.Wrapf(err, "error hashing pod template")
+	}
+	h := fnv.New64a()
+	h.Write(val)
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
+
+// dbContainerImage returns the image of the CockroachDB container of the pod
+// template, or an empty string if there is none.
+func dbContainerImage(template *corev1.PodTemplateSpec) string {
+	for _, container := range template.Spec.Containers {
+		if container.Name == DBContainerName {
+			return container.Image
+		}
+	}
+	return ""
+}
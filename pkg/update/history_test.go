@@ -0,0 +1,118 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateHistory(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, _, _ := newTestUpdate(t, 3, hc)
+
+	update := func(image string, mutate ...func(*v1.StatefulSet)) {
+		var want corev1.PodTemplateSpec
+		updateSuite := NewUpdateFunctionSuite(
+			func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+				sts.Spec.Template.Spec.Containers[0].Image = image
+				for _, m := range mutate {
+					m(sts)
+				}
+				want = *sts.Spec.Template.DeepCopy()
+				return sts, nil
+			},
+			PartitionedRollingUpdateStrategy(func(update *UpdateSts, podNumber int, l logr.Logger) error {
+				sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(update.ctx, testStsName, metav1.GetOptions{})
+				if err != nil {
+					return err
+				}
+				if !apiequality.Semantic.DeepEqual(sts.Spec.Template, want) {
+					return errors.New("pod not updated")
+				}
+				return partitionVerificationFunc(clientset)(update, podNumber, l)
+			}),
+		)
+		_, err := UpdateRegionStatefulSet(
+			context.Background(),
+			clientset,
+			updateSuite,
+			log.NullLogger{},
+			WithName(testStsName),
+			WithNamespace(testStsNamespace),
+			WithTimeout(time.Second),
+			WithPollingInterval(10*time.Millisecond),
+			WithHealthChecker(hc),
+			WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+			WithOperatorVersion("v2.1.0"),
+		)
+		require.NoError(t, err)
+	}
+	history := func() []UpdateHistoryEntry {
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+		require.NoError(t, err)
+		history, err := UpdateHistory(sts)
+		require.NoError(t, err)
+		return history
+	}
+
+	update("cockroachdb/cockroach:v21.1.0")
+	require.Len(t, history(), 1)
+	entry := history()[0]
+	require.Equal(t, "cockroachdb/cockroach:v20.2.0", entry.FromImage)
+	require.Equal(t, "cockroachdb/cockroach:v21.1.0", entry.ToImage)
+	require.Equal(t, "v2.1.0", entry.OperatorVersion)
+	require.False(t, entry.Timestamp.IsZero())
+
+	// running the same update again does not record it twice
+	update("cockroachdb/cockroach:v21.1.0")
+	require.Len(t, history(), 1)
+
+	// an update that doesn't change the image is recorded too
+	withCPU := func(sts *v1.StatefulSet) {
+		sts.Spec.Template.Spec.Containers[0].Resources.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")}
+	}
+	update("cockroachdb/cockroach:v21.1.0", withCPU)
+	require.Len(t, history(), 2)
+	entry = history()[1]
+	require.Equal(t, "cockroachdb/cockroach:v21.1.0", entry.FromImage)
+	require.Equal(t, "cockroachdb/cockroach:v21.1.0", entry.ToImage)
+	require.NotEqual(t, history()[0].TemplateHash, entry.TemplateHash)
+
+	update("cockroachdb/cockroach:v21.1.0", withCPU)
+	require.Len(t, history(), 2)
+
+	for i := 1; i <= 12; i++ {
+		update(fmt.Sprintf("cockroachdb/cockroach:v21.1.%d", i))
+	}
+	got := history()
+	require.Len(t, got, maxUpdateHistoryEntries)
+	require.Equal(t, "cockroachdb/cockroach:v21.1.2", got[0].FromImage)
+	require.Equal(t, "cockroachdb/cockroach:v21.1.12", got[len(got)-1].ToImage)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"time"
+)
+
+// withGracePeriod returns a context that carries the values of parent but is
+// only cancelled once grace has elapsed after parent is done, or when the
+// returned cancel func is called. It lets work that is already in progress,
+// such as verifying an updated pod, finish when the operator is shutting down.
+func withGracePeriod(parent context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	if grace <= 0 {
+		return context.WithCancel(parent)
+	}
+
+	ctx, cancel := context.WithCancel(valuesOnly{parent})
+	go func() {
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-clockFrom(parent).After(grace):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// valuesOnly is a context that carries the values of the wrapped context but is
+// never cancelled and has no deadline.
+type valuesOnly struct {
+	context.Context
+}
+
+func (valuesOnly) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (valuesOnly) Done() <-chan struct{} { return nil }
+
+func (valuesOnly) Err() error { return nil }
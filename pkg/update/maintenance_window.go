@@ -0,0 +1,174 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+)
+
+// ErrOutsideMaintenanceWindow is returned by a MaintenanceWindowHealthChecker
+// when it is probed outside of its maintenance window.
+var ErrOutsideMaintenanceWindow = errors.New("outside of the maintenance window")
+
+// MaintenanceWindowHealthChecker is a HealthChecker that only lets the update
+// proceed during a maintenance window: it fails outside of the window and
+// probes the wrapped HealthChecker, if any, within it. Used as the probe
+// between pods, it halts the rollout outside of the window.
+type MaintenanceWindowHealthChecker struct {
+	healthChecker healthchecker.HealthChecker
+	window        *maintenanceWindow
+	clock         Clock
+}
+
+var _ healthchecker.HealthChecker = &MaintenanceWindowHealthChecker{}
+
+// NewMaintenanceWindowHealthChecker returns a MaintenanceWindowHealthChecker
+// that decorates hc, which may be nil. window is a cron expression of the
+// minutes, in UTC, that make up the maintenance window: minute, hour, day of
+// month, month and day of week, where each field is *, a number, a range such
+// as 1-5, a step such as */15 or 0-30/10, or a list of those such as 1,3,5. For
+// example "* 2-4 * * 6,0" is from 02:00 to 04:59 on weekends. clock may be nil.
+func NewMaintenanceWindowHealthChecker(hc healthchecker.HealthChecker, window string, clock Clock) (*MaintenanceWindowHealthChecker, error) {
+	w, err := parseMaintenanceWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = defaultClock
+	}
+	return &MaintenanceWindowHealthChecker{
+		healthChecker: hc,
+		window:        w,
+		clock:         clock,
+	}, nil
+}
+
+// Probe returns an error wrapping ErrOutsideMaintenanceWindow outside of the
+// maintenance window, and probes the wrapped HealthChecker within it.
+func (hc *MaintenanceWindowHealthChecker) Probe(ctx context.Context, l logr.Logger, logSuffix string, partition int) error {
+	if now := hc.clock.Now().UTC(); !hc.window.contains(now) {
+		return errors.Wrapf(ErrOutsideMaintenanceWindow, "%s is not within %q", now.Format(time.RFC3339), hc.window.spec)
+	}
+
+	if hc.healthChecker != nil {
+		return hc.healthChecker.Probe(ctx, l, logSuffix, partition)
+	}
+	return nil
+}
+
+// maintenanceWindow is a parsed cron expression. Each field is a bit set of the
+// values it matches.
+type maintenanceWindow struct {
+	spec                                     string
+	minute, hour, dayOfMonth, month, weekday uint64
+	// anyDayOfMonth and anyWeekday record whether the day fields are *, as
+	// cron matches either of the day fields when both are restricted.
+	anyDayOfMonth, anyWeekday bool
+}
+
+func parseMaintenanceWindow(spec string) (*maintenanceWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.Newf("maintenance window %q must have 5 fields: minute, hour, day of month, month and day of week", spec)
+	}
+
+	w := &maintenanceWindow{spec: spec}
+	bounds := []struct {
+		set      *uint64
+		min, max int
+	}{
+		{&w.minute, 0, 59},
+		{&w.hour, 0, 23},
+		{&w.dayOfMonth, 1, 31},
+		{&w.month, 1, 12},
+		// 7 is Sunday as well
+		{&w.weekday, 0, 7},
+	}
+	for i, b := range bounds {
+		set, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, errors.Wrapf(err, "maintenance window %q", spec)
+		}
+		*b.set = set
+	}
+	if w.weekday&(1<<7) != 0 {
+		w.weekday |= 1 << 0
+	}
+	w.anyDayOfMonth = fields[2] == "*"
+	w.anyWeekday = fields[4] == "*"
+	return w, nil
+}
+
+// parseCronField returns the bit set of the values between min and max that
+// field matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, errors.Newf("invalid step in %q", part)
+			}
+			rng = part[:i]
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Newf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.Newf("invalid value in %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.Newf("%q is not within %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// contains returns true if the minute of t is matched by the window.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	has := func(set uint64, v int) bool { return set&(1<<uint(v)) != 0 }
+
+	inDayOfMonth := has(w.dayOfMonth, t.Day())
+	inWeekday := has(w.weekday, int(t.Weekday()))
+	inDay := inDayOfMonth && inWeekday
+	if !w.anyDayOfMonth && !w.anyWeekday {
+		inDay = inDayOfMonth || inWeekday
+	}
+
+	return has(w.minute, t.Minute()) && has(w.hour, t.Hour()) && has(w.month, int(t.Month())) && inDay
+}
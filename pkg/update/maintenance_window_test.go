@@ -0,0 +1,92 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceWindowHealthChecker(t *testing.T) {
+	clock := newFakeClock()
+	// Saturday, 02:30 UTC
+	clock.now = time.Date(2021, 1, 2, 2, 30, 0, 0, time.UTC)
+
+	inner := &fakeHealthChecker{failAfter: -1}
+	hc, err := NewMaintenanceWindowHealthChecker(inner, "* 2-4 * * 6,7", clock)
+	require.NoError(t, err)
+
+	t.Run("inside the window", func(t *testing.T) {
+		require.NoError(t, hc.Probe(context.Background(), log.NullLogger{}, "test", 2))
+		require.Equal(t, []int{2}, inner.calls)
+	})
+
+	t.Run("outside the window", func(t *testing.T) {
+		clock.Advance(3 * time.Hour)
+		err := hc.Probe(context.Background(), log.NullLogger{}, "test", 1)
+		require.True(t, errors.Is(err, ErrOutsideMaintenanceWindow))
+		require.Contains(t, err.Error(), `2021-01-02T05:30:00Z is not within "* 2-4 * * 6,7"`)
+		require.Equal(t, []int{2}, inner.calls)
+	})
+
+	t.Run("Sunday is 0 or 7", func(t *testing.T) {
+		clock.Advance(21 * time.Hour)
+		require.NoError(t, hc.Probe(context.Background(), log.NullLogger{}, "test", 0))
+	})
+}
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		// January 2021 starts on a Friday.
+		return time.Date(2021, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		spec    string
+		inside  []time.Time
+		outside []time.Time
+	}{
+		{spec: "* * * * *", inside: []time.Time{at(1, 0, 0), at(31, 23, 59)}},
+		{spec: "0-29/10 3 * * *", inside: []time.Time{at(4, 3, 0), at(4, 3, 20)}, outside: []time.Time{at(4, 3, 5), at(4, 3, 30), at(4, 4, 0)}},
+		{spec: "* * 15 1 *", inside: []time.Time{at(15, 12, 0)}, outside: []time.Time{at(14, 12, 0)}},
+		// either day field matches when both are restricted
+		{spec: "* * 15 * 1", inside: []time.Time{at(15, 0, 0), at(4, 0, 0)}, outside: []time.Time{at(5, 0, 0)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			w, err := parseMaintenanceWindow(tt.spec)
+			require.NoError(t, err)
+			for _, ts := range tt.inside {
+				require.True(t, w.contains(ts), ts)
+			}
+			for _, ts := range tt.outside {
+				require.False(t, w.contains(ts), ts)
+			}
+		})
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "a * * * *"} {
+		_, err := parseMaintenanceWindow(spec)
+		require.Error(t, err, spec)
+	}
+}
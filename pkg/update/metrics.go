@@ -0,0 +1,105 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons used to label crdb_operator_update_failures_total.
+const (
+	failureReasonGetStatefulSet    = "get_statefulset"
+	failureReasonUpdateFunc        = "update_func"
+	failureReasonWaitForPods       = "wait_for_pods"
+	failureReasonUpdateStatefulSet = "update_statefulset"
+	failureReasonVerification      = "verification"
+	failureReasonHealthProbe       = "health_probe"
+	failureReasonDisruptionBudget  = "disruption_budget"
+	failureReasonPreflight         = "preflight"
+	failureReasonPreUpdateHook     = "pre_update_hook"
+	failureReasonPostUpdateHook    = "post_update_hook"
+	failureReasonRevision          = "revision"
+)
+
+// Metrics contains the Prometheus metrics recorded while updating the
+// CockroachDB StatefulSets. A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	// PodUpdateDuration is the time it took to roll and verify a partition.
+	PodUpdateDuration *prometheus.HistogramVec
+	// UpdateFailures counts the failed updates by reason.
+	UpdateFailures *prometheus.CounterVec
+	// UpdateInProgress is the number of StatefulSet updates in progress.
+	UpdateInProgress prometheus.Gauge
+}
+
+// NewMetrics creates the update metrics and registers them with reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		PodUpdateDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "crdb_operator_pod_update_duration_seconds",
+			Help:    "Time it took to update and verify the pods of a partition.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		}, []string{"namespace"}),
+		UpdateFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "crdb_operator_update_failures_total",
+			Help: "Number of failed StatefulSet updates.",
+		}, []string{"reason"}),
+		UpdateInProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "crdb_operator_update_in_progress",
+			Help: "Number of StatefulSet updates in progress.",
+		}),
+	}
+
+	reg.MustRegister(m.PodUpdateDuration, m.UpdateFailures, m.UpdateInProgress)
+	return m
+}
+
+// WithMetrics sets the metrics recorded while updating the StatefulSet.
+// Default: no metrics are recorded
+func WithMetrics(m *Metrics) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.metrics = m })
+}
+
+func (m *Metrics) observePodUpdate(namespace string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.PodUpdateDuration.WithLabelValues(namespace).Observe(d.Seconds())
+}
+
+func (m *Metrics) updateFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.UpdateFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) updateStarted() {
+	if m == nil {
+		return
+	}
+	m.UpdateInProgress.Inc()
+}
+
+func (m *Metrics) updateFinished() {
+	if m == nil {
+		return
+	}
+	m.UpdateInProgress.Dec()
+}
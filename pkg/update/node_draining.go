@@ -0,0 +1,103 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+)
+
+// nodeLivenessQuery returns whether the node serving the connection is draining
+// and its membership status, e.g. active or decommissioning.
+const nodeLivenessQuery = "SELECT draining, membership FROM crdb_internal.gossip_liveness WHERE node_id = crdb_internal.node_id()"
+
+// NodeNotDrainingHealthChecker is a HealthChecker that probes the wrapped
+// HealthChecker, if any, and then waits until the node running in the pod that
+// was just updated is no longer draining and accepts load again.
+type NodeNotDrainingHealthChecker struct {
+	healthChecker healthchecker.HealthChecker
+	sqlConn       SQLConnFactory
+	namespace     string
+	stsName       string
+	// maxWait is how long ProbeNodeNotDraining waits for the node to be active,
+	// polling at most every pollingInterval.
+	maxWait         time.Duration
+	pollingInterval time.Duration
+}
+
+var _ healthchecker.HealthChecker = &NodeNotDrainingHealthChecker{}
+
+// NewNodeNotDrainingHealthChecker returns a NodeNotDrainingHealthChecker that
+// decorates hc, which may be nil, and connects to the pods of the StatefulSet
+// stsName in namespace using sqlConn.
+func NewNodeNotDrainingHealthChecker(hc healthchecker.HealthChecker, sqlConn SQLConnFactory, namespace, stsName string) *NodeNotDrainingHealthChecker {
+	return &NodeNotDrainingHealthChecker{
+		healthChecker:   hc,
+		sqlConn:         sqlConn,
+		namespace:       namespace,
+		stsName:         stsName,
+		maxWait:         3 * time.Minute,
+		pollingInterval: 10 * time.Second,
+	}
+}
+
+// Probe probes the wrapped HealthChecker and then calls ProbeNodeNotDraining.
+func (hc *NodeNotDrainingHealthChecker) Probe(ctx context.Context, l logr.Logger, logSuffix string, partition int) error {
+	if hc.healthChecker != nil {
+		if err := hc.healthChecker.Probe(ctx, l, logSuffix, partition); err != nil {
+			return err
+		}
+	}
+
+	if err := hc.ProbeNodeNotDraining(ctx, partition); err != nil {
+		return errors.Wrapf(err, "node draining probe failed for cluster %s", logSuffix)
+	}
+	return nil
+}
+
+// ProbeNodeNotDraining connects to the pod of the given partition and returns
+// once its node is active and not draining, or an error if that does not happen
+// within maxWait.
+func (hc *NodeNotDrainingHealthChecker) ProbeNodeNotDraining(ctx context.Context, partition int) error {
+	podName := fmt.Sprintf("%s-%d", hc.stsName, partition)
+	db, err := hc.sqlConn.Open(ctx, hc.namespace, podName)
+	if err != nil {
+		return errors.Wrapf(err, "error connecting to pod %s", podName)
+	}
+	defer db.Close()
+
+	return pollFor(ctx, hc.maxWait, hc.pollingInterval, func() error {
+		var draining bool
+		var membership string
+		if err := db.QueryRowContext(ctx, nodeLivenessQuery).Scan(&draining, &membership); err != nil {
+			return errors.Wrapf(err, "error getting liveness of pod %s", podName)
+		}
+
+		if draining {
+			return errors.Newf("node in pod %s is still draining", podName)
+		}
+		if membership != "active" {
+			return errors.Newf("node in pod %s is %s, waiting for it to be active", podName, membership)
+		}
+		return nil
+	})
+}
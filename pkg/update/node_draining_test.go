@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/cockroachdb/errors"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// expectLiveness expects the liveness of the node to be queried once for each
+// of the membership statuses, reporting the node as draining when the status is
+// "draining".
+func expectLiveness(statuses ...string) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		for _, status := range statuses {
+			rows := sqlmock.NewRows([]string{"draining", "membership"})
+			if status == "draining" {
+				rows.AddRow(true, "active")
+			} else {
+				rows.AddRow(false, status)
+			}
+			mock.ExpectQuery(nodeLivenessQuery).WillReturnRows(rows)
+		}
+	}
+}
+
+func TestNodeNotDrainingHealthChecker(t *testing.T) {
+	newHealthChecker := func(hc healthchecker.HealthChecker, sqlConn SQLConnFactory) *NodeNotDrainingHealthChecker {
+		nhc := NewNodeNotDrainingHealthChecker(hc, sqlConn, testStsNamespace, testStsName)
+		nhc.maxWait = time.Second
+		nhc.pollingInterval = time.Millisecond
+		return nhc
+	}
+
+	t.Run("waits until the node is no longer draining", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		sqlConn, pods := newTestSQLConn(t, expectLiveness("draining", "draining", "active"))
+
+		require.NoError(t, newHealthChecker(hc, sqlConn).Probe(context.Background(), log.NullLogger{}, "test", 2))
+		require.Equal(t, []string{"cockroachdb-2"}, *pods)
+		require.Equal(t, []int{2}, hc.calls)
+	})
+
+	t.Run("returns an error when the node is not active", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectLiveness("decommissioning"))
+		hc := newHealthChecker(nil, sqlConn)
+		// Give up after the first attempt.
+		hc.maxWait = time.Nanosecond
+
+		err := hc.ProbeNodeNotDraining(context.Background(), 0)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "node in pod cockroachdb-0 is decommissioning")
+	})
+
+	t.Run("does not query the node when the wrapped probe fails", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: 0}
+		sqlConn, pods := newTestSQLConn(t)
+
+		require.Error(t, newHealthChecker(hc, sqlConn).Probe(context.Background(), log.NullLogger{}, "test", 1))
+		require.Empty(t, *pods)
+	})
+
+	t.Run("returns an error when the liveness can't be queried", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(nodeLivenessQuery).WillReturnError(errors.New("connection refused"))
+		})
+		hc := newHealthChecker(nil, sqlConn)
+		hc.maxWait = time.Nanosecond
+
+		require.Error(t, hc.ProbeNodeNotDraining(context.Background(), 1))
+	})
+}
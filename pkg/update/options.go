@@ -0,0 +1,421 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// UpdateOption defines a configuration option for UpdateRegionStatefulSet.
+type UpdateOption interface {
+	apply(*updateOptions)
+}
+
+// updateOptions contains the StatefulSet and timer configuration that is built
+// up by the UpdateOptions passed to UpdateRegionStatefulSet.
+type updateOptions struct {
+	updateSts      *UpdateSts
+	updateTimer    *UpdateTimer
+	preflight      bool
+	verifyRevision bool
+	rollUnchanged  bool
+}
+
+type updateOptionFn func(*updateOptions)
+
+func (fn updateOptionFn) apply(o *updateOptions) { fn(o) }
+
+func newUpdateOptions(ctx context.Context, clientset kubernetes.Interface, opts ...UpdateOption) *updateOptions {
+	o := &updateOptions{
+		updateSts:   NewUpdateSts(ctx, clientset, nil, "", ""),
+		updateTimer: &UpdateTimer{},
+	}
+	for _, opt := range opts {
+		opt.apply(o)
+	}
+	return o
+}
+
+func (o *updateOptions) validate() error {
+	if o.updateSts.name == "" {
+		return errors.New("statefulset name is required, use WithName")
+	}
+	if o.updateSts.namespace == "" {
+		return errors.New("statefulset namespace is required, use WithNamespace")
+	}
+	if o.updateTimer.healthChecker == nil {
+		return errors.New("health checker is required, use WithHealthChecker")
+	}
+	if o.updateTimer.waitUntilAllPodsReadyFunc == nil {
+		return errors.New("wait for pods func is required, use WithWaitForPodsFunc")
+	}
+	return o.updateTimer.validate()
+}
+
+// WithDryRun runs updateFunc and logs the resulting changes without updating the
+// StatefulSet or probing the health of the cluster.
+// Default: false
+func WithDryRun() UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.dryRun = true })
+}
+
+// WithPreflight runs the Preflight checks after updateFunc and before any pod is
+// updated. They are skipped in a dry run, which doesn't probe the cluster.
+// Default: false
+func WithPreflight() UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.preflight = true })
+}
+
+// WithPreflightCheck adds a check, such as NoZombieNodesVerificationFunc, that
+// runs against pod 0 after the Preflight checks and is reported under name in
+// the PreflightError if it fails. It turns on WithPreflight.
+// Default: no additional check
+func WithPreflightCheck(name string, check func(*UpdateSts, int, logr.Logger) error) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) {
+		o.preflight = true
+		o.updateSts.preflightChecks = append(o.updateSts.preflightChecks, preflightCheck{name: name, check: check})
+	})
+}
+
+// WithRollUnchanged runs the update strategy even when updateFunc didn't change
+// the spec of the StatefulSet and no rollout is in progress, instead of
+// returning right away with skipSleep true.
+// Default: false
+func WithRollUnchanged() UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.rollUnchanged = true })
+}
+
+// WithVerifyRevision checks, once every pod has been updated, that the whole
+// StatefulSet converged to the updated revision. See VerifyRegionAtRevision.
+// Default: false
+func WithVerifyRevision() UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.verifyRevision = true })
+}
+
+// WithName sets the name of the StatefulSet to update.
+func WithName(name string) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.name = name })
+}
+
+// WithNamespace sets the namespace of the StatefulSet to update.
+func WithNamespace(namespace string) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.namespace = namespace })
+}
+
+// WithOperatorVersion sets the version of the operator that is recorded in the
+// update history of the StatefulSet.
+// Default: "", not recorded
+func WithOperatorVersion(version string) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.operatorVersion = version })
+}
+
+// WithPodDisruptionBudget sets the name of the PodDisruptionBudget, in the
+// namespace of the StatefulSet, that must allow a disruption before each pod is
+// restarted.
+// Default: "", no check
+func WithPodDisruptionBudget(name string) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.pdbName = name })
+}
+
+// WithRateLimiter sets a limiter that is waited for before each call to the
+// StatefulSets API, for example a *rate.Limiter shared by all the regions that
+// are updated by the same operator.
+// Default: nil, unlimited
+func WithRateLimiter(limiter RateLimiter) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.limiter = limiter })
+}
+
+// WithConflictRetry sets the backoff used to retry writes to the StatefulSet
+// that conflict with a concurrent change. Busy clusters may need more steps
+// than the default.
+// Default: retry.DefaultRetry
+func WithConflictRetry(b wait.Backoff) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.conflictBackoff = b })
+}
+
+// WithConflictRetryMaxDuration sets how long writes to the StatefulSet that
+// conflict with a concurrent change are retried at most, even if the backoff
+// set by WithConflictRetry has steps left. Zero means no limit.
+// Default: 30s
+func WithConflictRetryMaxDuration(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateSts.conflictRetryMaxDuration = d })
+}
+
+// WithTimeout sets how long to wait for each pod to be verified after it has
+// been updated and for the health of the cluster to be probed afterwards. The
+// verification and the probe share this budget, unless WithHealthProbeTimeout
+// is set.
+func WithTimeout(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.podUpdateTimeout = d })
+}
+
+// WithHealthProbeTimeout sets how long the health probe between pods may take,
+// independently of the time it took to verify the updated pods.
+// Default: 0, the probe shares the budget set by WithTimeout
+func WithHealthProbeTimeout(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.healthProbeTimeout = d })
+}
+
+// WithRegionUpdateTimeout sets how long updating every pod of the StatefulSet
+// may take before the update is abandoned with a RegionUpdateTimeoutError.
+// Default: 0, no limit
+func WithRegionUpdateTimeout(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.regionUpdateTimeout = d })
+}
+
+// WithPollingInterval sets the maximum interval between two verifications of an
+// updated pod.
+func WithPollingInterval(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.podMaxPollingInterval = d })
+}
+
+// WithInitialInterval sets the interval before the first retry of the
+// verification of an updated pod.
+// Default: backoff.DefaultInitialInterval
+func WithInitialInterval(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.initialInterval = d })
+}
+
+// WithMultiplier sets the factor by which the interval between two
+// verifications of an updated pod grows.
+// Default: backoff.DefaultMultiplier
+func WithMultiplier(m float64) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.multiplier = m })
+}
+
+// WithProgressFunc sets a function that is called with the progress of the
+// update after every partition.
+// Default: nil, no progress is reported
+func WithProgressFunc(fn ProgressFunc) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.progressFunc = fn })
+}
+
+// WithPollingJitter randomizes the interval between two verifications of an
+// updated pod by up to the given fraction, between 0 and 1, so that regions
+// updated at the same time don't poll the API server in lockstep.
+// Default: backoff.DefaultRandomizationFactor
+func WithPollingJitter(jitter float64) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.pollingJitter = jitter })
+}
+
+// WithVerificationLogInterval logs the failed verification attempts of an
+// updated pod at most once per interval d. The first and the last attempts are
+// always logged.
+// Default: 0, every attempt is logged
+func WithVerificationLogInterval(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.verificationLogInterval = d })
+}
+
+// WithShutdownGracePeriod sets how long the pods that are being verified when
+// the update context is cancelled, for example on SIGTERM, are still waited for
+// before the update returns an InterruptedError.
+// Default: 0, stop waiting right away
+func WithShutdownGracePeriod(d time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.shutdownGracePeriod = d })
+}
+
+// WithClock sets the Clock that the update tells the time and waits with,
+// including the deadlines of the update and the polling of the health checkers
+// and wait functions of this package. It lets tests control time.
+// Default: the real clock
+func WithClock(clock Clock) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) {
+		o.updateTimer.clock = clock
+		o.updateSts.ctx = withClock(o.updateSts.ctx, clock)
+	})
+}
+
+// WithSkipHealthProbe skips probing the health of the cluster between pods,
+// while still verifying every updated pod. It speeds up updates of test and
+// development clusters and must not be used in production.
+// Default: false
+func WithSkipHealthProbe() UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.skipHealthProbe = true })
+}
+
+// WithPreUpdateHook sets a hook that runs right before each pod is updated, for
+// example to drain its connections. The pod is not updated if the hook returns
+// an error.
+// Default: nil, no hook
+func WithPreUpdateHook(hook UpdateHook) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.preUpdateHook = hook })
+}
+
+// WithPostUpdateHook sets a hook that runs after each pod has been updated and
+// verified, before the health of the cluster is probed, for example to enable
+// its connections again. The update is aborted if the hook returns an error.
+// Default: nil, no hook
+func WithPostUpdateHook(hook UpdateHook) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.postUpdateHook = hook })
+}
+
+// WithDrainConnections sets a PreUpdateHook that drains the SQL connections of
+// each node for up to timeout before its pod is updated. See DrainNode. It replaces the hook set by WithPreUpdateHook.
+// Default: connections are not drained
+func WithDrainConnections(connFactory SQLConnFactory, timeout time.Duration) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) {
+		o.updateTimer.preUpdateHook = drainConnectionsHook(o.updateSts, connFactory, timeout)
+	})
+}
+
+// withUpdateTimer replaces the UpdateTimer built up by the other options, for
+// the callers that already have one.
+func withUpdateTimer(ut *UpdateTimer) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer = ut })
+}
+
+// WithHealthChecker sets the health checker that is probed between pod updates.
+func WithHealthChecker(hc healthchecker.HealthChecker) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.healthChecker = hc })
+}
+
+// WithWaitForPodsFunc sets the function used to wait until all pods are ready
+// before a pod is updated.
+func WithWaitForPodsFunc(fn func(context.Context, logr.Logger) error) UpdateOption {
+	return updateOptionFn(func(o *updateOptions) { o.updateTimer.waitUntilAllPodsReadyFunc = fn })
+}
+
+// StrategyOption defines a configuration option for PartitionedRollingUpdateStrategy.
+type StrategyOption interface {
+	apply(*strategyOptions)
+}
+
+// strategyOptions contains the configurable values for rolling out an update
+// across the pods of a StatefulSet.
+type strategyOptions struct {
+	maxConcurrent          int32
+	rollbackOnProbeFailure bool
+	order                  PartitionOrder
+	allowZeroReplicas      bool
+	maxConsecutiveFailures int
+	fieldManager           string
+	useEviction            bool
+	maxPodsPerInvocation   int32
+	// checkpoint records the last completed partition in the
+	// LastUpdatedPartitionAnnotation, it is set by the strategies that resume
+	// from it.
+	checkpoint bool
+}
+
+type strategyOptionFn func(*strategyOptions)
+
+func (fn strategyOptionFn) apply(o *strategyOptions) { fn(o) }
+
+func newStrategyOptions(opts ...StrategyOption) *strategyOptions {
+	o := &strategyOptions{
+		maxConcurrent: 1,
+		order:         Descending,
+	}
+	for _, opt := range opts {
+		opt.apply(o)
+	}
+	return o
+}
+
+// WithMaxConcurrent sets the number of pods that are allowed to roll at the same
+// time. Values lower than 1 are ignored.
+// Default: 1
+func WithMaxConcurrent(n int) StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) {
+		if n > 0 {
+			o.maxConcurrent = int32(n)
+		}
+	})
+}
+
+// WithMaxPodsPerInvocation makes PartitionedRollingUpdateStrategy return once n
+// pods have been updated, handing control back to the caller, e.g. so that a
+// reconcile doesn't starve the others. The next invocation resumes from the
+// checkpoint. It only applies to the Descending order. Values lower than 1 are
+// ignored.
+// Default: 0, every pod is updated
+func WithMaxPodsPerInvocation(n int) StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) {
+		if n > 0 {
+			o.maxPodsPerInvocation = int32(n)
+		}
+	})
+}
+
+// WithRollbackOnProbeFailure restores the StatefulSet to the pod template and
+// partition it had before the update when the health probe fails between pods.
+// Default: false
+func WithRollbackOnProbeFailure() StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) { o.rollbackOnProbeFailure = true })
+}
+
+// WithServerSideApply lowers the partition of the StatefulSet with a server-side
+// apply patch owned by fieldManager, instead of updating the whole StatefulSet
+// and retrying on conflicts.
+// Default: "", the StatefulSet is updated
+func WithServerSideApply(fieldManager string) StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) { o.fieldManager = fieldManager })
+}
+
+// WithEviction evicts the pods of each batch through the eviction subresource
+// instead of lowering the partition, so that pod disruption budgets are
+// honored. The StatefulSet uses the OnDelete update strategy meanwhile, so that
+// the controller doesn't replace the pods itself. An eviction refused by a
+// budget is retried for up to the pod update timeout, then the update fails. It
+// only applies to the Descending order, Ascending updates delete the pods
+// themselves, and takes precedence over WithServerSideApply since no partition
+// is lowered.
+// Default: false, the StatefulSet controller replaces the pods
+func WithEviction() StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) { o.useEviction = true })
+}
+
+// AllowZeroReplicas lets PartitionedRollingUpdateStrategy succeed without
+// updating any pod when the StatefulSet has no replicas, instead of returning an
+// error.
+// Default: false
+func AllowZeroReplicas() StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) { o.allowZeroReplicas = true })
+}
+
+// WithMaxConsecutiveFailures pauses the update, by setting the
+// PauseUpdateAnnotation, once the verification of an updated pod has given up n
+// times in a row across reconciles, and returns ErrAutoPaused. The failures are
+// counted in the VerificationFailuresAnnotation of the StatefulSet, which is
+// cleared every time a batch of pods is verified.
+// Default: 0, the update is never paused
+func WithMaxConsecutiveFailures(n int) StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) { o.maxConsecutiveFailures = n })
+}
+
+// PartitionOrder is the order in which the pods of a StatefulSet are updated.
+type PartitionOrder int
+
+const (
+	// Descending updates the highest numbered pod first and counts down to pod 0.
+	Descending PartitionOrder = iota
+	// Ascending updates pod 0 first and counts up to the highest numbered pod.
+	Ascending
+)
+
+// WithPartitionOrder sets the order in which pods are updated.
+// Default: Descending
+func WithPartitionOrder(order PartitionOrder) StrategyOption {
+	return strategyOptionFn(func(o *strategyOptions) { o.order = order })
+}
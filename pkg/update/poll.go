@@ -0,0 +1,40 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// pollFor calls f with an exponential backoff of at most pollingInterval until
+// it succeeds, maxWait elapses or ctx is done, and returns the last error of f.
+// It waits on the clock carried by ctx, see WithClock.
+func pollFor(ctx context.Context, maxWait, pollingInterval time.Duration, f func() error) error {
+	clock := clockFrom(ctx)
+	b := backoff.NewExponentialBackOff()
+	b.Clock = clock
+	b.MaxElapsedTime = maxWait
+	b.MaxInterval = pollingInterval
+	if b.InitialInterval > b.MaxInterval {
+		b.InitialInterval = b.MaxInterval
+	}
+	b.Reset()
+	return retryNotify(ctx, clock, b, f, nil)
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollForFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	ctx := withClock(context.Background(), clock)
+
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- pollFor(ctx, time.Hour, time.Minute, func() error {
+			attempts++
+			return errors.New("not ready")
+		})
+	}()
+
+	start := clock.Now()
+	for {
+		select {
+		case err := <-done:
+			require.EqualError(t, err, "not ready")
+			elapsed := clock.Now().Sub(start)
+			require.GreaterOrEqual(t, int64(elapsed), int64(time.Hour), "f must be polled until maxWait")
+			require.Less(t, int64(elapsed), int64(time.Hour+2*time.Minute))
+			require.Greater(t, attempts, 60)
+			return
+		case <-clock.waiting:
+			clock.advanceToNextWaiter()
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/kube"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Names of the preflight checks, as reported in PreflightError.
+const (
+	PreflightCheckPodsReady   = "pods ready"
+	PreflightCheckHealthProbe = "health probe"
+	PreflightCheckImage       = "image reference"
+	// PreflightCheckNoZombieNodes is the suggested name of the check that uses
+	// NoZombieNodesVerificationFunc, see WithPreflightCheck.
+	PreflightCheckNoZombieNodes = "no zombie nodes"
+)
+
+// preflightCheck is an additional check run by Preflight, added with
+// WithPreflightCheck.
+type preflightCheck struct {
+	name  string
+	check func(*UpdateSts, int, logr.Logger) error
+}
+
+// imageReferenceRegexp is a simplified version of the grammar of container
+// image references: an optional registry host and port, a repository path of
+// lowercase components, and an optional tag and digest.
+var imageReferenceRegexp = regexp.MustCompile(
+	`^(?:[a-zA-Z0-9.-]+(?::[0-9]+)?/)?` +
+		`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+		`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?` +
+		`(?:@sha256:[a-f0-9]{64})?$`)
+
+// Preflight checks that the StatefulSet can be updated before any pod is
+// touched: every pod must currently be Ready, the health probe must pass and
+// the image of the updated CockroachDB container must be a valid image
+// reference. The checks added with WithPreflightCheck then run against pod 0. A
+// PreflightError is returned for the first check that fails.
+func Preflight(ctx context.Context, updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) error {
+	sts := updateSts.sts
+
+	for podNumber := 0; podNumber < int(replicasOf(sts)); podNumber++ {
+		podName := PodName(sts, podNumber)
+		pod, err := updateSts.clientset.CoreV1().Pods(updateSts.namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return PreflightError{Check: PreflightCheckPodsReady, Err: errors.Wrapf(err, "error getting pod %s", podName)}
+		}
+		if !kube.IsPodReady(pod) {
+			return PreflightError{Check: PreflightCheckPodsReady, Err: errors.Newf("pod %s is not ready", podName)}
+		}
+	}
+
+	if err := updateTimer.healthChecker.Probe(ctx, l, fmt.Sprintf("preflight for %s", updateSts.name), 0); err != nil {
+		return PreflightError{Check: PreflightCheckHealthProbe, Err: err}
+	}
+
+	image := dbContainerImage(&sts.Spec.Template)
+	if image == "" {
+		return PreflightError{Check: PreflightCheckImage, Err: errors.New("cockroachdb container not found in sts")}
+	}
+	if !imageReferenceRegexp.MatchString(image) {
+		return PreflightError{Check: PreflightCheckImage, Err: errors.Newf("%q is not a valid image reference", image)}
+	}
+
+	for _, c := range updateSts.preflightChecks {
+		if err := c.check(updateSts, 0, l); err != nil {
+			return PreflightError{Check: c.name, Err: err}
+		}
+	}
+	return nil
+}
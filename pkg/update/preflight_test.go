@@ -0,0 +1,182 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPreflight(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		image       string
+		notReady    int
+		failProbe   bool
+		check       string
+	}{
+		{
+			description: "passes",
+			image:       "cockroachdb/cockroach:v21.1.0",
+			notReady:    -1,
+		},
+		{
+			description: "passes with a registry and digest",
+			image:       "gcr.io:443/cockroachlabs/cockroach@sha256:" + fmt.Sprintf("%064x", 1),
+			notReady:    -1,
+		},
+		{
+			description: "fails when a pod is not ready",
+			image:       "cockroachdb/cockroach:v21.1.0",
+			notReady:    1,
+			check:       PreflightCheckPodsReady,
+		},
+		{
+			description: "fails when the health probe fails",
+			image:       "cockroachdb/cockroach:v21.1.0",
+			notReady:    -1,
+			failProbe:   true,
+			check:       PreflightCheckHealthProbe,
+		},
+		{
+			description: "fails with an invalid image reference",
+			image:       "cockroachdb/Cockroach:v21.1.0 ",
+			notReady:    -1,
+			check:       PreflightCheckImage,
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			if test.failProbe {
+				hc.failAfter = 0
+			}
+			clientset := fake.NewSimpleClientset(newTestStatefulSet(3))
+			for i := 0; i < 3; i++ {
+				pod := newTestReadyPod(fmt.Sprintf("cockroachdb-%d", i), i != test.notReady)
+				_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(), pod, metav1.CreateOptions{})
+				require.NoError(t, err)
+			}
+
+			updateSuite := NewUpdateFunctionSuite(
+				func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+					sts.Spec.Template.Spec.Containers[0].Image = test.image
+					return sts, nil
+				},
+				PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset)),
+			)
+			_, err := UpdateRegionStatefulSet(
+				context.Background(),
+				clientset,
+				updateSuite,
+				log.NullLogger{},
+				WithName(testStsName),
+				WithNamespace(testStsNamespace),
+				WithTimeout(time.Second),
+				WithPollingInterval(10*time.Millisecond),
+				WithHealthChecker(hc),
+				WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+				WithPreflight(),
+			)
+
+			if test.check == "" {
+				require.NoError(t, err)
+				require.Equal(t, int32(0), currentPartition(t, clientset))
+				return
+			}
+
+			var preflightErr PreflightError
+			require.True(t, errors.As(err, &preflightErr))
+			require.Equal(t, test.check, preflightErr.Check)
+			// no pod was touched
+			require.Empty(t, updatedPartitions(clientset))
+		})
+	}
+}
+
+func TestPreflightNilReplicas(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	_, updateSts, updateTimer := newTestUpdate(t, 0, hc)
+	updateSts.sts.Spec.Replicas = nil
+
+	// there is no pod to check, the other checks still run
+	require.NoError(t, Preflight(context.Background(), updateSts, updateTimer, log.NullLogger{}))
+	require.Equal(t, []int{0}, hc.calls)
+}
+
+func TestPreflightCheck(t *testing.T) {
+	for _, test := range []struct {
+		description string
+		liveNodes   int
+		wantErr     bool
+	}{
+		{description: "passes when every node is expected", liveNodes: 3},
+		{description: "fails when a zombie node lingers", liveNodes: 4, wantErr: true},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(newTestStatefulSet(3))
+			for i := 0; i < 3; i++ {
+				pod := newTestReadyPod(fmt.Sprintf("cockroachdb-%d", i), true)
+				_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(), pod, metav1.CreateOptions{})
+				require.NoError(t, err)
+			}
+			sqlConn, _ := newTestSQLConn(t, expectLiveNodes(test.liveNodes))
+
+			updateSuite := NewUpdateFunctionSuite(
+				func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+					sts.Spec.Template.Spec.Containers[0].Image = "cockroachdb/cockroach:v21.1.0"
+					return sts, nil
+				},
+				PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset)),
+			)
+			_, err := UpdateRegionStatefulSet(
+				context.Background(),
+				clientset,
+				updateSuite,
+				log.NullLogger{},
+				WithName(testStsName),
+				WithNamespace(testStsNamespace),
+				WithTimeout(time.Second),
+				WithPollingInterval(10*time.Millisecond),
+				WithHealthChecker(&fakeHealthChecker{failAfter: -1}),
+				WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+				WithPreflightCheck(PreflightCheckNoZombieNodes, NoZombieNodesVerificationFunc(sqlConn, 3)),
+			)
+
+			if !test.wantErr {
+				require.NoError(t, err)
+				require.Equal(t, int32(0), currentPartition(t, clientset))
+				return
+			}
+
+			var preflightErr PreflightError
+			require.True(t, errors.As(err, &preflightErr))
+			require.Equal(t, PreflightCheckNoZombieNodes, preflightErr.Check)
+			require.Contains(t, err.Error(), "cluster has 4 live nodes")
+			require.Empty(t, updatedPartitions(clientset))
+		})
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/cockroachdb/cockroach-operator/pkg/clustersql"
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+)
+
+// finalizeProbeInterval is how often the health of the cluster is probed while
+// soaking before an upgrade is finalized.
+var finalizeProbeInterval = 30 * time.Second
+
+// GetPreserveDowngradeOption returns the value of
+// cluster.preserve_downgrade_option, e.g. 20.2, or an empty string if it is not
+// set.
+func GetPreserveDowngradeOption(ctx context.Context, db *sql.DB) (string, error) {
+	value, err := clustersql.GetClusterSetting(ctx, db, PreserveDowngradeOptionClusterSetting)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting preserve downgrade option failed")
+	}
+	return value, nil
+}
+
+// SetPreserveDowngradeOption sets cluster.preserve_downgrade_option to the major
+// and minor version of fromVersion, e.g. 20.2 for v20.2.5. This keeps the
+// cluster from finalizing a major version upgrade, so that it can still be
+// rolled back. It must run before a major version rollout begins.
+//
+// It is safe to run again when an upgrade is resumed: nothing is changed if the
+// option is already set to that version, and an error is returned if it is set
+// to another version.
+func SetPreserveDowngradeOption(ctx context.Context, db *sql.DB, fromVersion string, l logr.Logger) error {
+	version, err := semver.NewVersion(fromVersion)
+	if err != nil {
+		return errors.Wrapf(err, "parsing version %s failed", fromVersion)
+	}
+
+	value := fmt.Sprintf("%d.%d", version.Major(), version.Minor())
+	if !validPreserveDowngradeOptionSetting.MatchString(value) {
+		return fmt.Errorf("%s is not a valid preserve downgrade option setting", value)
+	}
+
+	current, err := GetPreserveDowngradeOption(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current == value {
+		l.Info("preserve downgrade option already set", PreserveDowngradeOptionClusterSetting, value)
+		return nil
+	}
+	if current != "" {
+		return errors.Newf("preserve downgrade option is set to %s, expected %s or unset", current, value)
+	}
+
+	if err := clustersql.SetClusterSetting(ctx, db, PreserveDowngradeOptionClusterSetting, value); err != nil {
+		return errors.Wrapf(err, "setting preserve downgrade option failed")
+	}
+	return nil
+}
+
+// ClearPreserveDowngradeOption resets cluster.preserve_downgrade_option, which
+// lets the cluster finalize a major version upgrade. After that the upgrade
+// can't be rolled back anymore, so it must only run once every region has been
+// updated and the cluster has soaked successfully.
+func ClearPreserveDowngradeOption(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("RESET CLUSTER SETTING %s", PreserveDowngradeOptionClusterSetting)); err != nil {
+		return errors.Wrapf(err, "clearing preserve downgrade option failed")
+	}
+	return nil
+}
+
+// FinalizeUpgrade commits a major version upgrade once every region has been
+// updated. It probes the health of the cluster for the soak duration and only
+// then clears cluster.preserve_downgrade_option, after which the upgrade can't
+// be rolled back. If a probe fails during the soak the option is left in place
+// and an error is returned, so that the binaries can still be rolled back.
+func FinalizeUpgrade(
+	ctx context.Context,
+	db *sql.DB,
+	soak time.Duration,
+	healthChecker healthchecker.HealthChecker,
+	l logr.Logger,
+) error {
+	l.Info("soaking before finalizing upgrade", "soak", soak.String())
+	if err := soakAndProbe(ctx, defaultClock, healthChecker, soak, finalizeProbeInterval, "soaking before finalizing upgrade", 0, l); err != nil {
+		return errors.Wrapf(err, "not finalizing upgrade, health probe failed during soak")
+	}
+
+	if err := ClearPreserveDowngradeOption(ctx, db); err != nil {
+		return err
+	}
+	l.Info("upgrade finalized")
+	return nil
+}
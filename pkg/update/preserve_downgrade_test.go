@@ -0,0 +1,150 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cockroachdb/errors"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetPreserveDowngradeOption(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer db.Close()
+
+	expectCurrent := func(value string) {
+		mock.
+			ExpectQuery("SHOW CLUSTER SETTING cluster.preserve_downgrade_option").
+			WillReturnRows(sqlmock.NewRows([]string{"cluster.preserve_downgrade_option"}).AddRow(value))
+	}
+
+	t.Run("sets the major and minor version", func(t *testing.T) {
+		expectCurrent("")
+		mock.
+			ExpectExec("SET CLUSTER SETTING cluster.preserve_downgrade_option = $1").
+			WithArgs("20.2").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		require.NoError(t, SetPreserveDowngradeOption(context.Background(), db, "v20.2.5", log.NullLogger{}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("does nothing when already set to the same version", func(t *testing.T) {
+		expectCurrent("20.2")
+
+		require.NoError(t, SetPreserveDowngradeOption(context.Background(), db, "v20.2.5", log.NullLogger{}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when already set to another version", func(t *testing.T) {
+		expectCurrent("20.1")
+
+		err := SetPreserveDowngradeOption(context.Background(), db, "v20.2.5", log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "set to 20.1, expected 20.2")
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error with an invalid version", func(t *testing.T) {
+		require.Error(t, SetPreserveDowngradeOption(context.Background(), db, "latest", log.NullLogger{}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the setting can't be read", func(t *testing.T) {
+		mock.
+			ExpectQuery("SHOW CLUSTER SETTING cluster.preserve_downgrade_option").
+			WillReturnError(errors.New("boom"))
+
+		require.Error(t, SetPreserveDowngradeOption(context.Background(), db, "21.1.0", log.NullLogger{}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the statement fails", func(t *testing.T) {
+		expectCurrent("")
+		mock.
+			ExpectExec("SET CLUSTER SETTING cluster.preserve_downgrade_option = $1").
+			WithArgs("21.1").
+			WillReturnError(errors.New("boom"))
+
+		require.Error(t, SetPreserveDowngradeOption(context.Background(), db, "21.1.0", log.NullLogger{}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestClearPreserveDowngradeOption(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer db.Close()
+
+	t.Run("resets the setting", func(t *testing.T) {
+		mock.
+			ExpectExec("RESET CLUSTER SETTING cluster.preserve_downgrade_option").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		require.NoError(t, ClearPreserveDowngradeOption(context.Background(), db))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("returns error when the statement fails", func(t *testing.T) {
+		mock.
+			ExpectExec("RESET CLUSTER SETTING cluster.preserve_downgrade_option").
+			WillReturnError(errors.New("boom"))
+
+		require.Error(t, ClearPreserveDowngradeOption(context.Background(), db))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestFinalizeUpgrade(t *testing.T) {
+	defer func(interval time.Duration) { finalizeProbeInterval = interval }(finalizeProbeInterval)
+	finalizeProbeInterval = 10 * time.Millisecond
+
+	t.Run("clears the option after a healthy soak", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.
+			ExpectExec("RESET CLUSTER SETTING cluster.preserve_downgrade_option").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		hc := &fakeHealthChecker{failAfter: -1}
+		require.NoError(t, FinalizeUpgrade(context.Background(), db, 50*time.Millisecond, hc, log.NullLogger{}))
+		require.GreaterOrEqual(t, len(hc.calls), 2)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("keeps the option when a probe fails during the soak", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		require.NoError(t, err)
+		defer db.Close()
+
+		hc := &fakeHealthChecker{failAfter: 1}
+		err = FinalizeUpgrade(context.Background(), db, time.Second, hc, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not finalizing upgrade")
+		require.Len(t, hc.calls, 2)
+		// no statement was issued
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+)
+
+// underReplicatedRangesQuery returns the number of under-replicated ranges
+// reported by all the stores of the cluster.
+const underReplicatedRangesQuery = "SELECT COALESCE(sum((metrics->>'ranges.underreplicated')::DECIMAL), 0)::INT FROM crdb_internal.kv_store_status"
+
+// RangeReplicationHealthChecker is a HealthChecker that queries the replication
+// stats of the cluster over SQL and waits until no more than threshold ranges
+// are under-replicated.
+type RangeReplicationHealthChecker struct {
+	sqlConn   SQLConnFactory
+	namespace string
+	stsName   string
+	threshold int
+	// maxWait is how long Probe waits for the ranges to be replicated, polling
+	// at most every pollingInterval.
+	maxWait         time.Duration
+	pollingInterval time.Duration
+}
+
+var _ healthchecker.HealthChecker = &RangeReplicationHealthChecker{}
+
+// NewRangeReplicationHealthChecker returns a RangeReplicationHealthChecker that
+// connects to the pods of the StatefulSet stsName in namespace using sqlConn,
+// and tolerates up to threshold under-replicated ranges.
+func NewRangeReplicationHealthChecker(sqlConn SQLConnFactory, namespace, stsName string, threshold int) *RangeReplicationHealthChecker {
+	return &RangeReplicationHealthChecker{
+		sqlConn:         sqlConn,
+		namespace:       namespace,
+		stsName:         stsName,
+		threshold:       threshold,
+		maxWait:         3 * time.Minute,
+		pollingInterval: 10 * time.Second,
+	}
+}
+
+// Probe connects to the pod that was just updated and returns once no more than
+// threshold ranges are under-replicated, or an error if that does not happen
+// within maxWait.
+func (hc *RangeReplicationHealthChecker) Probe(ctx context.Context, l logr.Logger, logSuffix string, partition int) error {
+	podName := fmt.Sprintf("%s-%d", hc.stsName, partition)
+	l.V(int(zapcore.DebugLevel)).Info("range replication health check probe", "label", logSuffix, "podName", podName)
+
+	db, err := hc.sqlConn.Open(ctx, hc.namespace, podName)
+	if err != nil {
+		return errors.Wrapf(err, "error connecting to pod %s", podName)
+	}
+	defer db.Close()
+
+	f := func() error {
+		var underReplicated int
+		if err := db.QueryRowContext(ctx, underReplicatedRangesQuery).Scan(&underReplicated); err != nil {
+			return errors.Wrapf(err, "error getting under-replicated ranges from pod %s", podName)
+		}
+
+		l.V(int(zapcore.DebugLevel)).Info("under-replicated ranges", "label", logSuffix, "count", underReplicated, "threshold", hc.threshold)
+		if underReplicated > hc.threshold {
+			return errors.Newf("%d ranges are under-replicated, at most %d allowed", underReplicated, hc.threshold)
+		}
+		return nil
+	}
+
+	if err := pollFor(ctx, hc.maxWait, hc.pollingInterval, f); err != nil {
+		return errors.Wrapf(err, "range replication probe failed for cluster %s", logSuffix)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// expectUnderReplicated expects the number of under-replicated ranges to be
+// queried once for each of counts, in order.
+func expectUnderReplicated(counts ...int) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		for _, count := range counts {
+			mock.ExpectQuery(underReplicatedRangesQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+		}
+	}
+}
+
+func TestRangeReplicationHealthChecker(t *testing.T) {
+	newHealthChecker := func(sqlConn SQLConnFactory, threshold int) *RangeReplicationHealthChecker {
+		hc := NewRangeReplicationHealthChecker(sqlConn, testStsNamespace, testStsName, threshold)
+		hc.maxWait = time.Second
+		hc.pollingInterval = time.Millisecond
+		return hc
+	}
+
+	t.Run("waits until the ranges are replicated", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectUnderReplicated(5, 2, 0))
+
+		require.NoError(t, newHealthChecker(sqlConn, 0).Probe(context.Background(), log.NullLogger{}, "test", 2))
+		require.Equal(t, []string{"cockroachdb-2"}, *pods)
+	})
+
+	t.Run("tolerates under-replicated ranges up to the threshold", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectUnderReplicated(3))
+
+		require.NoError(t, newHealthChecker(sqlConn, 3).Probe(context.Background(), log.NullLogger{}, "test", 0))
+	})
+
+	t.Run("returns an error when the ranges stay under-replicated", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectUnderReplicated(1))
+		hc := newHealthChecker(sqlConn, 0)
+		// Give up after the first attempt.
+		hc.maxWait = time.Nanosecond
+
+		err := hc.Probe(context.Background(), log.NullLogger{}, "test", 0)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "1 ranges are under-replicated")
+	})
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+
+	"github.com/cockroachdb/errors"
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+)
+
+// RateLimiter throttles the calls made to the StatefulSets API. Wait blocks
+// until the next call is allowed or ctx is done. *rate.Limiter implements it.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+var _ RateLimiter = (*rate.Limiter)(nil)
+
+// statefulSets waits for the rate limiter, if any, and returns the StatefulSets
+// client of the namespace being updated. It must be called once per API call.
+func (u *UpdateSts) statefulSets(ctx context.Context) (appsv1.StatefulSetInterface, error) {
+	if u.limiter != nil {
+		if err := u.limiter.Wait(ctx); err != nil {
+			return nil, errors.Wrapf(err, "rate limiting sts %s ns: %s", u.name, u.namespace)
+		}
+	}
+	return u.clientset.AppsV1().StatefulSets(u.namespace), nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// fakeRateLimiter hands out one token per Wait, which the StatefulSets API
+// calls consume.
+type fakeRateLimiter struct {
+	mu     sync.Mutex
+	waits  int
+	tokens int
+	err    error
+}
+
+func (l *fakeRateLimiter) Wait(context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.waits++
+	if l.err != nil {
+		return l.err
+	}
+	l.tokens++
+	return nil
+}
+
+// take consumes a token and reports whether one was available.
+func (l *fakeRateLimiter) take() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tokens == 0 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func TestPartitionedRollingUpdateStrategyRateLimiter(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+	// Like partitionVerificationFunc, but the StatefulSet is read through the
+	// rate limiter so that every API call is accounted for.
+	verified := func(update *UpdateSts, podNumber int, _ logr.Logger) error {
+		stsClient, err := update.statefulSets(update.ctx)
+		if err != nil {
+			return err
+		}
+		sts, err := stsClient.Get(update.ctx, update.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		ru := sts.Spec.UpdateStrategy.RollingUpdate
+		if ru == nil || ru.Partition == nil || int(*ru.Partition) > podNumber {
+			return errors.New("pod not updated")
+		}
+		return nil
+	}
+
+	limiter := &fakeRateLimiter{}
+	updateSts.limiter = limiter
+
+	var calls int
+	clientset.PrependReactor("*", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		calls++
+		if !limiter.take() {
+			t.Errorf("%s of statefulsets was not rate limited", action.GetVerb())
+		}
+		return false, nil, nil
+	})
+
+	_, err := PartitionedRollingUpdateStrategy(verified)(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.Equal(t, []int32{2, 1, 0}, updatedPartitions(clientset))
+	require.NotZero(t, calls)
+	require.Equal(t, calls, limiter.waits)
+	require.Zero(t, limiter.tokens)
+
+	t.Run("aborts when the limiter fails", func(t *testing.T) {
+		_, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		updateSts.limiter = &fakeRateLimiter{err: errors.New("rate: Wait(n=1) would exceed context deadline")}
+
+		_, err := PartitionedRollingUpdateStrategy(verified)(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "rate limiting sts")
+	})
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/kube"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+	v1 "k8s.io/api/apps/v1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// decommissioningNodesQuery returns the address of every node that is
+// decommissioning or has been decommissioned.
+const decommissioningNodesQuery = `SELECT n.address
+FROM crdb_internal.gossip_liveness AS l
+JOIN crdb_internal.gossip_nodes AS n ON n.node_id = l.node_id
+WHERE l.decommissioning`
+
+// WaitUntilAllPodsReadyExcludingDecommissioned returns a function, to be passed
+// to WithWaitForPodsFunc, that waits until every pod of the StatefulSet is
+// ready. Pods running a node that is decommissioning, or has been
+// decommissioned, according to crdb_internal.gossip_liveness are not waited
+// for, since they may never become ready again and would block the update
+// forever.
+func WaitUntilAllPodsReadyExcludingDecommissioned(
+	clientset kubernetes.Interface,
+	db *sql.DB,
+	name, namespace string,
+	timeout, maxPollingInterval time.Duration,
+) func(ctx context.Context, l logr.Logger) error {
+	return func(ctx context.Context, l logr.Logger) error {
+		l.V(int(zapcore.DebugLevel)).Info("waiting until all pods that are not decommissioning are in the ready state")
+		f := func() error {
+			sts, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return handleStsError(err, l, name, namespace)
+			}
+
+			decommissioning, err := decommissioningPods(ctx, db)
+			if err != nil {
+				return err
+			}
+
+			if err := checkPodsReady(ctx, clientset, sts, decommissioning, l); err != nil {
+				return err
+			}
+
+			l.V(int(zapcore.DebugLevel)).Info("all pods that are not decommissioning are ready")
+			return nil
+		}
+
+		return pollFor(ctx, timeout, maxPollingInterval, f)
+	}
+}
+
+// WaitForAllPodsReady returns a function, to be passed to WithWaitForPodsFunc,
+// that polls the pods of the StatefulSet stsName every interval at most, until
+// all of them are ready or timeout has elapsed.
+func WaitForAllPodsReady(
+	clientset kubernetes.Interface,
+	namespace, stsName string,
+	timeout, interval time.Duration,
+) func(ctx context.Context, l logr.Logger) error {
+	return func(ctx context.Context, l logr.Logger) error {
+		l.V(int(zapcore.DebugLevel)).Info("waiting until all pods are in the ready state")
+		err := pollFor(ctx, timeout, interval, func() error {
+			sts, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, stsName, metav1.GetOptions{})
+			if err != nil {
+				return handleStsError(err, l, stsName, namespace)
+			}
+			return checkPodsReady(ctx, clientset, sts, nil, l)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "pods of sts %s ns: %s not ready after %s", stsName, namespace, timeout)
+		}
+
+		l.V(int(zapcore.DebugLevel)).Info("all pods are ready")
+		return nil
+	}
+}
+
+// checkPodsReady returns an error unless every pod of the StatefulSet, except
+// the decommissioning ones, exists and is ready.
+func checkPodsReady(ctx context.Context, clientset kubernetes.Interface, sts *v1.StatefulSet, decommissioning map[string]bool, l logr.Logger) error {
+	for podNumber := 0; podNumber < int(replicasOf(sts)); podNumber++ {
+		podName := PodName(sts, podNumber)
+		if decommissioning[podName] {
+			l.V(int(zapcore.DebugLevel)).Info("not waiting for decommissioning pod", "podName", podName)
+			continue
+		}
+
+		pod, err := clientset.CoreV1().Pods(sts.Namespace).Get(ctx, podName, metav1.GetOptions{})
+		if k8sErrors.IsNotFound(err) {
+			return errors.Newf("pod %s does not exist yet", podName)
+		} else if err != nil {
+			return errors.Wrapf(err, "error getting pod %s", podName)
+		}
+		if !kube.IsPodReady(pod) {
+			return errors.Newf("pod %s is not ready", podName)
+		}
+	}
+	return nil
+}
+
+// decommissioningPods returns the names of the pods running a node that is
+// decommissioning or has been decommissioned. The pod name is the first label
+// of the address the node advertises, e.g. cockroachdb-2 for
+// cockroachdb-2.cockroachdb.default:26257.
+func decommissioningPods(ctx context.Context, db *sql.DB) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, decommissioningNodesQuery)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting decommissioning nodes")
+	}
+	defer rows.Close()
+
+	pods := map[string]bool{}
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			return nil, errors.Wrapf(err, "error getting decommissioning nodes")
+		}
+		host := strings.SplitN(address, ":", 2)[0]
+		pods[strings.SplitN(host, ".", 2)[0]] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error getting decommissioning nodes")
+	}
+	return pods, nil
+}
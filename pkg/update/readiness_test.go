@@ -0,0 +1,139 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestReadyPod(name string, ready bool) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testStsNamespace,
+		},
+		Status: corev1.PodStatus{
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: status},
+			},
+		},
+	}
+}
+
+func TestWaitUntilAllPodsReadyExcludingDecommissioned(t *testing.T) {
+	newClientset := func() *fake.Clientset {
+		return fake.NewSimpleClientset(
+			newTestStatefulSet(3),
+			newTestReadyPod("cockroachdb-0", true),
+			newTestReadyPod("cockroachdb-1", false),
+			newTestReadyPod("cockroachdb-2", true),
+		)
+	}
+
+	t.Run("does not wait for a decommissioning node", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(decommissioningNodesQuery).WillReturnRows(
+			sqlmock.NewRows([]string{"address"}).AddRow("cockroachdb-1.cockroachdb.testns:26257"))
+
+		wait := WaitUntilAllPodsReadyExcludingDecommissioned(newClientset(), db, testStsName, testStsNamespace, time.Second, 10*time.Millisecond)
+		require.NoError(t, wait(context.Background(), log.NullLogger{}))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("waits for a node that is not decommissioning", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		require.NoError(t, err)
+		defer db.Close()
+
+		// the check is retried until the timeout, with no node decommissioning
+		for i := 0; i < 100; i++ {
+			mock.ExpectQuery(decommissioningNodesQuery).WillReturnRows(sqlmock.NewRows([]string{"address"}))
+		}
+
+		wait := WaitUntilAllPodsReadyExcludingDecommissioned(newClientset(), db, testStsName, testStsNamespace, 50*time.Millisecond, 10*time.Millisecond)
+		err = wait(context.Background(), log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "cockroachdb-1 is not ready")
+	})
+}
+
+func TestWaitForAllPodsReady(t *testing.T) {
+	t.Run("waits until the pods become ready", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(
+			newTestStatefulSet(3),
+			newTestReadyPod("cockroachdb-0", true),
+			newTestReadyPod("cockroachdb-1", false),
+			newTestReadyPod("cockroachdb-2", false),
+		)
+		// Every poll makes one more pod ready.
+		polls := 0
+		clientset.PrependReactor("get", "statefulsets", func(k8stesting.Action) (bool, runtime.Object, error) {
+			polls++
+			if polls > 1 && polls <= 3 {
+				pod := newTestReadyPod(fmt.Sprintf("cockroachdb-%d", polls-1), true)
+				if err := clientset.Tracker().Update(corev1.SchemeGroupVersion.WithResource("pods"), pod, testStsNamespace); err != nil {
+					return true, nil, err
+				}
+			}
+			return false, nil, nil
+		})
+
+		wait := WaitForAllPodsReady(clientset, testStsNamespace, testStsName, time.Second, time.Millisecond)
+		require.NoError(t, wait(context.Background(), log.NullLogger{}))
+		require.Equal(t, 3, polls)
+	})
+
+	t.Run("times out when a pod never becomes ready", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(
+			newTestStatefulSet(2),
+			newTestReadyPod("cockroachdb-0", true),
+			newTestReadyPod("cockroachdb-1", false),
+		)
+
+		wait := WaitForAllPodsReady(clientset, testStsNamespace, testStsName, 50*time.Millisecond, 10*time.Millisecond)
+		err := wait(context.Background(), log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "pods of sts cockroachdb ns: testns not ready after 50ms")
+		require.Contains(t, err.Error(), "pod cockroachdb-1 is not ready")
+	})
+
+	t.Run("waits for a missing pod", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(newTestStatefulSet(1))
+
+		wait := WaitForAllPodsReady(clientset, testStsNamespace, testStsName, 20*time.Millisecond, 10*time.Millisecond)
+		require.Contains(t, wait(context.Background(), log.NullLogger{}).Error(), "pod cockroachdb-0 does not exist yet")
+	})
+}
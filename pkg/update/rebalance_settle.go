@@ -0,0 +1,119 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+)
+
+// rangeMovementsQuery returns the number of replicas added to and removed from
+// all the stores of the cluster since they started. The counters only grow, so
+// the difference between two samples is the number of range movements in
+// between.
+const rangeMovementsQuery = "SELECT COALESCE(sum((metrics->>'range.adds')::DECIMAL + (metrics->>'range.removes')::DECIMAL), 0)::INT FROM crdb_internal.kv_store_status"
+
+// RebalanceSettleHealthChecker is a HealthChecker that samples the range
+// movements of the cluster over SQL and waits until no more than threshold
+// ranges move during samplingWindow, meaning that the rebalancing caused by the
+// restart of a node has settled.
+type RebalanceSettleHealthChecker struct {
+	sqlConn        SQLConnFactory
+	namespace      string
+	stsName        string
+	threshold      int
+	samplingWindow time.Duration
+	// maxWait is how long Probe waits for the rebalancing to settle, sampling
+	// at most every pollingInterval.
+	maxWait         time.Duration
+	pollingInterval time.Duration
+}
+
+var _ healthchecker.HealthChecker = &RebalanceSettleHealthChecker{}
+
+// NewRebalanceSettleHealthChecker returns a RebalanceSettleHealthChecker that
+// connects to the pods of the StatefulSet stsName in namespace using sqlConn,
+// and tolerates up to threshold range movements in samplingWindow.
+func NewRebalanceSettleHealthChecker(sqlConn SQLConnFactory, namespace, stsName string, threshold int, samplingWindow time.Duration) *RebalanceSettleHealthChecker {
+	return &RebalanceSettleHealthChecker{
+		sqlConn:         sqlConn,
+		namespace:       namespace,
+		stsName:         stsName,
+		threshold:       threshold,
+		samplingWindow:  samplingWindow,
+		maxWait:         5 * time.Minute,
+		pollingInterval: 10 * time.Second,
+	}
+}
+
+// Probe connects to the pod that was just updated and returns once no more than
+// threshold ranges moved during a sampling window, or an error if that does not
+// happen within maxWait.
+func (hc *RebalanceSettleHealthChecker) Probe(ctx context.Context, l logr.Logger, logSuffix string, partition int) error {
+	podName := fmt.Sprintf("%s-%d", hc.stsName, partition)
+	l.V(int(zapcore.DebugLevel)).Info("rebalance settle health check probe", "label", logSuffix, "podName", podName)
+
+	db, err := hc.sqlConn.Open(ctx, hc.namespace, podName)
+	if err != nil {
+		return errors.Wrapf(err, "error connecting to pod %s", podName)
+	}
+	defer db.Close()
+
+	rangeMovements := func() (int, error) {
+		var movements int
+		if err := db.QueryRowContext(ctx, rangeMovementsQuery).Scan(&movements); err != nil {
+			return 0, errors.Wrapf(err, "error getting range movements from pod %s", podName)
+		}
+		return movements, nil
+	}
+
+	f := func() error {
+		before, err := rangeMovements()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-clockFrom(ctx).After(hc.samplingWindow):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		after, err := rangeMovements()
+		if err != nil {
+			return err
+		}
+
+		moved := after - before
+		l.V(int(zapcore.DebugLevel)).Info("range movements", "label", logSuffix, "count", moved, "window", hc.samplingWindow, "threshold", hc.threshold)
+		if moved > hc.threshold {
+			return errors.Newf("%d ranges moved in %s, at most %d allowed", moved, hc.samplingWindow, hc.threshold)
+		}
+		return nil
+	}
+
+	if err := pollFor(ctx, hc.maxWait, hc.pollingInterval, f); err != nil {
+		return errors.Wrapf(err, "rebalance settle probe failed for cluster %s", logSuffix)
+	}
+	return nil
+}
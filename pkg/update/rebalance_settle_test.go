@@ -0,0 +1,64 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// expectRangeMovements expects the range movements to be sampled once for each
+// of counts, in order.
+func expectRangeMovements(counts ...int) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		for _, count := range counts {
+			mock.ExpectQuery(rangeMovementsQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+		}
+	}
+}
+
+func TestRebalanceSettleHealthChecker(t *testing.T) {
+	newHealthChecker := func(sqlConn SQLConnFactory, threshold int) *RebalanceSettleHealthChecker {
+		hc := NewRebalanceSettleHealthChecker(sqlConn, testStsNamespace, testStsName, threshold, time.Millisecond)
+		hc.maxWait = time.Second
+		hc.pollingInterval = time.Millisecond
+		return hc
+	}
+
+	t.Run("waits until the rebalancing settles", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectRangeMovements(100, 150, 150, 152))
+
+		require.NoError(t, newHealthChecker(sqlConn, 5).Probe(context.Background(), log.NullLogger{}, "test", 2))
+		require.Equal(t, []string{"cockroachdb-2"}, *pods)
+	})
+
+	t.Run("returns an error when the ranges keep moving", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectRangeMovements(100, 150))
+		hc := newHealthChecker(sqlConn, 5)
+		// Give up after the first attempt.
+		hc.maxWait = time.Nanosecond
+
+		err := hc.Probe(context.Background(), log.NullLogger{}, "test", 0)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "50 ranges moved")
+	})
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	"golang.org/x/sync/semaphore"
+	"k8s.io/client-go/kubernetes"
+)
+
+// InterRegionDelay is the delay that is usually waited between updating a
+// region and updating the next one, giving the cluster time to settle. See
+// MaybeSleep.
+const InterRegionDelay time.Duration = time.Minute
+
+// MaybeSleep waits for delay after a region has been updated, unless skipSleep
+// is true. UpdateRegionStatefulSet returns skipSleep true when every partition
+// was already updated, or the update is paused, so that there is nothing for
+// the cluster to settle from and no delay is needed.
+func MaybeSleep(skipSleep bool, delay time.Duration) {
+	maybeSleep(defaultClock, skipSleep, delay)
+}
+
+// maybeSleep is MaybeSleep on clock.
+func maybeSleep(clock Clock, skipSleep bool, delay time.Duration) {
+	if skipSleep || delay <= 0 {
+		return
+	}
+	clock.Sleep(delay)
+}
+
+// UpdateRegionStatefulSets applies the updateSuite to each of the named
+// StatefulSets of a region that is split into several shards, one StatefulSet
+// after the other, using UpdateRegionStatefulSet with a copy of updateTimer. It
+// stops at the first StatefulSet that fails to update. The returned skipSleep is
+// only true if every StatefulSet was already updated, see MaybeSleep.
+func UpdateRegionStatefulSets(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	names []string,
+	namespace string,
+	updateSuite *updateFunctionSuite,
+	updateTimer *UpdateTimer,
+	l logr.Logger,
+	opts ...UpdateOption,
+) (bool, error) {
+	skipSleep := true
+	for _, name := range names {
+		timer := *updateTimer
+		skipped, err := UpdateRegionStatefulSet(
+			ctx,
+			clientset,
+			updateSuite,
+			l.WithValues(logKeyStsName, name),
+			append([]UpdateOption{
+				WithName(name),
+				WithNamespace(namespace),
+				withUpdateTimer(&timer),
+			}, opts...)...,
+		)
+		if err != nil {
+			return false, errors.Wrapf(err, "updating sts %s ns: %s", name, namespace)
+		}
+		skipSleep = skipSleep && skipped
+	}
+	return skipSleep, nil
+}
+
+// RegionUpdate describes the update of the CockroachDB StatefulSet of a single
+// region, see UpdateRegionStatefulSet.
+type RegionUpdate struct {
+	// Region identifies the region in logs and errors.
+	Region      string
+	Clientset   kubernetes.Interface
+	UpdateSuite *updateFunctionSuite
+	Options     []UpdateOption
+}
+
+// RegionsOption defines a configuration option for UpdateAllRegions.
+type RegionsOption interface {
+	apply(*regionsOptions)
+}
+
+// regionsOptions contains the configurable values for updating several regions
+// at the same time.
+type regionsOptions struct {
+	cancelOnFailure bool
+}
+
+type regionsOptionFn func(*regionsOptions)
+
+func (fn regionsOptionFn) apply(o *regionsOptions) { fn(o) }
+
+// WithCancelOnFailure cancels the update of every other region as soon as the
+// update of one region fails. Regions that haven't started yet are not updated.
+// Default: false
+func WithCancelOnFailure() RegionsOption {
+	return regionsOptionFn(func(o *regionsOptions) { o.cancelOnFailure = true })
+}
+
+// UpdateAllRegions updates the StatefulSets of several regions, running at most
+// maxConcurrent region updates at the same time so the control plane isn't
+// overwhelmed. Values of maxConcurrent lower than 1 update one region at a
+// time. The errors of every failed region are combined into the returned error.
+func UpdateAllRegions(
+	ctx context.Context,
+	regions []RegionUpdate,
+	maxConcurrent int,
+	l logr.Logger,
+	opts ...RegionsOption,
+) error {
+	o := &regionsOptions{}
+	for _, opt := range opts {
+		opt.apply(o)
+	}
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sem := semaphore.NewWeighted(int64(maxConcurrent))
+	regionErrs := make([]error, len(regions))
+	var wg sync.WaitGroup
+	for i := range regions {
+		region := regions[i]
+		// Acquire succeeds on a cancelled context when a slot is free, so the
+		// context is checked again before starting the region.
+		err := sem.Acquire(ctx, 1)
+		if err == nil && ctx.Err() != nil {
+			sem.Release(1)
+			err = ctx.Err()
+		}
+		if err != nil {
+			// The update was cancelled, the remaining regions are not started.
+			for j := i; j < len(regions); j++ {
+				regionErrs[j] = errors.Wrapf(err, "region %s not updated", regions[j].Region)
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer sem.Release(1)
+
+			rl := l.WithValues("region", region.Region)
+			rl.Info("updating region")
+			if _, err := UpdateRegionStatefulSet(ctx, region.Clientset, region.UpdateSuite, rl, region.Options...); err != nil {
+				regionErrs[i] = errors.Wrapf(err, "updating region %s", region.Region)
+				if o.cancelOnFailure {
+					cancel()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var combined error
+	var failed []string
+	for i, err := range regionErrs {
+		if err != nil {
+			combined = errors.CombineErrors(combined, err)
+			failed = append(failed, regions[i].Region)
+		}
+	}
+	if combined == nil {
+		return nil
+	}
+	return errors.Wrapf(combined, "%d of %d regions failed to update (%s)",
+		len(failed), len(regions), strings.Join(failed, ", "))
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// concurrencyTracker records how many region updates run at the same time.
+type concurrencyTracker struct {
+	mu      sync.Mutex
+	running int
+	max     int
+	regions []string
+}
+
+// strategy returns an update strategy that takes a little while, and fails
+// for the regions in fail.
+func (c *concurrencyTracker) strategy(fail ...string) func(*UpdateSts, *UpdateTimer, logr.Logger) (bool, error) {
+	return func(updateSts *UpdateSts, _ *UpdateTimer, _ logr.Logger) (bool, error) {
+		c.mu.Lock()
+		c.running++
+		if c.running > c.max {
+			c.max = c.running
+		}
+		c.regions = append(c.regions, updateSts.Namespace())
+		c.mu.Unlock()
+
+		defer func() {
+			c.mu.Lock()
+			c.running--
+			c.mu.Unlock()
+		}()
+
+		for _, region := range fail {
+			if region == updateSts.Namespace() {
+				return false, errors.New("region failed")
+			}
+		}
+		select {
+		case <-updateSts.ctx.Done():
+			return false, updateSts.ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+		return false, nil
+	}
+}
+
+func newTestRegions(n int, strategy func(*UpdateSts, *UpdateTimer, logr.Logger) (bool, error)) []RegionUpdate {
+	var regions []RegionUpdate
+	for i := 0; i < n; i++ {
+		region := fmt.Sprintf("region-%d", i)
+		sts := newTestStatefulSet(3)
+		sts.Namespace = region
+		regions = append(regions, RegionUpdate{
+			Region:    region,
+			Clientset: fake.NewSimpleClientset(sts),
+			UpdateSuite: NewUpdateFunctionSuite(
+				func(sts *v1.StatefulSet) (*v1.StatefulSet, error) { return sts, nil },
+				strategy,
+			),
+			Options: []UpdateOption{
+				WithName(testStsName),
+				WithNamespace(region),
+				WithHealthChecker(&fakeHealthChecker{failAfter: -1}),
+				WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+				WithRollUnchanged(),
+			},
+		})
+	}
+	return regions
+}
+
+func TestUpdateAllRegions(t *testing.T) {
+	t.Run("updates at most maxConcurrent regions at a time", func(t *testing.T) {
+		tracker := &concurrencyTracker{}
+		regions := newTestRegions(4, tracker.strategy())
+
+		require.NoError(t, UpdateAllRegions(context.Background(), regions, 2, log.NullLogger{}))
+		require.Equal(t, 2, tracker.max)
+		require.ElementsMatch(t, []string{"region-0", "region-1", "region-2", "region-3"}, tracker.regions)
+	})
+
+	t.Run("returns the errors of the failed regions", func(t *testing.T) {
+		tracker := &concurrencyTracker{}
+		regions := newTestRegions(4, tracker.strategy("region-1", "region-3"))
+
+		err := UpdateAllRegions(context.Background(), regions, 2, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "2 of 4 regions failed to update (region-1, region-3)")
+		// the other regions were still updated
+		require.Len(t, tracker.regions, 4)
+	})
+
+	t.Run("cancels the other regions on failure", func(t *testing.T) {
+		tracker := &concurrencyTracker{}
+		regions := newTestRegions(4, tracker.strategy("region-0"))
+
+		err := UpdateAllRegions(context.Background(), regions, 2, log.NullLogger{}, WithCancelOnFailure())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "4 of 4 regions failed to update")
+		// region-1 may have been running and was cancelled, the other regions
+		// were never started
+		require.Contains(t, tracker.regions, "region-0")
+		require.LessOrEqual(t, len(tracker.regions), 2)
+		require.Contains(t, fmt.Sprintf("%+v", err), "context canceled")
+	})
+}
+
+func TestMaybeSleep(t *testing.T) {
+	clock := newFakeClock()
+
+	maybeSleep(clock, true, InterRegionDelay)
+	require.Empty(t, clock.slept, "no delay is needed when every partition was already updated")
+
+	maybeSleep(clock, false, InterRegionDelay)
+	require.Equal(t, []time.Duration{InterRegionDelay}, clock.slept)
+
+	maybeSleep(clock, false, 0)
+	require.Len(t, clock.slept, 1)
+}
+
+func TestUpdateRegionStatefulSets(t *testing.T) {
+	// newShards returns a clientset with the StatefulSets of two shards.
+	newShards := func() *fake.Clientset {
+		var objects []runtime.Object
+		for _, name := range []string{"cockroachdb-a", "cockroachdb-b"} {
+			sts := newTestStatefulSet(3)
+			sts.Name = name
+			objects = append(objects, sts)
+		}
+		return fake.NewSimpleClientset(objects...)
+	}
+	updateImage := func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+		sts.Spec.Template.Spec.Containers[0].Image = "cockroachdb/cockroach:v21.1.0"
+		return sts, nil
+	}
+	// updated treats the pods of the StatefulSets in names as already updated.
+	updated := func(clientset *fake.Clientset, names ...string) func(*UpdateSts, int, logr.Logger) error {
+		verify := partitionVerificationFunc(clientset)
+		return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+			for _, name := range names {
+				if updateSts.Name() == name {
+					return nil
+				}
+			}
+			return verify(updateSts, podNumber, l)
+		}
+	}
+	partition := func(t *testing.T, clientset *fake.Clientset, name string) *int32 {
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		if sts.Spec.UpdateStrategy.RollingUpdate == nil {
+			return nil
+		}
+		return sts.Spec.UpdateStrategy.RollingUpdate.Partition
+	}
+	newTimer := func(t *testing.T) *UpdateTimer {
+		updateTimer, err := NewUpdateTimer(time.Second, 10*time.Millisecond, &fakeHealthChecker{failAfter: -1},
+			func(context.Context, logr.Logger) error { return nil })
+		require.NoError(t, err)
+		return updateTimer
+	}
+	names := []string{"cockroachdb-a", "cockroachdb-b"}
+
+	t.Run("updates the shards that are not updated yet", func(t *testing.T) {
+		clientset := newShards()
+		updateSuite := NewUpdateFunctionSuite(updateImage, PartitionedRollingUpdateStrategy(updated(clientset, "cockroachdb-a")))
+
+		skipSleep, err := UpdateRegionStatefulSets(context.Background(), clientset, names, testStsNamespace, updateSuite, newTimer(t), log.NullLogger{})
+		require.NoError(t, err)
+		require.False(t, skipSleep)
+		require.Nil(t, partition(t, clientset, "cockroachdb-a"))
+		require.Equal(t, int32(0), *partition(t, clientset, "cockroachdb-b"))
+	})
+
+	t.Run("skips sleeping when every shard is already updated", func(t *testing.T) {
+		clientset := newShards()
+		updateSuite := NewUpdateFunctionSuite(updateImage, PartitionedRollingUpdateStrategy(updated(clientset, names...)))
+
+		skipSleep, err := UpdateRegionStatefulSets(context.Background(), clientset, names, testStsNamespace, updateSuite, newTimer(t), log.NullLogger{})
+		require.NoError(t, err)
+		require.True(t, skipSleep)
+	})
+
+	t.Run("stops at the first shard that fails", func(t *testing.T) {
+		clientset := newShards()
+		updateSuite := NewUpdateFunctionSuite(updateImage, PartitionedRollingUpdateStrategy(updated(clientset)))
+
+		_, err := UpdateRegionStatefulSets(context.Background(), clientset, []string{"missing", "cockroachdb-b"}, testStsNamespace,
+			updateSuite, newTimer(t), log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "updating sts missing ns: testns")
+		require.Nil(t, partition(t, clientset, "cockroachdb-b"))
+	})
+}
@@ -78,7 +78,7 @@ func makeRollingUpdateVerificationFunc() func(update *UpdateSts, podNumber int,
 
 		// TODO refactor code and func to handle errors vs IsNotFound or !IsPodReady
 
-		podName := fmt.Sprintf("%s-%d", update.sts.Name, podNumber)
+		podName := update.PodName(podNumber)
 		crdbPod, err := update.clientset.CoreV1().Pods(update.namespace).Get(update.ctx, podName, metav1.GetOptions{})
 		if k8sErrors.IsNotFound(err) { // this is not an error
 			l.Info("cannot find Pod", "podName", podName, "namespace", update.sts.Namespace)
@@ -0,0 +1,48 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SQLConnFactory opens SQL connections to individual CockroachDB pods, so that
+// the update can check the state of the node running in a pod it has just
+// restarted. It is an interface so that the connection can be faked in tests.
+type SQLConnFactory interface {
+	// Open returns a connection to the CockroachDB node running in the named pod.
+	// The caller is responsible for closing the connection.
+	//
+	// podName is usually the bare name of the pod, e.g. cockroachdb-1, but
+	// SQLReadinessVerificationFunc passes the DNS name of the pod through the
+	// governing service of the StatefulSet instead, e.g. cockroachdb-1.cockroachdb.
+	// A name that contains a dot is already qualified with the service and must
+	// be connected to as is.
+	Open(ctx context.Context, namespace, podName string) (*sql.DB, error)
+}
+
+// SQLConnFactoryFunc is an adapter to allow the use of an ordinary function as
+// a SQLConnFactory.
+type SQLConnFactoryFunc func(ctx context.Context, namespace, podName string) (*sql.DB, error)
+
+var _ SQLConnFactory = SQLConnFactoryFunc(nil)
+
+// Open calls f(ctx, namespace, podName).
+func (f SQLConnFactoryFunc) Open(ctx context.Context, namespace, podName string) (*sql.DB, error) {
+	return f(ctx, namespace, podName)
+}
@@ -18,25 +18,65 @@ package update
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
 	"github.com/cockroachdb/errors"
 	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pmezard/go-difflib/difflib"
 	"go.uber.org/zap/zapcore"
 	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
 )
 
 const (
 	PreserveDowngradeOptionClusterSetting = "cluster.preserve_downgrade_option"
+
+	// PauseUpdateAnnotation freezes an in-progress update when it is set to
+	// "true" on the StatefulSet. The update resumes from where it left off once
+	// the annotation is removed.
+	PauseUpdateAnnotation = "crdb.cockroachlabs.com/pause-update"
+)
+
+// Keys of the structured logs of the update, so that the same field always has
+// the same name.
+const (
+	logKeyNamespace = "namespace"
+	logKeyStsName   = "stsName"
+	logKeyPartition = "partition"
 )
 
+// ErrRolledBack is returned when an update was halted and the StatefulSet was
+// restored to its pre-update pod template.
+var ErrRolledBack = errors.New("update rolled back")
+
+// ErrPodFailed marks the errors of perPodVerificationFuncs that retrying won't
+// fix, e.g. because the pod is in CrashLoopBackOff, so that the verification
+// gives up immediately instead of retrying until podUpdateTimeout. Returning a
+// backoff.PermanentError, wrapped or not, has the same effect.
+var ErrPodFailed = errors.New("pod failed")
+
+// ErrConflictRetriesExhausted is returned when the StatefulSet kept being
+// modified concurrently and updating it still conflicted after every retry.
+// Callers may requeue the update with a backoff.
+var ErrConflictRetriesExhausted = errors.New("statefulset update conflict retries exhausted")
+
 // updateFunctionSuite is a collection of functions used to update the
 // CockroachDB StatefulSet in each region of a CockroachDB cluster. This suite
 // gets passed as an argument to updateClusterStatefulSets to handle the update
@@ -67,6 +107,147 @@ type UpdateSts struct {
 	sts       *v1.StatefulSet
 	namespace string
 	name      string
+	// preUpdateTemplate and preUpdateStrategy are captured before updateFunc
+	// runs, so that a failed update can be rolled back.
+	preUpdateTemplate *corev1.PodTemplateSpec
+	preUpdateStrategy *v1.StatefulSetUpdateStrategy
+	// eventRecorder is optional, when nil no events are emitted.
+	eventRecorder record.EventRecorder
+	eventObject   runtime.Object
+	// metrics is optional, when nil no metrics are recorded.
+	metrics *Metrics
+	// dryRun logs the changes that would be made without applying them.
+	dryRun bool
+	// operatorVersion is recorded in the update history.
+	operatorVersion string
+	// pdbName is the PodDisruptionBudget that must allow a disruption before a
+	// pod is restarted. The check is skipped when empty.
+	pdbName string
+	// limiter is optional, when nil the StatefulSets API is not rate limited.
+	limiter RateLimiter
+	// preflightChecks are run by Preflight after its own checks.
+	preflightChecks []preflightCheck
+	// rolledAt is when the pods being verified were rolled. It is only set on
+	// the copy of the UpdateSts that is passed to perPodVerificationFunc once
+	// the partition has been lowered or the pods deleted.
+	rolledAt time.Time
+	// incomplete is set by the update strategy when it returned before every
+	// pod was updated, without an error, e.g. because of a per invocation limit.
+	incomplete bool
+	// conflictBackoff is the backoff used to retry writes to the StatefulSet
+	// that conflict with a concurrent change, see WithConflictRetry.
+	// retry.DefaultRetry is used when it is left empty.
+	conflictBackoff wait.Backoff
+	// conflictRetryMaxDuration caps how long conflicting writes are retried,
+	// whatever steps conflictBackoff has left, see
+	// WithConflictRetryMaxDuration. Zero means no limit.
+	conflictRetryMaxDuration time.Duration
+}
+
+// defaultConflictRetryMaxDuration is the conflictRetryMaxDuration of the
+// UpdateSts returned by NewUpdateSts.
+const defaultConflictRetryMaxDuration = 30 * time.Second
+
+// NewUpdateSts returns an UpdateSts for the StatefulSet with the given name and
+// namespace. sts may be nil, in which case it is read from the cluster when the
+// update starts.
+func NewUpdateSts(ctx context.Context, clientset kubernetes.Interface, sts *v1.StatefulSet, name, namespace string) *UpdateSts {
+	return &UpdateSts{
+		ctx:                      ctx,
+		clientset:                clientset,
+		sts:                      sts,
+		name:                     name,
+		namespace:                namespace,
+		conflictBackoff:          retry.DefaultRetry,
+		conflictRetryMaxDuration: defaultConflictRetryMaxDuration,
+	}
+}
+
+// conflictRetry returns the backoff used to retry conflicting writes to the
+// StatefulSet.
+func (u *UpdateSts) conflictRetry() wait.Backoff {
+	if u.conflictBackoff.Steps == 0 {
+		return retry.DefaultRetry
+	}
+	return u.conflictBackoff
+}
+
+// retryOnConflict is retry.RetryOnConflict with the conflictRetry backoff,
+// waiting on the clock of the update, except that it also gives up, returning
+// the last conflict, once conflictRetryMaxDuration has elapsed.
+func (u *UpdateSts) retryOnConflict(fn func() error) error {
+	clock := clockFrom(u.ctx)
+	start := clock.Now()
+	b := u.conflictRetry()
+	for {
+		err := fn()
+		if err == nil || !k8sErrors.IsConflict(err) {
+			return err
+		}
+		if b.Steps <= 1 || (u.conflictRetryMaxDuration > 0 && clock.Now().Sub(start) >= u.conflictRetryMaxDuration) {
+			return err
+		}
+		clock.Sleep(b.Step())
+	}
+}
+
+// Name returns the name of the StatefulSet being updated.
+func (u *UpdateSts) Name() string {
+	return u.name
+}
+
+// Namespace returns the namespace of the StatefulSet being updated.
+func (u *UpdateSts) Namespace() string {
+	return u.namespace
+}
+
+// StatefulSet returns the StatefulSet being updated, as last read from or
+// written to the cluster.
+func (u *UpdateSts) StatefulSet() *v1.StatefulSet {
+	return u.sts
+}
+
+// PodName returns the name of the pod of the StatefulSet being updated with the
+// given partition number, see PodName.
+func (u *UpdateSts) PodName(partition int) string {
+	return PodName(u.sts, partition)
+}
+
+// PodName returns the name of the pod of sts with the given partition number,
+// e.g. cockroachdb-2. An empty string is returned if sts has no such pod,
+// including when it has no replicas.
+func PodName(sts *v1.StatefulSet, partition int) string {
+	if partition < 0 || partition >= int(replicasOf(sts)) {
+		return ""
+	}
+	return fmt.Sprintf("%s-%d", sts.Name, partition)
+}
+
+// replicasOf returns the number of replicas of sts. A nil count is treated as no
+// replicas: the API server defaults it to 1, so only a StatefulSet that wasn't
+// read back from it lacks one, and guessing its size could touch the wrong pods.
+func replicasOf(sts *v1.StatefulSet) int32 {
+	if sts.Spec.Replicas == nil {
+		return 0
+	}
+	return *sts.Spec.Replicas
+}
+
+// checkReplicas returns the number of replicas of the StatefulSet being updated.
+// A StatefulSet without replicas has no pod to update, which more likely than
+// not is a misconfiguration, so an error is returned unless AllowZeroReplicas is
+// set. ok is false when there is no pod to update, in which case the strategy
+// must return without updating anything.
+func checkReplicas(updateSts *UpdateSts, o *strategyOptions, l logr.Logger) (replicas int32, ok bool, err error) {
+	replicas = replicasOf(updateSts.sts)
+	if replicas > 0 {
+		return replicas, true, nil
+	}
+	if !o.allowZeroReplicas {
+		return 0, false, errors.Newf("refusing to update %s ns: %s, it has no replicas", updateSts.name, updateSts.namespace)
+	}
+	l.Info("statefulset has no replicas, no pod to update", logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace)
+	return 0, false, nil
 }
 
 // UpdateTimer encapsulates everything timer and polling related we need to update
@@ -77,6 +258,119 @@ type UpdateTimer struct {
 	healthChecker         healthchecker.HealthChecker
 	// TODO check that this func is actually correct
 	waitUntilAllPodsReadyFunc func(context.Context, logr.Logger) error
+	// initialInterval and multiplier tune the verification backoff. The
+	// backoff library defaults are used when they are zero.
+	initialInterval time.Duration
+	multiplier      float64
+	// regionUpdateTimeout caps the time it takes to update every pod of the
+	// StatefulSet. Zero means no limit.
+	regionUpdateTimeout time.Duration
+	// pollingJitter randomizes the polling intervals by up to this fraction, so
+	// that concurrent updates don't poll in lockstep. The backoff library
+	// default is used when it is zero.
+	pollingJitter float64
+	// progressFunc is optional, when nil no progress is reported.
+	progressFunc ProgressFunc
+	// shutdownGracePeriod is how long the pods being verified when the update
+	// is interrupted are still waited for. Zero stops waiting right away.
+	shutdownGracePeriod time.Duration
+	// skipHealthProbe disables the health probe between pods, it is only meant
+	// for test and development clusters.
+	skipHealthProbe bool
+	// preUpdateHook and postUpdateHook are optional, they run before each pod
+	// is updated and after it has been verified.
+	preUpdateHook  UpdateHook
+	postUpdateHook UpdateHook
+	// clock is used for every wait and deadline of the update, the real clock
+	// when nil.
+	clock Clock
+	// healthProbeTimeout is how long the health probe between pods may take.
+	// When zero, the probe shares the podUpdateTimeout of the pods it follows
+	// with their verification.
+	healthProbeTimeout time.Duration
+	// verificationLogInterval is the minimum interval between two logs of
+	// failed verification attempts of a pod. Zero logs every attempt.
+	verificationLogInterval time.Duration
+}
+
+// UpdateHook is run for a single pod of the StatefulSet during an update, with
+// the partition number of the pod. An error aborts the update.
+type UpdateHook func(ctx context.Context, partition int, l logr.Logger) error
+
+// ProgressFunc is called after every partition of the StatefulSet has been
+// updated, or was found already updated, with the number of pods updated so far
+// out of the total number of pods, and the partition that was just updated.
+type ProgressFunc func(completed, total int, currentPartition int)
+
+// reportProgress calls the progressFunc, if any.
+func (ut *UpdateTimer) reportProgress(completed, total, currentPartition int) {
+	if ut.progressFunc == nil {
+		return
+	}
+	ut.progressFunc(completed, total, currentPartition)
+}
+
+// NewUpdateTimer returns an UpdateTimer that waits up to podUpdateTimeout for
+// each updated pod to be verified, polling it at most every
+// podMaxPollingInterval. An error is returned if the timeout is shorter than
+// the polling interval or if hc or waitFn is nil.
+func NewUpdateTimer(
+	podUpdateTimeout, podMaxPollingInterval time.Duration,
+	hc healthchecker.HealthChecker,
+	waitFn func(context.Context, logr.Logger) error,
+) (*UpdateTimer, error) {
+	ut := &UpdateTimer{
+		podUpdateTimeout:          podUpdateTimeout,
+		podMaxPollingInterval:     podMaxPollingInterval,
+		healthChecker:             hc,
+		waitUntilAllPodsReadyFunc: waitFn,
+	}
+	if err := ut.validate(); err != nil {
+		return nil, err
+	}
+	return ut, nil
+}
+
+func (ut *UpdateTimer) validate() error {
+	if ut.podUpdateTimeout < ut.podMaxPollingInterval {
+		return errors.Newf("pod update timeout %s is less than the polling interval %s",
+			ut.podUpdateTimeout, ut.podMaxPollingInterval)
+	}
+	if ut.healthChecker == nil {
+		return errors.New("health checker is required")
+	}
+	if ut.waitUntilAllPodsReadyFunc == nil {
+		return errors.New("wait for pods func is required")
+	}
+	return nil
+}
+
+// regionDeadline returns the time by which the update of the region must be
+// complete, or the zero time if there is no limit.
+func (ut *UpdateTimer) regionDeadline() time.Time {
+	if ut.regionUpdateTimeout <= 0 {
+		return time.Time{}
+	}
+	return ut.getClock().Now().Add(ut.regionUpdateTimeout)
+}
+
+// newBackOff returns the exponential backoff used to poll an updated pod.
+func (ut *UpdateTimer) newBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.Clock = ut.getClock()
+	b.MaxElapsedTime = ut.podUpdateTimeout
+	b.MaxInterval = ut.podMaxPollingInterval
+	if ut.initialInterval > 0 {
+		b.InitialInterval = ut.initialInterval
+	}
+	if ut.multiplier > 0 {
+		b.Multiplier = ut.multiplier
+	}
+	if ut.pollingJitter > 0 {
+		b.RandomizationFactor = math.Min(ut.pollingJitter, 1)
+	}
+	b.Reset()
+	return b
 }
 
 func NewUpdateFunctionSuite(
@@ -89,13 +383,13 @@ func NewUpdateFunctionSuite(
 	}
 }
 
-// TODO rewrite docs
-// TODO too many parmeters, just found a bug where I reversed namespace and sts name
-// Refactor this into a struct
-
 // UpdateClusterRegionStatefulSet is the regional version of
 // updateClusterStatefulSets. See its documentation for more information on the
-// parameters passed to this function.
+// parameters passed to this function. opts are applied after the options built
+// from the parameters, e.g. WithVerifyRevision.
+//
+// Deprecated: use UpdateRegionStatefulSet, which takes named options instead of
+// positional parameters.
 func UpdateClusterRegionStatefulSet(
 	ctx context.Context,
 	clientset kubernetes.Interface,
@@ -107,36 +401,104 @@ func UpdateClusterRegionStatefulSet(
 	podMaxPollingInterval time.Duration,
 	healthChecker healthchecker.HealthChecker,
 	l logr.Logger,
+	opts ...UpdateOption,
+) (bool, error) {
+	return UpdateRegionStatefulSet(
+		ctx,
+		clientset,
+		updateSuite,
+		l,
+		append([]UpdateOption{
+			WithName(name),
+			WithNamespace(namespace),
+			WithWaitForPodsFunc(waitUntilAllPodsReadyFunc),
+			WithTimeout(podUpdateTimeout),
+			WithPollingInterval(podMaxPollingInterval),
+			WithHealthChecker(healthChecker),
+		}, opts...)...,
+	)
+}
+
+// UpdateRegionStatefulSet applies the updateSuite to the CockroachDB
+// StatefulSet of a single region. The StatefulSet name and namespace, the
+// timeouts, the health checker and the function that waits for all pods to be
+// ready are supplied as options. See updateClusterStatefulSets for more
+// information.
+//
+// Once the update completes, it is recorded in the UpdateHistoryAnnotation of
+// the StatefulSet.
+func UpdateRegionStatefulSet(
+	ctx context.Context,
+	clientset kubernetes.Interface,
+	updateSuite *updateFunctionSuite,
+	l logr.Logger,
+	opts ...UpdateOption,
 ) (bool, error) {
+	o := newUpdateOptions(ctx, clientset, opts...)
+	if err := o.validate(); err != nil {
+		return false, err
+	}
+
+	updateSts, updateTimer := o.updateSts, o.updateTimer
+	name, namespace := updateSts.name, updateSts.namespace
 	l = l.WithName(namespace)
 
-	sts, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	updateSts.metrics.updateStarted()
+	defer updateSts.metrics.updateFinished()
+
+	stsClient, err := updateSts.statefulSets(ctx)
 	if err != nil {
+		updateSts.metrics.updateFailed(failureReasonGetStatefulSet)
+		return false, err
+	}
+	sts, err := stsClient.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		updateSts.metrics.updateFailed(failureReasonGetStatefulSet)
 		return false, handleStsError(err, l, name, namespace)
 	}
 
+	// Capture the pod template and update strategy before updateFunc mutates
+	// them, so we have something to roll back to.
+	before := sts.DeepCopy()
+	updateSts.preUpdateTemplate = before.Spec.Template.DeepCopy()
+	updateSts.preUpdateStrategy = before.Spec.UpdateStrategy.DeepCopy()
+
 	// Run the updateFunc to update the in-memory copy of the Kubernetes
 	// resource.  The new in-memory copy of the Kubernetes resource is not
 	// applied to the cluster by updateFunc, that is handled by the
 	// updateStrategyFunc.
 	sts, err = updateSuite.updateFunc(sts)
 	if err != nil {
+		updateSts.metrics.updateFailed(failureReasonUpdateFunc)
 		return false, errors.Wrapf(err, "error applying updateFunc to %s %s", name, namespace)
 	}
-	updateSts := &UpdateSts{
-		ctx:       ctx,
-		clientset: clientset,
-		sts:       sts,
-		name:      name,
-		namespace: namespace,
+	updateSts.sts = sts
+
+	if diff := DiffStatefulSet(before, sts); diff != "" {
+		l.V(int(zapcore.InfoLevel)).Info("statefulset changed by updateFunc", logKeyStsName, name, logKeyNamespace, namespace, "diff", diff)
 	}
 
-	updateTimer := &UpdateTimer{
-		podUpdateTimeout:          podUpdateTimeout,
-		podMaxPollingInterval:     podMaxPollingInterval,
-		healthChecker:             healthChecker,
-		waitUntilAllPodsReadyFunc: waitUntilAllPodsReadyFunc,
+	// Nothing to roll out when updateFunc left the spec alone, e.g. because the
+	// image is already the target one, and no earlier rollout is unfinished.
+	if !o.rollUnchanged && apiequality.Semantic.DeepEqual(before.Spec, sts.Spec) && !rolloutInProgress(sts) {
+		l.V(int(zapcore.DebugLevel)).Info("statefulset unchanged by updateFunc, no pod to update", logKeyStsName, name, logKeyNamespace, namespace)
+		return true, nil
+	}
+
+	// A dry run doesn't probe the cluster, so the preflight checks don't run
+	// either.
+	if updateSts.dryRun {
+		logDryRun(before, sts, l)
+		return true, nil
+	}
+
+	if o.preflight {
+		if err := Preflight(ctx, updateSts, updateTimer, l); err != nil {
+			updateSts.metrics.updateFailed(failureReasonPreflight)
+			return false, err
+		}
 	}
+
 	// updateStrategyFunc is responsible for controlling the rollout of the
 	// changed StatefulSet definition across the pods in the Statefulset.
 	skipSleep, err := updateSuite.updateStrategyFunc(updateSts, updateTimer, l)
@@ -144,12 +506,79 @@ func UpdateClusterRegionStatefulSet(
 		return false, errors.Wrapf(err, "error applying updateStrategyFunc to %s %s", name, namespace)
 	}
 
+	if updateSts.incomplete {
+		l.Info("update not finished, it resumes on the next invocation", logKeyStsName, name, logKeyNamespace, namespace)
+	} else if !isUpdatePaused(updateSts.sts) {
+		if o.verifyRevision {
+			if err := VerifyRegionAtRevision(ctx, updateSts); err != nil {
+				updateSts.metrics.updateFailed(failureReasonRevision)
+				return skipSleep, err
+			}
+		}
+
+		if err := recordUpdateHistory(updateSts, l); err != nil {
+			return skipSleep, errors.Wrapf(err, "error recording update history of %s %s", name, namespace)
+		}
+	}
+
 	return skipSleep, nil
 }
 
+// rolloutInProgress returns true if some pods of the StatefulSet are still
+// waiting to be updated: its partition is above 0 or the controller reports
+// pods on a revision other than the update revision.
+func rolloutInProgress(sts *v1.StatefulSet) bool {
+	if ru := sts.Spec.UpdateStrategy.RollingUpdate; ru != nil && ru.Partition != nil && *ru.Partition > 0 {
+		return true
+	}
+	return sts.Status.UpdateRevision != "" && sts.Status.CurrentRevision != sts.Status.UpdateRevision
+}
+
+// logDryRun logs the partitions that would be rolled and the changes updateFunc
+// made to the StatefulSet, instead of applying them.
+func logDryRun(before, after *v1.StatefulSet, l logr.Logger) {
+	var partitions []int32
+	for partition := replicasOf(after) - 1; partition >= 0; partition-- {
+		partitions = append(partitions, partition)
+	}
+
+	l.Info("dry run, statefulset not updated",
+		logKeyStsName, after.Name,
+		"partitions", partitions,
+		"diff", cmp.Diff(before.Spec, after.Spec),
+		"spec", after.Spec,
+	)
+}
+
+// DiffStatefulSet returns a unified diff of the YAML of the StatefulSet before
+// and after it was changed, or an empty string when they are the same.
+func DiffStatefulSet(before, after *v1.StatefulSet) string {
+	from, err := yaml.Marshal(before)
+	if err != nil {
+		return fmt.Sprintf("error marshalling statefulset: %s", err)
+	}
+	to, err := yaml.Marshal(after)
+	if err != nil {
+		return fmt.Sprintf("error marshalling statefulset: %s", err)
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(from)),
+		B:        difflib.SplitLines(string(to)),
+		FromFile: "before",
+		ToFile:   "after",
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Sprintf("error diffing statefulset: %s", err)
+	}
+	return diff
+}
+
 // partitionedRollingUpdateStrategy is an update strategy which updates the
 // pods in a statefulset one at a time, and verifies the health of the
-// cluster throughout the update.
+// cluster throughout the update. The update can be paused between pods by
+// setting the PauseUpdateAnnotation on the statefulset.
 //
 // partitionedRollingUpdateStrategy checks that all pods are ready before
 // replacing a pod within a cluster.
@@ -159,109 +588,1022 @@ func UpdateClusterRegionStatefulSet(
 // takes a Kubernetes clientset, the StatefulSet being modified, and the pod
 // number of the Statefulset that has just been updated. If it returns an error,
 // the update is halted.
+//
+// By default pods are updated one at a time. WithMaxConcurrent allows several
+// pods to roll at the same time when the cluster has spare replication
+// capacity, in which case the partition is lowered by that many pods at once
+// and every pod in the batch is verified before moving on.
+//
+// If a PodDisruptionBudget is configured with WithPodDisruptionBudget, the
+// strategy waits until the budget allows a disruption before restarting pods.
+//
+// If the UpdateTimer has a regionUpdateTimeout, the update is abandoned once it
+// has been running for that long and a RegionUpdateTimeoutError is returned.
+//
+// WithPreUpdateHook runs a hook right before each pod is updated, and
+// WithPostUpdateHook once the pod has been verified, before the health probe.
+//
+// When the context of the update is cancelled, for example because it is wired
+// to SIGTERM and the operator pod is being rescheduled, no more pods are
+// updated. The pods being verified are waited for up to the shutdown grace
+// period of the UpdateTimer and an InterruptedError recording the last
+// completed partition is returned, so that the next update can resume from it.
+//
+// Every partition that has been updated, verified and probed is recorded in the
+// LastUpdatedPartitionAnnotation of the StatefulSet. As long as the StatefulSet
+// still has the same pod template, the next invocation starts below that
+// partition instead of from the highest pod. The annotation is removed once
+// every pod has been updated.
+//
+// WithPartitionOrder(Ascending) updates pod 0 first and counts up to the highest
+// pod instead. Kubernetes partitions are inverted for this purpose, setting the
+// partition to N updates every pod numbered N or higher, so an ascending update
+// can't be expressed as a partition. Instead the StatefulSet is switched to the
+// OnDelete update strategy and the pods are deleted in order, letting the
+// controller recreate each of them with the updated spec. The RollingUpdate
+// strategy is restored once every pod has been updated.
+//
+// WithServerSideApply makes the strategy lower the partition with a server-side
+// apply patch instead of an Update, so that it doesn't conflict with concurrent
+// reconciles writing other fields of the StatefulSet.
+//
+// WithMaxPodsPerInvocation makes the strategy return once it has updated that
+// many pods, leaving the rest to the next invocation, which resumes from the
+// checkpoint. The revision of the region isn't verified and the update isn't
+// recorded in the history until the last pod has been updated.
+//
+// WithEviction makes the strategy evict the pods of each batch through the
+// eviction API, so that pod disruption budgets are honored. The StatefulSet is
+// switched to the OnDelete update strategy while the pods are evicted, so that
+// the controller recreates them with the updated spec instead of replacing them
+// itself, and the RollingUpdate strategy is restored once every pod has been
+// updated.
+//
+// WithRollbackOnProbeFailure makes the strategy restore the pod template and
+// partition captured before updateFunc ran when the health probe fails between
+// pods, instead of leaving the StatefulSet partially updated.
 func PartitionedRollingUpdateStrategy(perPodVerificationFunc func(*UpdateSts, int, logr.Logger) error,
+	opts ...StrategyOption,
 ) func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
+	o := newStrategyOptions(opts...)
 	return func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
-		// When a StatefulSet's partition number is set to `n`, only StatefulSet pods
-		// numbered greater or equal to `n` will be updated. The rest will remain untouched.
-		// https://kubernetes.io/docs/concepts/workloads/controllers/statefulset/#partitions
-		skipSleep := false
-		sts := updateSts.sts
-		for partition := *sts.Spec.Replicas - 1; partition >= 0; partition-- {
-			stsName := sts.Name
-			stsNamespace := sts.Namespace
-
-			// If pod already updated, we are probably retrying a failed job
-			// attempt. Best not to redo the update in that case, especially the sleeps!!
-			if err := perPodVerificationFunc(updateSts, int(partition), l); err == nil {
-				l.V(int(zapcore.DebugLevel)).Info("already updated, skipping sleep", "partition", partition)
-				skipSleep = true
-				continue
+		replicas, ok, err := checkReplicas(updateSts, o, l)
+		if !ok {
+			return false, err
+		}
+
+		deadline := updateTimer.regionDeadline()
+		if o.order == Ascending {
+			skipSleep, err := rollBatches(updateSts, updateTimer, perPodVerificationFunc,
+				ascendingBatches(0, replicas-1, o.maxConcurrent), deletePods, deadline, o, l)
+			if err != nil || isUpdatePaused(updateSts.sts) {
+				return skipSleep, err
+			}
+			return skipSleep, restoreRollingUpdate(updateSts, l)
+		}
+
+		// Resume below the last partition that was completed by a previous
+		// invocation.
+		top := replicas - 1
+		if partition, ok := checkpointPartition(updateSts, replicas); ok {
+			l.Info("resuming update from checkpoint", logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace, logKeyPartition, partition)
+			top = partition - 1
+		}
+
+		roll := partitionRoll(o, updateTimer)
+		updateSts.incomplete = false
+		batches := descendingBatches(top, 0, o.maxConcurrent)
+		if o.maxPodsPerInvocation > 0 {
+			batches = limitBatches(batches, o.maxPodsPerInvocation)
+		}
+		co := *o
+		co.checkpoint = true
+		skipSleep, err := rollBatches(updateSts, updateTimer, perPodVerificationFunc,
+			batches, roll, deadline, &co, l)
+		if err != nil || isUpdatePaused(updateSts.sts) {
+			return skipSleep, err
+		}
+		// The checkpoint is kept for the next invocation to resume from.
+		if len(batches) > 0 && batches[len(batches)-1].bottom > 0 {
+			l.Info("updated the maximum number of pods for this invocation", logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace,
+				"maxPodsPerInvocation", o.maxPodsPerInvocation, logKeyPartition, batches[len(batches)-1].bottom)
+			updateSts.incomplete = true
+			return skipSleep, nil
+		}
+		if top < 0 {
+			skipSleep = true
+		}
+		if o.useEviction {
+			if err := restoreRollingUpdate(updateSts, l); err != nil {
+				return skipSleep, err
 			}
+		}
+		return skipSleep, clearCheckpoint(updateSts, l)
+	}
+}
+
+// PartitionedRollingUpdateStrategyForRange is PartitionedRollingUpdateStrategy
+// restricted to the pods numbered from lo to hi, inclusive, for example to only
+// roll a few pods of a region during an emergency. The other pods are left
+// untouched. An error is returned if the range is not within the replicas of
+// the StatefulSet.
+//
+// A partition always covers every pod above it, so partitions are only used
+// when hi is the highest pod and the pods are updated in Descending order.
+// Otherwise the pods of the range are deleted in turn, the way
+// OnDeleteUpdateStrategy does, and the StatefulSet is left with the OnDelete
+// update strategy so that the controller does not replace the other pods.
+func PartitionedRollingUpdateStrategyForRange(lo, hi int,
+	perPodVerificationFunc func(*UpdateSts, int, logr.Logger) error,
+	opts ...StrategyOption,
+) func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
+	o := newStrategyOptions(opts...)
+	return func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
+		n, ok, err := checkReplicas(updateSts, o, l)
+		if !ok {
+			return false, err
+		}
+		replicas := int(n)
+		if lo < 0 || lo > hi || hi >= replicas {
+			return false, errors.Newf("partition range [%d, %d] is not within the %d replicas of %s", lo, hi, replicas, updateSts.name)
+		}
+
+		deadline := updateTimer.regionDeadline()
+		if o.order == Descending && hi == replicas-1 {
+			return rollBatches(updateSts, updateTimer, perPodVerificationFunc,
+				descendingBatches(int32(hi), int32(lo), o.maxConcurrent), setPartition, deadline, o, l)
+		}
+
+		batches := descendingBatches(int32(hi), int32(lo), o.maxConcurrent)
+		if o.order == Ascending {
+			batches = ascendingBatches(int32(lo), int32(hi), o.maxConcurrent)
+		}
+		return rollBatches(updateSts, updateTimer, perPodVerificationFunc, batches, deletePods, deadline, o, l)
+	}
+}
+
+// OnDeleteUpdateStrategy is an update strategy for StatefulSets that use the
+// OnDelete update strategy, where the StatefulSet controller only replaces pods
+// once they are deleted. Instead of setting a partition, each pod is deleted in
+// turn, starting from the highest numbered pod, and the controller recreates it
+// with the updated spec. The perPodVerificationFunc then runs the same way as
+// for PartitionedRollingUpdateStrategy, and the health of the cluster is probed
+// between pods.
+//
+// The same options as PartitionedRollingUpdateStrategy are supported, with
+// WithPartitionOrder(Ascending) deleting pod 0 first. The StatefulSet is left
+// with the OnDelete update strategy.
+func OnDeleteUpdateStrategy(perPodVerificationFunc func(*UpdateSts, int, logr.Logger) error,
+	opts ...StrategyOption,
+) func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
+	o := newStrategyOptions(opts...)
+	return func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
+		replicas, ok, err := checkReplicas(updateSts, o, l)
+		if !ok {
+			return false, err
+		}
+		batches := descendingBatches(replicas-1, 0, o.maxConcurrent)
+		if o.order == Ascending {
+			batches = ascendingBatches(0, replicas-1, o.maxConcurrent)
+		}
+		return rollBatches(updateSts, updateTimer, perPodVerificationFunc,
+			batches, deletePods, updateTimer.regionDeadline(), o, l)
+	}
+}
+
+// CanaryUpdateStrategy is an update strategy which first updates the highest
+// canaryCount pods of a statefulset, then soaks for the given duration while
+// continuously probing the health of the cluster, and only then updates the
+// remaining pods the same way PartitionedRollingUpdateStrategy does.
+//
+// If the health probe fails during the soak, an error is returned and the
+// remaining pods are left untouched so the update is halted. If the canary pods
+// were all already updated, we are probably retrying a failed job attempt and the
+// soak is skipped.
+//
+// The options of PartitionedRollingUpdateStrategy apply to both the canary and
+// the remaining pods, except for WithPartitionOrder(Ascending) and
+// WithMaxPodsPerInvocation, which are rejected: the canaries are the highest
+// pods and the update doesn't resume from a checkpoint.
+func CanaryUpdateStrategy(
+	canaryCount int,
+	soak time.Duration,
+	perPodVerificationFunc func(*UpdateSts, int, logr.Logger) error,
+	opts ...StrategyOption,
+) func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
+	o := newStrategyOptions(opts...)
+	return func(updateSts *UpdateSts, updateTimer *UpdateTimer, l logr.Logger) (bool, error) {
+		if canaryCount < 1 {
+			return false, errors.Newf("canary count must be at least 1, got %d", canaryCount)
+		}
+		if o.order == Ascending {
+			return false, errors.New("canary updates only support the Descending partition order")
+		}
+		if o.maxPodsPerInvocation > 0 {
+			return false, errors.New("canary updates do not support a maximum number of pods per invocation")
+		}
+		replicas, ok, err := checkReplicas(updateSts, o, l)
+		if !ok {
+			return false, err
+		}
+
+		lastCanary := replicas - int32(canaryCount)
+		if lastCanary < 0 {
+			lastCanary = 0
+		}
+
+		roll := partitionRoll(o, updateTimer)
+		deadline := updateTimer.regionDeadline()
+		skipSleep, err := rollBatches(updateSts, updateTimer, perPodVerificationFunc,
+			descendingBatches(replicas-1, lastCanary, o.maxConcurrent), roll, deadline, o, l)
+		if err != nil {
+			return false, errors.Wrapf(err, "error updating canary pods")
+		}
+
+		if !skipSleep {
+			l.V(int(zapcore.DebugLevel)).Info("soaking canary pods", "canaries", replicas-lastCanary, "soak", soak.String())
+			if err := soakCanary(updateSts, updateTimer, soak, int(lastCanary), l); err != nil {
+				return false, err
+			}
+		}
+
+		if lastCanary > 0 {
+			skipSleep, err = rollBatches(updateSts, updateTimer, perPodVerificationFunc,
+				descendingBatches(lastCanary-1, 0, o.maxConcurrent), roll, deadline, o, l)
+			if err != nil {
+				return skipSleep, err
+			}
+		}
+		if o.useEviction && !isUpdatePaused(updateSts.sts) {
+			return skipSleep, restoreRollingUpdate(updateSts, l)
+		}
+		return skipSleep, nil
+	}
+}
+
+// soakCanary runs the health probe repeatedly until the soak duration has
+// elapsed. The probe is run at least once.
+func soakCanary(updateSts *UpdateSts, updateTimer *UpdateTimer, soak time.Duration, partition int, l logr.Logger) error {
+	err := soakAndProbe(updateSts.ctx, updateTimer.getClock(), updateTimer.healthChecker, soak, updateTimer.podMaxPollingInterval,
+		fmt.Sprintf("soaking canary for %s", updateSts.name), partition, l)
+	if err != nil && updateSts.ctx.Err() == nil {
+		return errors.Wrapf(err, "health probe failed while soaking canary pods")
+	}
+	return err
+}
+
+// soakAndProbe runs the health probe every interval until the soak duration has
+// elapsed. The probe is run at least once, and a failed probe ends the soak.
+func soakAndProbe(
+	ctx context.Context,
+	clock Clock,
+	healthChecker healthchecker.HealthChecker,
+	soak, interval time.Duration,
+	logSuffix string,
+	partition int,
+	l logr.Logger,
+) error {
+	deadline := clock.Now().Add(soak)
+	for {
+		if err := healthChecker.Probe(ctx, l, logSuffix, partition); err != nil {
+			return err
+		}
+
+		remaining := deadline.Sub(clock.Now())
+		if remaining <= 0 {
+			return nil
+		}
+
+		wait := interval
+		if wait <= 0 || wait > remaining {
+			wait = remaining
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(wait):
+		}
+	}
+}
+
+// podBatch is a group of pods, numbered from top down to bottom, that are
+// rolled at the same time.
+type podBatch struct {
+	top, bottom int32
+}
+
+// descendingBatches splits the pods numbered from `from` down to `to`
+// (inclusive) into batches of up to size pods, highest pods first.
+func descendingBatches(from, to, size int32) []podBatch {
+	var batches []podBatch
+	for top := from; top >= to; top -= size {
+		bottom := top - size + 1
+		if bottom < to {
+			bottom = to
+		}
+		batches = append(batches, podBatch{top: top, bottom: bottom})
+	}
+	return batches
+}
+
+// limitBatches returns the first batches covering up to n pods, the last one is
+// shrunk if it would go over.
+func limitBatches(batches []podBatch, n int32) []podBatch {
+	var limited []podBatch
+	for _, batch := range batches {
+		if n <= 0 {
+			break
+		}
+		if size := batch.top - batch.bottom + 1; size > n {
+			batch.bottom = batch.top - n + 1
+		}
+		n -= batch.top - batch.bottom + 1
+		limited = append(limited, batch)
+	}
+	return limited
+}
+
+// ascendingBatches splits the pods numbered from `from` up to `to` (inclusive)
+// into batches of up to size pods, lowest pods first.
+func ascendingBatches(from, to, size int32) []podBatch {
+	var batches []podBatch
+	for bottom := from; bottom <= to; bottom += size {
+		top := bottom + size - 1
+		if top > to {
+			top = to
+		}
+		batches = append(batches, podBatch{top: top, bottom: bottom})
+	}
+	return batches
+}
+
+// rollBatchFunc makes the StatefulSet controller replace the pods of a batch
+// with pods running the updated spec.
+type rollBatchFunc func(updateSts *UpdateSts, sts *v1.StatefulSet, batch podBatch, l logr.Logger) error
+
+// setPartition lowers the partition of the StatefulSet to the bottom of the
+// batch. When a StatefulSet's partition number is set to `n`, only StatefulSet
+// pods numbered greater or equal to `n` will be updated. The rest will remain
+// untouched.
+// https://kubernetes.io/docs/concepts/workloads/controllers/statefulset/#partitions
+func setPartition(updateSts *UpdateSts, sts *v1.StatefulSet, batch podBatch, l logr.Logger) error {
+	partition := batch.bottom
+	return updateStatefulSet(updateSts, sts, func(sts *v1.StatefulSet) {
+		sts.Spec.UpdateStrategy.RollingUpdate = &v1.RollingUpdateStatefulSetStrategy{
+			Partition: &partition,
+		}
+	}, l)
+}
+
+// applyPartition returns a roll function that lowers the partition of the
+// StatefulSet to the bottom of the batch, like setPartition, using server-side
+// apply with fieldManager. The apply patch only carries the update strategy, so
+// it can't conflict with concurrent changes to other fields and doesn't need to
+// be retried. It is forced, taking the partition over from any other manager.
+func applyPartition(fieldManager string) func(*UpdateSts, *v1.StatefulSet, podBatch, logr.Logger) error {
+	return func(updateSts *UpdateSts, sts *v1.StatefulSet, batch podBatch, l logr.Logger) error {
+		patch, err := json.Marshal(map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "StatefulSet",
+			"metadata": map[string]interface{}{
+				"name":      sts.Name,
+				"namespace": sts.Namespace,
+			},
+			"spec": map[string]interface{}{
+				"updateStrategy": map[string]interface{}{
+					"type": v1.RollingUpdateStatefulSetStrategyType,
+					"rollingUpdate": map[string]interface{}{
+						"partition": batch.bottom,
+					},
+				},
+			},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "error building apply patch for sts %s", sts.Name)
+		}
+
+		stsClient, err := updateSts.statefulSets(updateSts.ctx)
+		if err != nil {
+			return err
+		}
+		force := true
+		_, err = stsClient.Patch(updateSts.ctx, sts.Name, types.ApplyPatchType, patch, metav1.PatchOptions{
+			FieldManager: fieldManager,
+			Force:        &force,
+		})
+		if err != nil {
+			return handleStsError(err, l, sts.Name, sts.Namespace)
+		}
+		return nil
+	}
+}
+
+// deletePods switches the StatefulSet to the OnDelete update strategy, so that
+// the controller stops replacing pods on its own, and deletes the pods of the
+// batch. The controller then recreates them with the updated spec. This is how
+// pods are rolled by the OnDeleteUpdateStrategy, and in Ascending order, since
+// a partition can only ever cover the highest pods of a StatefulSet.
+func deletePods(updateSts *UpdateSts, sts *v1.StatefulSet, batch podBatch, l logr.Logger) error {
+	if err := setOnDelete(updateSts, sts, l); err != nil {
+		return err
+	}
+
+	for podNumber := batch.bottom; podNumber <= batch.top; podNumber++ {
+		podName := PodName(sts, int(podNumber))
+		l.V(int(zapcore.DebugLevel)).Info("deleting pod", "podName", podName)
+		err := updateSts.clientset.CoreV1().Pods(sts.Namespace).Delete(updateSts.ctx, podName, metav1.DeleteOptions{})
+		if err != nil && !k8sErrors.IsNotFound(err) {
+			return errors.Wrapf(err, "error deleting pod %s", podName)
+		}
+	}
+	return nil
+}
+
+// setOnDelete switches the StatefulSet to the OnDelete update strategy.
+func setOnDelete(updateSts *UpdateSts, sts *v1.StatefulSet, l logr.Logger) error {
+	return updateStatefulSet(updateSts, sts, func(sts *v1.StatefulSet) {
+		sts.Spec.UpdateStrategy = v1.StatefulSetUpdateStrategy{
+			Type: v1.OnDeleteStatefulSetStrategyType,
+		}
+	}, l)
+}
 
-			skipSleep = false
-			// TODO we are only using this func here.  Why are we passing it around?
-			if err := updateTimer.waitUntilAllPodsReadyFunc(updateSts.ctx, l); err != nil {
-				return false, errors.Wrapf(err, "error while waiting for all pods to be ready")
+// partitionRoll returns the roll function that lowers the partition the way the
+// options ask for, or evicts the pods with WithEviction.
+func partitionRoll(o *strategyOptions, updateTimer *UpdateTimer) rollBatchFunc {
+	if o.useEviction {
+		return evictPods(updateTimer)
+	}
+	if o.fieldManager != "" {
+		return applyPartition(o.fieldManager)
+	}
+	return setPartition
+}
+
+// evictPods returns a roll function that rolls the batch the way deletePods
+// does, but evicts the pods through the eviction subresource instead of
+// deleting them, so that pod disruption budgets are honored. The partition is
+// never lowered: the StatefulSet controller would delete the evicted pods a
+// second time, without regard for the budgets, if it recreated them on the old
+// revision. With the OnDelete update strategy it recreates them on the update
+// revision instead, and never deletes pods itself.
+func evictPods(updateTimer *UpdateTimer) rollBatchFunc {
+	return func(updateSts *UpdateSts, sts *v1.StatefulSet, batch podBatch, l logr.Logger) error {
+		if err := setOnDelete(updateSts, sts, l); err != nil {
+			return err
+		}
+		for podNumber := batch.top; podNumber >= batch.bottom; podNumber-- {
+			if err := evictPod(updateSts, updateTimer, sts, int(podNumber), l); err != nil {
+				return err
 			}
-			sts.Spec.UpdateStrategy.RollingUpdate = &v1.RollingUpdateStatefulSetStrategy{
+		}
+		return nil
+	}
+}
+
+// evictPod evicts the pod, retrying for up to podUpdateTimeout while the pod
+// disruption budget doesn't allow it. A pod that is already gone is skipped.
+func evictPod(updateSts *UpdateSts, updateTimer *UpdateTimer, sts *v1.StatefulSet, podNumber int, l logr.Logger) error {
+	podName := PodName(sts, podNumber)
+	l.V(int(zapcore.DebugLevel)).Info("evicting pod", "podName", podName)
+	evict := func() error {
+		err := updateSts.clientset.PolicyV1beta1().Evictions(sts.Namespace).Evict(updateSts.ctx, &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{Name: podName, Namespace: sts.Namespace},
+		})
+		switch {
+		case err == nil, k8sErrors.IsNotFound(err):
+			return nil
+		case k8sErrors.IsTooManyRequests(err):
+			return err
+		}
+		return backoff.Permanent(errors.Wrapf(err, "error evicting pod %s", podName))
+	}
+	notify := func(err error, next time.Duration) {
+		l.V(int(zapcore.DebugLevel)).Info("pod disruption budget does not allow evicting pod yet", "podName", podName, "nextAttemptIn", next.String())
+	}
+
+	err := retryNotify(updateSts.ctx, updateTimer.getClock(), updateTimer.newBackOff(), evict, notify)
+	if k8sErrors.IsTooManyRequests(err) {
+		return errors.Wrapf(err, "pod disruption budget did not allow evicting pod %s within %s", podName, updateTimer.podUpdateTimeout)
+	}
+	return err
+}
+
+// restoreRollingUpdate switches a StatefulSet that was updated in Ascending
+// order back to the RollingUpdate strategy. Every pod is updated at that point,
+// so the partition is set to 0 like at the end of a Descending update.
+func restoreRollingUpdate(updateSts *UpdateSts, l logr.Logger) error {
+	var partition int32
+	return updateStatefulSet(updateSts, updateSts.sts, func(sts *v1.StatefulSet) {
+		sts.Spec.UpdateStrategy = v1.StatefulSetUpdateStrategy{
+			Type: v1.RollingUpdateStatefulSetStrategyType,
+			RollingUpdate: &v1.RollingUpdateStatefulSetStrategy{
 				Partition: &partition,
+			},
+		}
+	}, l)
+}
+
+// updateStatefulSet applies mutate to sts and writes it. If the write conflicts
+// with another change, mutate is applied to a fresh copy of the StatefulSet
+// until the write succeeds or the retries are exhausted.
+func updateStatefulSet(updateSts *UpdateSts, sts *v1.StatefulSet, mutate func(*v1.StatefulSet), l logr.Logger) error {
+	stsName := sts.Name
+	stsNamespace := sts.Namespace
+
+	mutate(sts)
+	stsClient, err := updateSts.statefulSets(updateSts.ctx)
+	if err != nil {
+		return err
+	}
+	_, err = stsClient.Update(updateSts.ctx, sts, metav1.UpdateOptions{})
+	if err != nil && k8sErrors.IsConflict(err) {
+		// we have a conflict on the update so we need to retry updating the sts
+		err := updateSts.retryOnConflict(func() error {
+			stsClient, err := updateSts.statefulSets(updateSts.ctx)
+			if err != nil {
+				return err
+			}
+			sts, err := stsClient.Get(updateSts.ctx, stsName, metav1.GetOptions{})
+			if err != nil {
+				return err
 			}
 
-			_, err := updateSts.clientset.AppsV1().StatefulSets(stsNamespace).Update(updateSts.ctx, sts, metav1.UpdateOptions{})
-			if err != nil && k8sErrors.IsConflict(err) {
-				// we have a conflict on the update so we need to retry updating the sts
-				err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-					sts, err := updateSts.clientset.AppsV1().StatefulSets(stsNamespace).Get(updateSts.ctx, sts.Name, metav1.GetOptions{})
-					if err != nil {
-						return err
-					}
+			mutate(sts)
+			if stsClient, err = updateSts.statefulSets(updateSts.ctx); err != nil {
+				return err
+			}
+			_, err = stsClient.Update(updateSts.ctx, sts, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			// May be conflict if max retries were hit, or may be something unrelated
+			// like permissions or a network error
+			return handleStsError(err, l, stsName, stsNamespace)
+		}
+	} else if err != nil {
+		return handleStsError(err, l, stsName, stsNamespace)
+	}
+	return nil
+}
+
+// rollBatches updates the pods of the statefulset one batch at a time, in the
+// order of batches, using roll to replace the pods of each batch. It returns
+// true if the last batch was already updated and the caller can skip sleeping.
+// If deadline is not zero and is exceeded, a RegionUpdateTimeoutError is
+// returned.
+func rollBatches(
+	updateSts *UpdateSts,
+	updateTimer *UpdateTimer,
+	perPodVerificationFunc func(*UpdateSts, int, logr.Logger) error,
+	batches []podBatch,
+	roll rollBatchFunc,
+	deadline time.Time,
+	opts *strategyOptions,
+	l logr.Logger,
+) (bool, error) {
+	// The pods being verified when the update is interrupted get a grace
+	// period to finish. Waiting for a pod to be verified must stop at the
+	// deadline as well.
+	verifyCtx, cancel := withGracePeriod(updateSts.ctx, updateTimer.shutdownGracePeriod)
+	defer cancel()
+	if !deadline.IsZero() {
+		verifyCtx, cancel = withClockTimeout(verifyCtx, updateTimer.getClock(), deadline.Sub(updateTimer.getClock().Now()))
+		defer cancel()
+	}
+	if updateTimer.skipHealthProbe {
+		l.V(int(zapcore.WarnLevel)).Info("health probe is disabled, the health of the cluster is not checked between pods, do not use this in production",
+			logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace)
+	}
+	completed := 0
+	lastCompleted := -1
+	timedOut := func() error {
+		l.Info("region update timed out", logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace, "completed", completed)
+		return RegionUpdateTimeoutError{
+			StatefulSet:         updateSts.name,
+			Timeout:             updateTimer.regionUpdateTimeout,
+			CompletedPartitions: completed,
+		}
+	}
+	interrupted := func() error {
+		l.Info("update interrupted", logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace, "lastCompletedPartition", lastCompleted)
+		return InterruptedError{
+			StatefulSet:            updateSts.name,
+			LastCompletedPartition: lastCompleted,
+			Err:                    updateSts.ctx.Err(),
+		}
+	}
+
+	// verifyAndProbe verifies the pods of a batch once it has been rolled, then
+	// probes the health of the cluster. The contexts it creates for the batch
+	// are released when it returns rather than when rollBatches does.
+	verifyAndProbe := func(sts *v1.StatefulSet, batch podBatch, rolledAt, start time.Time) error {
+		stsName := sts.Name
+		stsNamespace := sts.Namespace
 
-					sts.Spec.UpdateStrategy.RollingUpdate = &v1.RollingUpdateStatefulSetStrategy{
-						Partition: &partition,
+		// Verifying the batch and probing the health of the cluster afterwards
+		// share a budget of podUpdateTimeout, so that a slow probe counts
+		// against it as well.
+		podCtx, cancelPod := withBudget(verifyCtx, updateTimer.getClock(), updateTimer.podUpdateTimeout)
+		defer cancelPod()
+		probeCtx, cancelProbe := withBudget(updateSts.ctx, updateTimer.getClock(), updateTimer.podUpdateTimeout)
+		defer cancelProbe()
+
+		// Wait until verificationFunction verifies the update of every pod in
+		// the batch, passing in the pod number so the function knows which pod
+		// to check the status of. The function is given the verification
+		// context so that it keeps working during the shutdown grace period.
+		verifySts := *updateSts
+		verifySts.ctx = podCtx
+		verifySts.sts = sts
+		verifySts.rolledAt = rolledAt
+		for podNumber := batch.top; podNumber >= batch.bottom; podNumber-- {
+			l.V(int(zapcore.DebugLevel)).Info("waiting until partition done updating", logKeyPartition, podNumber, "podName", PodName(sts, int(podNumber)))
+			if err := waitUntilPerPodVerificationFuncVerifies(podCtx, &verifySts, perPodVerificationFunc, int(podNumber), updateTimer, l); err != nil {
+				if verifyCtx.Err() == context.DeadlineExceeded && updateSts.ctx.Err() == nil {
+					return timedOut()
+				}
+				if updateSts.ctx.Err() != nil {
+					return interrupted()
+				}
+				updateSts.metrics.updateFailed(failureReasonVerification)
+				err = errors.Wrapf(err, "error while running verificationFunc on pod %d", int(podNumber))
+				if opts.maxConsecutiveFailures > 0 {
+					paused, pauseErr := recordVerificationFailure(updateSts, opts.maxConsecutiveFailures, l)
+					if pauseErr != nil {
+						return errors.WithSecondaryError(err, pauseErr)
 					}
-					_, err = updateSts.clientset.AppsV1().StatefulSets(stsNamespace).Update(updateSts.ctx, sts, metav1.UpdateOptions{})
-					return err
-				})
-				if err != nil {
-					// May be conflict if max retries were hit, or may be something unrelated
-					// like permissions or a network error
-					return false, handleStsError(err, l, stsName, stsNamespace)
+					if paused {
+						updateSts.warningEvent(UpdateAutoPausedReason, "Update of %s paused after %d consecutive verification failures", stsName, opts.maxConsecutiveFailures)
+						return errors.Mark(err, ErrAutoPaused)
+					}
+				}
+				return err
+			}
+			if updateTimer.postUpdateHook != nil {
+				if err := updateTimer.postUpdateHook(podCtx, int(podNumber), l); err != nil {
+					updateSts.metrics.updateFailed(failureReasonPostUpdateHook)
+					return errors.Wrapf(err, "error while running the post-update hook on pod %d", int(podNumber))
 				}
-			} else if err != nil {
-				return false, handleStsError(err, l, stsName, stsNamespace)
 			}
+			updateSts.normalEvent(PodUpdateCompletedReason, "Pod %d of %s updated", podNumber, stsName)
+			completed++
+		}
+		if opts.maxConsecutiveFailures > 0 {
+			if err := resetVerificationFailures(updateSts, sts.DeepCopy(), l); err != nil {
+				return err
+			}
+		}
+		lastCompleted = batchPartition(batch, opts.order)
+		updateSts.metrics.observePodUpdate(stsNamespace, updateTimer.getClock().Now().Sub(start))
 
-			// Wait until verificationFunction verifies the update, passing in
-			// the current partition so the function knows which pod to check
-			// the status of.
-			l.V(int(zapcore.DebugLevel)).Info("waiting until partition done updating", "partition number:", partition)
-			if err := waitUntilPerPodVerificationFuncVerifies(updateSts, perPodVerificationFunc, int(partition), updateTimer, l); err != nil {
-				return false, errors.Wrapf(err, "error while running verificationFunc on pod %d", int(partition))
+		// The batch is verified, don't probe the cluster or update more pods
+		// when the update was interrupted meanwhile.
+		if updateSts.ctx.Err() != nil {
+			return interrupted()
+		}
+
+		// A healthProbeTimeout gives the probe a budget of its own instead.
+		if updateTimer.healthProbeTimeout > 0 {
+			probeCtx, cancelProbe = withBudget(updateSts.ctx, updateTimer.getClock(), updateTimer.healthProbeTimeout)
+			defer cancelProbe()
+		}
+		if updateTimer.skipHealthProbe {
+			l.V(int(zapcore.DebugLevel)).Info("skipping health probe", logKeyPartition, batch.bottom)
+		} else if err := probe(probeCtx, updateTimer.healthChecker, l, fmt.Sprintf("between updating pods for %s", stsName), int(batch.bottom)); err != nil {
+			if updateSts.ctx.Err() != nil {
+				return interrupted()
+			}
+			if probeCtx.Err() == context.DeadlineExceeded {
+				if updateTimer.healthProbeTimeout > 0 {
+					err = errors.Wrapf(err, "health probe timed out after %s on partition %d", updateTimer.healthProbeTimeout, batch.bottom)
+				} else {
+					err = errors.Wrapf(err, "health probe exceeded the update budget of %s of partition %d", updateTimer.podUpdateTimeout, batch.bottom)
+				}
+			}
+			updateSts.warningEvent(HealthProbeFailedReason, "Health probe failed after updating partition %d of %s: %v", batch.bottom, stsName, err)
+			updateSts.metrics.updateFailed(failureReasonHealthProbe)
+			if opts.rollbackOnProbeFailure {
+				return rollback(updateSts, err, l)
 			}
+			return err
+		}
+		return nil
+	}
 
-			// Must refresh STS object, or the next time through the loop
-			// Kubernetes will error out because the object has been updated
-			// since we last read it.
-			sts, err = updateSts.clientset.AppsV1().StatefulSets(stsNamespace).Get(updateSts.ctx, stsName, metav1.GetOptions{})
-			if err != nil {
-				return false, handleStsError(err, l, stsName, stsNamespace)
+	skipSleep := false
+	sts := updateSts.sts
+	// Pod revisions can only be trusted once the desired pod template has been
+	// applied to the cluster, otherwise the update revision is the previous one.
+	templateApplied := updateSts.preUpdateTemplate != nil &&
+		apiequality.Semantic.DeepEqual(*updateSts.preUpdateTemplate, sts.Spec.Template)
+	for _, batch := range batches {
+		// Stop promptly if the update has been cancelled, for example because
+		// the cluster was deleted or the operator is shutting down in the
+		// middle of the update.
+		if updateSts.ctx.Err() != nil {
+			return false, interrupted()
+		}
+		if !deadline.IsZero() && updateTimer.getClock().Now().After(deadline) {
+			return false, timedOut()
+		}
+
+		stsName := sts.Name
+		stsNamespace := sts.Namespace
+
+		// The update has been frozen, the next reconcile will pick it up again
+		// once the annotation is removed.
+		if isUpdatePaused(sts) {
+			l.Info("update paused, not updating any more pods", logKeyStsName, stsName, logKeyNamespace, stsNamespace, logKeyPartition, batch.top)
+			return true, nil
+		}
+
+		// If pods already updated, we are probably retrying a failed job
+		// attempt. Best not to redo the update in that case, especially the sleeps!!
+		if batchAlreadyUpdated(updateSts, sts, templateApplied, perPodVerificationFunc, batch.top, batch.bottom, l) {
+			l.V(int(zapcore.DebugLevel)).Info("already updated, skipping sleep", logKeyPartition, batch.bottom)
+			updateSts.normalEvent(PartitionAlreadyUpdatedReason, "Partition %d of %s already updated", batchPartition(batch, opts.order), stsName)
+			skipSleep = true
+			completed += int(batch.top-batch.bottom) + 1
+			lastCompleted = batchPartition(batch, opts.order)
+			updateTimer.reportProgress(batchProgress(sts, batch, opts.order))
+			continue
+		}
+
+		skipSleep = false
+		// TODO we are only using this func here.  Why are we passing it around?
+		if err := updateTimer.waitUntilAllPodsReadyFunc(updateSts.ctx, l); err != nil {
+			updateSts.metrics.updateFailed(failureReasonWaitForPods)
+			return false, errors.Wrapf(err, "error while waiting for all pods to be ready")
+		}
+		if err := waitUntilDisruptionAllowed(updateSts, updateTimer, sts, l); err != nil {
+			updateSts.metrics.updateFailed(failureReasonDisruptionBudget)
+			return false, errors.Wrapf(err, "error while waiting for the pod disruption budget")
+		}
+		start := updateTimer.getClock().Now()
+		if batch.bottom == batch.top {
+			updateSts.normalEvent(PodUpdateStartedReason, "Updating pod %d of %s", batch.bottom, stsName)
+		} else {
+			updateSts.normalEvent(PodUpdateStartedReason, "Updating pods %d to %d of %s", batch.bottom, batch.top, stsName)
+		}
+
+		if updateTimer.preUpdateHook != nil {
+			for podNumber := batch.top; podNumber >= batch.bottom; podNumber-- {
+				if err := updateTimer.preUpdateHook(updateSts.ctx, int(podNumber), l); err != nil {
+					updateSts.metrics.updateFailed(failureReasonPreUpdateHook)
+					return false, errors.Wrapf(err, "error while running the pre-update hook on pod %d", int(podNumber))
+				}
 			}
-			if err := updateTimer.healthChecker.Probe(updateSts.ctx, l, fmt.Sprintf("between updating pods for %s", stsName), int(partition)); err != nil {
-				return skipSleep, err
+		}
+		rolledAt := updateTimer.getClock().Now()
+		if err := roll(updateSts, sts, batch, l); err != nil {
+			updateSts.metrics.updateFailed(failureReasonUpdateStatefulSet)
+			return false, err
+		}
+		templateApplied = true
+
+		if err := verifyAndProbe(sts, batch, rolledAt, start); err != nil {
+			return false, err
+		}
+		updateTimer.reportProgress(batchProgress(sts, batch, opts.order))
+		if updateSts.ctx.Err() != nil {
+			return false, interrupted()
+		}
+		if opts.checkpoint {
+			if err := recordCheckpoint(updateSts, batch.bottom, l); err != nil {
+				return false, err
 			}
 		}
-		return skipSleep, nil
+
+		// Must refresh STS object, or the next time through the loop
+		// Kubernetes will error out because the object has been updated
+		// since we last read it. Refreshing after the probe also picks up a
+		// pause annotation that was set while the pod was being updated.
+		stsClient, err := updateSts.statefulSets(updateSts.ctx)
+		if err != nil {
+			return false, err
+		}
+		sts, err = stsClient.Get(updateSts.ctx, stsName, metav1.GetOptions{})
+		if err != nil {
+			return false, handleStsError(err, l, stsName, stsNamespace)
+		}
+		updateSts.sts = sts
+	}
+	return skipSleep, nil
+}
+
+// probe probes the health of the cluster with hc. It returns the error of ctx
+// as soon as ctx is done, even if hc doesn't return, so that a hung health
+// checker can't stall the update.
+func probe(ctx context.Context, hc healthchecker.HealthChecker, l logr.Logger, logSuffix string, partition int) error {
+	done := make(chan error, 1)
+	go func() { done <- hc.Probe(ctx, l, logSuffix, partition) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withBudget returns a context that is done once the budget has elapsed on
+// clock, unless it is zero, or when parent is done.
+func withBudget(parent context.Context, clock Clock, budget time.Duration) (context.Context, context.CancelFunc) {
+	if budget <= 0 {
+		return context.WithCancel(parent)
 	}
+	return withClockTimeout(parent, clock, budget)
 }
 
+// batchProgress returns the number of pods that are updated once batch is,
+// the total number of pods and the partition of the batch.
+func batchProgress(sts *v1.StatefulSet, batch podBatch, order PartitionOrder) (int, int, int) {
+	total := int(replicasOf(sts))
+	if order == Ascending {
+		return int(batch.top) + 1, total, int(batch.bottom)
+	}
+	return total - int(batch.bottom), total, int(batch.bottom)
+}
+
+// batchPartition returns the partition a StatefulSet is at once batch is
+// updated: the lowest pod of the batch in Descending order, the highest one in
+// Ascending order.
+func batchPartition(batch podBatch, order PartitionOrder) int {
+	if order == Ascending {
+		return int(batch.top)
+	}
+	return int(batch.bottom)
+}
+
+// rollback restores the pod template and update strategy that the StatefulSet
+// had before updateFunc ran. The returned error wraps cause and is marked with
+// ErrRolledBack when the rollback succeeded.
+func rollback(updateSts *UpdateSts, cause error, l logr.Logger) error {
+	if updateSts.preUpdateTemplate == nil || updateSts.preUpdateStrategy == nil {
+		return errors.Wrapf(cause, "unable to roll back %s, pre-update state was not captured", updateSts.name)
+	}
+
+	l.Info("rolling back statefulset", logKeyStsName, updateSts.name, logKeyNamespace, updateSts.namespace)
+	err := updateSts.retryOnConflict(func() error {
+		stsClient, err := updateSts.statefulSets(updateSts.ctx)
+		if err != nil {
+			return err
+		}
+		sts, err := stsClient.Get(updateSts.ctx, updateSts.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		sts.Spec.Template = *updateSts.preUpdateTemplate.DeepCopy()
+		sts.Spec.UpdateStrategy = *updateSts.preUpdateStrategy.DeepCopy()
+		if stsClient, err = updateSts.statefulSets(updateSts.ctx); err != nil {
+			return err
+		}
+		_, err = stsClient.Update(updateSts.ctx, sts, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.WithSecondaryError(
+			errors.Wrapf(cause, "rolling back %s failed", updateSts.name),
+			handleStsError(err, l, updateSts.name, updateSts.namespace),
+		)
+	}
+
+	return errors.Mark(errors.Wrapf(cause, "rolled back %s", updateSts.name), ErrRolledBack)
+}
+
+// isUpdatePaused returns true if the PauseUpdateAnnotation is set on the
+// StatefulSet.
+func isUpdatePaused(sts *v1.StatefulSet) bool {
+	return sts.Annotations[PauseUpdateAnnotation] == "true"
+}
+
+// batchAlreadyUpdated returns true if every pod numbered from top down to
+// bottom is already updated. When the desired template has been applied, the
+// controller-revision-hash of each pod is authoritative. Otherwise, or if the
+// revision of a pod can't be determined, perPodVerificationFunc decides.
+func batchAlreadyUpdated(
+	updateSts *UpdateSts,
+	sts *v1.StatefulSet,
+	templateApplied bool,
+	perPodVerificationFunc func(*UpdateSts, int, logr.Logger) error,
+	top, bottom int32,
+	l logr.Logger,
+) bool {
+	for podNumber := top; podNumber >= bottom; podNumber-- {
+		if templateApplied && sts.Status.UpdateRevision != "" {
+			updated, err := isPodOnUpdateRevision(updateSts, sts, int(podNumber))
+			if err == nil {
+				if !updated {
+					return false
+				}
+				continue
+			}
+			l.V(int(zapcore.DebugLevel)).Info("unable to check pod revision, running verificationFunc", logKeyPartition, podNumber, "error", err.Error())
+		}
+
+		if err := perPodVerificationFunc(updateSts, int(podNumber), l); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isPodOnUpdateRevision returns true if the controller-revision-hash label of
+// the pod matches the update revision of the StatefulSet.
+func isPodOnUpdateRevision(updateSts *UpdateSts, sts *v1.StatefulSet, podNumber int) (bool, error) {
+	podName := PodName(sts, podNumber)
+	pod, err := updateSts.clientset.CoreV1().Pods(sts.Namespace).Get(updateSts.ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return false, errors.Wrapf(err, "getting pod %s", podName)
+	}
+
+	revision, ok := pod.Labels[v1.ControllerRevisionHashLabelKey]
+	if !ok {
+		return false, errors.Newf("pod %s has no %s label", podName, v1.ControllerRevisionHashLabelKey)
+	}
+	return revision == sts.Status.UpdateRevision, nil
+}
+
+// waitUntilPerPodVerificationFuncVerifies retries perPodVerificationFunc with an
+// exponential backoff until it succeeds, the podUpdateTimeout elapses or ctx is
+// cancelled. It gives up immediately on a permanent error, see ErrPodFailed.
 func waitUntilPerPodVerificationFuncVerifies(
+	ctx context.Context,
 	updateSts *UpdateSts,
 	perPodVerificationFunc func(*UpdateSts, int, logr.Logger) error,
 	podNumber int,
 	updateTimer *UpdateTimer,
 	l logr.Logger,
 ) error {
+	clock := updateTimer.getClock()
+	attempt := 0
 	f := func() error {
+		attempt++
 		err := perPodVerificationFunc(updateSts, podNumber, l)
+		// Retrying won't help a pod that failed for good, give up right away
+		// instead of waiting out podUpdateTimeout.
+		if errors.Is(err, ErrPodFailed) {
+			return backoff.Permanent(err)
+		}
 		return err
 	}
-	b := backoff.NewExponentialBackOff()
-	b.MaxElapsedTime = updateTimer.podUpdateTimeout
-	b.MaxInterval = updateTimer.podMaxPollingInterval
-	return backoff.Retry(f, b)
-}
+	// Log the failed attempts, otherwise a stuck update retries silently, but
+	// at most once per verificationLogInterval so that a long wait doesn't
+	// flood the logs.
+	start := clock.Now()
+	var lastLogged time.Time
+	loggedAttempt, skipped := 0, false
+	notify := func(err error, next time.Duration) {
+		now := clock.Now()
+		if loggedAttempt > 0 && now.Sub(lastLogged) < updateTimer.verificationLogInterval {
+			skipped = true
+			return
+		}
+		lastLogged, loggedAttempt = now, attempt
+		l.V(int(zapcore.DebugLevel)).Info("verification attempt failed", logKeyPartition, podNumber, "attempt", attempt,
+			"elapsed", now.Sub(start).String(), "nextAttemptIn", next.String(), "error", err.Error())
+	}
+	err := retryNotify(ctx, clock, updateTimer.newBackOff(), f, notify)
 
-// TODO there are ALOT more reason codes in k8sErrors, should we test them all?
+	// The last attempt is always logged when some attempts were not.
+	if skipped && loggedAttempt != attempt {
+		elapsed := clock.Now().Sub(start).String()
+		if err != nil {
+			l.V(int(zapcore.DebugLevel)).Info("verification attempt failed", logKeyPartition, podNumber, "attempt", attempt,
+				"elapsed", elapsed, "error", err.Error())
+		} else {
+			l.V(int(zapcore.DebugLevel)).Info("verification attempt succeeded", logKeyPartition, podNumber, "attempt", attempt,
+				"elapsed", elapsed)
+		}
+	}
+	return err
+}
 
+// handleStsError logs and classifies an error returned by the Kubernetes API
+// while reading or writing a StatefulSet. Transient errors are wrapped in a
+// RetryableError and errors that retrying won't fix are wrapped in a FatalError.
+// Conflicts are only returned once RetryOnConflict has given up, they are marked
+// with ErrConflictRetriesExhausted.
 func handleStsError(err error, l logr.Logger, stsName string, ns string) error {
 	if k8sErrors.IsNotFound(err) {
-		l.Error(err, "sts is not found", "stsName", stsName, "namespace", ns)
+		l.Error(err, "sts is not found", logKeyStsName, stsName, logKeyNamespace, ns)
 		return errors.Wrapf(err, "sts is not found: %s ns: %s", stsName, ns)
+	} else if k8sErrors.IsServerTimeout(err) || k8sErrors.IsTooManyRequests(err) || k8sErrors.IsInternalError(err) {
+		l.Error(err, "transient error accessing statefulset", logKeyStsName, stsName, logKeyNamespace, ns)
+		return RetryableError{Err: err}
+	} else if k8sErrors.IsForbidden(err) || k8sErrors.IsUnauthorized(err) {
+		l.Error(err, "not allowed to access statefulset", logKeyStsName, stsName, logKeyNamespace, ns)
+		return FatalError{Err: err}
+	} else if k8sErrors.IsConflict(err) {
+		l.Error(err, "conflict retries exhausted updating statefulset", logKeyStsName, stsName, logKeyNamespace, ns)
+		return errors.Mark(errors.Wrapf(err, "sts kept conflicting: %s ns: %s", stsName, ns), ErrConflictRetriesExhausted)
 	} else if statusError, isStatus := err.(*k8sErrors.StatusError); isStatus {
-		l.Error(statusError, fmt.Sprintf("Error getting statefulset %v", statusError.ErrStatus.Message), "stsName", stsName, "namespace", ns)
+		l.Error(statusError, fmt.Sprintf("Error getting statefulset %v", statusError.ErrStatus.Message), logKeyStsName, stsName, logKeyNamespace, ns)
 		return statusError
 	}
-	l.Error(err, "error getting statefulset", "stsName", stsName, "namspace", ns)
+	l.Error(err, "error getting statefulset", logKeyStsName, stsName, logKeyNamespace, ns)
 	return err
 }
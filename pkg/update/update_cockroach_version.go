@@ -27,7 +27,6 @@ import (
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/cenkalti/backoff"
-	"github.com/cockroachdb/cockroach-operator/pkg/clustersql"
 	"github.com/cockroachdb/cockroach-operator/pkg/healthchecker"
 	"github.com/cockroachdb/errors"
 	"github.com/go-logr/logr"
@@ -65,6 +64,11 @@ type UpdateCluster struct {
 	PodUpdateTimeout      time.Duration
 	PodMaxPollingInterval time.Duration
 	HealthChecker         healthchecker.HealthChecker
+	// Metrics is optional, when nil no update metrics are recorded.
+	Metrics *Metrics
+	// ExcludeDecommissioned does not wait for the pods of decommissioning
+	// nodes to be ready before updating a pod.
+	ExcludeDecommissioned bool
 }
 
 // UpdateClusterCockroachVersion, and allows specifying custom pod timeouts,
@@ -94,7 +98,7 @@ func UpdateClusterCockroachVersion(
 
 	l.V(int(zapcore.InfoLevel)).Info("starting upgrade")
 
-	if isForwardOneMajorVersion(update.WantVersion, update.CurrentVersion) {
+	if kind == "MAJOR_UPGRADE" {
 		if err := setDowngradeOption(ctx, update.WantVersion, update.CurrentVersion, update.Db, l); err != nil {
 			return errors.Wrapf(err, "setting downgrade option for major roll forward failed")
 		}
@@ -133,19 +137,33 @@ func updateClusterStatefulSets(
 	updateSuite *updateFunctionSuite,
 	l logr.Logger,
 ) error {
+	waitForPodsFunc := makeWaitUntilAllPodsReadyFunc(ctx, cluster, update)
+	if cluster.ExcludeDecommissioned {
+		waitForPodsFunc = WaitUntilAllPodsReadyExcludingDecommissioned(
+			cluster.Clientset,
+			update.Db,
+			update.StsName,
+			update.StsNamespace,
+			cluster.PodUpdateTimeout,
+			cluster.PodMaxPollingInterval,
+		)
+	}
+
 	// TODO see what skipSleep should be doing here
-	// It is the first param returned by UpdateClusterRegionStatefulSet
-	_, err := UpdateClusterRegionStatefulSet(
+	// It is the first param returned by UpdateRegionStatefulSet
+	_, err := UpdateRegionStatefulSet(
 		ctx,
 		cluster.Clientset,
-		update.StsName,
-		update.StsNamespace,
 		updateSuite,
-		makeWaitUntilAllPodsReadyFunc(ctx, cluster, update),
-		cluster.PodUpdateTimeout,
-		cluster.PodMaxPollingInterval,
-		cluster.HealthChecker,
-		l)
+		l,
+		WithName(update.StsName),
+		WithNamespace(update.StsNamespace),
+		WithWaitForPodsFunc(waitForPodsFunc),
+		WithTimeout(cluster.PodUpdateTimeout),
+		WithPollingInterval(cluster.PodMaxPollingInterval),
+		WithHealthChecker(cluster.HealthChecker),
+		WithMetrics(cluster.Metrics),
+	)
 	if err != nil {
 		return err
 	}
@@ -206,38 +224,42 @@ func kindAndCheckPreserveDowngradeSetting(
 	if isPatch(wantVersion, currentVersion) {
 		l.V(int(zapcore.DebugLevel)).Info("patch upgrade")
 		return "PATCH", nil
-	} else if isForwardOneMajorVersion(wantVersion, currentVersion) {
+	}
+
+	kind := "MAJOR_UPGRADE"
+	if wantVersion.LessThan(currentVersion) {
+		kind = "MAJOR_ROLLBACK"
+	}
+	preserve, err := preserveDowngradeSetting(ctx, db)
+	if err != nil {
+		return kind, err
+	}
+	// validateUpgradeSkew is the single source of the versions that can be
+	// updated to, including the roll backs that the preserve downgrade option
+	// allows.
+	if err := validateUpgradeSkew(wantVersion, currentVersion, preserve); err != nil {
+		l.Error(err, "update not allowed")
+		return kind, err
+	}
+
+	if kind == "MAJOR_UPGRADE" {
 		l.V(int(zapcore.DebugLevel)).Info("major upgrade")
-		s := "MAJOR_UPGRADE"
-		preserve, err := preserveDowngradeSetting(ctx, db)
-		if err != nil {
-			return s, err
-		}
 		// To do a roll forward, preserve downgrade option should either be
 		// unset, or set to current version. If unset, kubeupdate will set it to
 		// current version.
 		if (preserve.Compare(&semver.Version{}) != 0 &&
 			(preserve.Major() != currentVersion.Major() || preserve.Minor() != currentVersion.Minor())) {
-			return s, UpdateNotAllowed{
+			return kind, UpdateNotAllowed{
 				cur:      currentVersion,
 				want:     wantVersion,
 				preserve: preserve,
 				extra:    "can't roll forward due to preserve downgrade option",
 			}
 		}
-		return s, nil
-	} else if isBackOneMajorVersion(wantVersion, currentVersion) {
-		l.V(int(zapcore.DebugLevel)).Info("major rollback")
-		return CheckDowngradeSetting(ctx, wantVersion, currentVersion, db)
+		return kind, nil
 	}
-
-	err := UpdateNotAllowed{
-		cur:   currentVersion,
-		want:  wantVersion,
-		extra: "only patches, rolling forward one major version, & rolling back one major version supported",
-	}
-	l.Error(err, "unknown upgrade")
-	return "UNKNOWN", err
+	l.V(int(zapcore.DebugLevel)).Info("major rollback")
+	return kind, nil
 }
 
 // CheckDowngradeSetting retrieves the downgrade setting from the database and then tests that the update is feasible.
@@ -265,9 +287,9 @@ func checkDowngradeAllowed(wantVersion *semver.Version, currentVersion *semver.V
 }
 
 func preserveDowngradeSetting(ctx context.Context, db *sql.DB) (*semver.Version, error) {
-	preserveDowngradeSetting, err := clustersql.GetClusterSetting(ctx, db, "cluster.preserve_downgrade_option")
+	preserveDowngradeSetting, err := GetPreserveDowngradeOption(ctx, db)
 	if err != nil {
-		return nil, errors.Wrapf(err, "getting preserve downgrade option failed")
+		return nil, err
 	}
 	if preserveDowngradeSetting == "" {
 		return &semver.Version{}, nil // empty semver.Version means unset preserve downgrade option
@@ -283,15 +305,11 @@ func preserveDowngradeSetting(ctx context.Context, db *sql.DB) (*semver.Version,
 }
 
 func setDowngradeOption(ctx context.Context, wantVersion *semver.Version, currentVersion *semver.Version, db *sql.DB, l logr.Logger) error {
-	newDowngradeOption := fmt.Sprintf("%d.%d", currentVersion.Major(), currentVersion.Minor())
-	if !validPreserveDowngradeOptionSetting.MatchString(newDowngradeOption) {
-		return fmt.Errorf("%s is not a valid preserve downgrade option setting", newDowngradeOption)
-	}
-	if err := clustersql.SetClusterSetting(ctx, db, PreserveDowngradeOptionClusterSetting, newDowngradeOption); err != nil {
-		return errors.Wrapf(err, "setting preserve downgrade option failed")
+	if err := SetPreserveDowngradeOption(ctx, db, currentVersion.String(), l); err != nil {
+		return err
 	}
 
-	l.V(int(zapcore.DebugLevel)).Info("set downgrade option since major version", "cluster.preserve_downgrade_option", newDowngradeOption)
+	l.V(int(zapcore.DebugLevel)).Info("set downgrade option since major version", "cluster.preserve_downgrade_option", fmt.Sprintf("%d.%d", currentVersion.Major(), currentVersion.Minor()))
 
 	return nil
 }
@@ -17,8 +17,9 @@ limitations under the License.
 package update
 
 import (
-	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	semver "github.com/Masterminds/semver/v3"
@@ -27,10 +28,16 @@ import (
 	"github.com/go-logr/logr"
 	"go.uber.org/zap/zapcore"
 	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// DBContainerName is the name of the CockroachDB container in the pods of the
+// StatefulSet. Containers are looked up by name, never by index, so that init
+// and sidecar containers can be added in any order.
+const DBContainerName = resource.DbContainerName
+
 // makeUpdateCockroachVersionFunction takes a cockroachImage string and returns
 // a function which takes a statefulset and returns the same statefulset, with
 // the CockroachDB container image within changed to the new cockroachImage.
@@ -46,19 +53,80 @@ func makeUpdateCockroachVersionFunction(
 		}
 		sts.Annotations[resource.CrdbVersionAnnotation] = version
 		sts.Annotations[resource.CrdbContainerImageAnnotation] = cockroachImage
-		for i := range sts.Spec.Template.Spec.Containers {
-			container := &sts.Spec.Template.Spec.Containers[i]
-			// TODO "db" is hardcoded.  Make this a value in statefulset resource
-			// so that we are sharing values here
-			if container.Name == "db" {
-				container.Image = cockroachImage
-				return sts, nil
+		return MakeImageUpdateFunc(map[string]string{DBContainerName: cockroachImage})(sts)
+	}
+}
+
+// MakeImageUpdateFunc returns an updateFunc that sets the image of every
+// container of the pod template named in containerImages, a map of container
+// names to images. It returns an error, without changing any image, if one of
+// the named containers is not in the pod template.
+func MakeImageUpdateFunc(containerImages map[string]string) func(*v1.StatefulSet) (*v1.StatefulSet, error) {
+	return func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+		containers := sts.Spec.Template.Spec.Containers
+		found := make(map[string]bool, len(containerImages))
+		for i := range containers {
+			if _, ok := containerImages[containers[i].Name]; ok {
+				found[containers[i].Name] = true
+			}
+		}
+
+		var missing []string
+		for name := range containerImages {
+			if !found[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return nil, fmt.Errorf("containers %s not found in sts %s", strings.Join(missing, ", "), sts.Name)
+		}
+
+		for i := range containers {
+			if image, ok := containerImages[containers[i].Name]; ok {
+				containers[i].Image = image
+			}
+		}
+		return sts, nil
+	}
+}
+
+// MakeResourceUpdateFunc returns an updateFunc that sets the resource requests
+// and limits of the named container of the pod template. The resources are
+// merged into the existing ones, so that, for instance, raising the memory
+// request keeps the CPU request. It returns an error if the container is not in
+// the pod template.
+func MakeResourceUpdateFunc(container string, requests, limits corev1.ResourceList) func(*v1.StatefulSet) (*v1.StatefulSet, error) {
+	return func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+		containers := sts.Spec.Template.Spec.Containers
+		for i := range containers {
+			if containers[i].Name != container {
+				continue
 			}
+
+			resources := &containers[i].Resources
+			resources.Requests = mergeResourceList(resources.Requests, requests)
+			resources.Limits = mergeResourceList(resources.Limits, limits)
+			return sts, nil
 		}
-		return nil, errors.New("cockroachdb container not found in sts")
+		return nil, fmt.Errorf("container %s not found in sts %s", container, sts.Name)
 	}
 }
 
+// mergeResourceList returns dst with the quantities of src added or replaced.
+func mergeResourceList(dst, src corev1.ResourceList) corev1.ResourceList {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(corev1.ResourceList, len(src))
+	}
+	for name, quantity := range src {
+		dst[name] = quantity.DeepCopy()
+	}
+	return dst
+}
+
 // TODO some of these should probably be panics or cancel the update at least
 // If we cannot find the Pod, or if we cannot find the container.
 // We need to return a status and an error instead of just an error.
@@ -74,7 +142,7 @@ func makeIsCRBPodIsRunningNewVersionFunction(
 		sts := update.sts
 		stsName := sts.Name
 		stsNamespace := sts.Namespace
-		podName := fmt.Sprintf("%s-%d", stsName, podNumber)
+		podName := PodName(sts, podNumber)
 		clientset := update.clientset
 
 		crdbPod, err := clientset.CoreV1().Pods(stsNamespace).Get(update.ctx, podName, metav1.GetOptions{})
@@ -95,8 +163,7 @@ func makeIsCRBPodIsRunningNewVersionFunction(
 
 		for i := range crdbPod.Spec.Containers {
 			container := &crdbPod.Spec.Containers[i]
-			// TODO this is hard coded and resource statefulset needs to use this
-			if container.Name == "db" {
+			if container.Name == DBContainerName {
 
 				// TODO this is not an error but should return a wait status
 				if container.Image != cockroachImage {
@@ -149,3 +216,50 @@ func isBackOneMajorVersion(wantVersion *semver.Version, currentVersion *semver.V
 	return (currentVersion.Major() == wantVersion.Major() && currentVersion.Minor() == wantVersion.Minor()+1) ||
 		(currentVersion.Major() == wantVersion.Major()+1 && currentVersion.Minor() == wantVersion.Minor()-1)
 }
+
+// ValidateUpgradeSkew returns an error if CockroachDB can't be updated from the
+// current to the target version in one go: if the target is more than one
+// major release ahead, e.g. from 22.1 to 24.1 or to 23.2 but not to 23.1, or is
+// a roll back to an older major version than preserve_downgrade_option allows.
+// The option of the cluster is not known here, so every roll back to an older
+// major version is rejected, the update itself checks it against the cluster.
+func ValidateUpgradeSkew(current, target string) error {
+	currentVersion, err := semver.NewVersion(current)
+	if err != nil {
+		return fmt.Errorf("invalid current version %s: %w", current, err)
+	}
+	targetVersion, err := semver.NewVersion(target)
+	if err != nil {
+		return fmt.Errorf("invalid target version %s: %w", target, err)
+	}
+	return validateUpgradeSkew(targetVersion, currentVersion, nil)
+}
+
+// validateUpgradeSkew is ValidateUpgradeSkew given the value of
+// preserve_downgrade_option, nil or the empty version when it is unset. A roll
+// back is only allowed to the version the option preserves.
+func validateUpgradeSkew(wantVersion, currentVersion, preserve *semver.Version) error {
+	switch {
+	case isPatch(wantVersion, currentVersion):
+		return nil
+	case currentVersion.LessThan(wantVersion):
+		// One major release ahead is at most a year ahead.
+		if wantVersion.Major() > currentVersion.Major()+1 ||
+			(wantVersion.Major() == currentVersion.Major()+1 && wantVersion.Minor() > currentVersion.Minor()) {
+			return UpdateNotAllowed{
+				cur:   currentVersion,
+				want:  wantVersion,
+				extra: "can't roll forward more than one major release at a time",
+			}
+		}
+		return nil
+	case preserve == nil || preserve.Equal(&semver.Version{}):
+		return UpdateNotAllowed{
+			cur:   currentVersion,
+			want:  wantVersion,
+			extra: "can't roll back unless the preserve downgrade option allows it",
+		}
+	}
+	_, err := checkDowngradeAllowed(wantVersion, currentVersion, preserve)
+	return err
+}
@@ -21,6 +21,9 @@ import (
 
 	semver "github.com/Masterminds/semver/v3"
 	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 func TestIsPatch(t *testing.T) {
@@ -143,3 +146,192 @@ func TestIsBackOneMajorVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateUpgradeSkew(t *testing.T) {
+	tests := []struct {
+		description    string
+		currentVersion string
+		wantVersion    string
+		result         bool
+	}{
+		{
+			"patch update",
+			"v22.1.5",
+			"v22.1.6",
+			true,
+		},
+		{
+			"forward within the same year 22.1 to 22.2",
+			"v22.1.0",
+			"v22.2.0",
+			true,
+		},
+		{
+			"forward one major release 22.1 to 23.1",
+			"v22.1.0",
+			"v23.1.0",
+			true,
+		},
+		{
+			"forward one major release 22.2 to 23.1",
+			"v22.2.0",
+			"v23.1.0",
+			true,
+		},
+		{
+			"forward more than one major release 22.1 to 23.2",
+			"v22.1.0",
+			"v23.2.0",
+			false,
+		},
+		{
+			"forward two major releases 22.1 to 24.1",
+			"v22.1.0",
+			"v24.1.0",
+			false,
+		},
+		{
+			"backward without preserve downgrade option 23.1 to 22.2",
+			"v23.1.0",
+			"v22.2.0",
+			false,
+		},
+		{
+			"invalid version",
+			"v22.1.0",
+			"latest",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := ValidateUpgradeSkew(test.currentVersion, test.wantVersion)
+			require.True(t, (err == nil) == test.result, "ValidateUpgradeSkew test failed: %v", err)
+		})
+	}
+
+	t.Run("with the preserve downgrade option", func(t *testing.T) {
+		tests := []struct {
+			description    string
+			currentVersion string
+			wantVersion    string
+			preserve       string
+			result         bool
+		}{
+			{"backward to the preserved version", "v23.1.0", "v22.2.0", "v22.2.0", true},
+			{"backward older than the preserved version", "v23.1.0", "v22.1.0", "v22.2.0", false},
+			{"backward after the upgrade was finalized", "v23.1.0", "v22.2.0", "v23.1.0", false},
+			{"forward is not limited by the option", "v22.2.0", "v23.1.0", "v22.2.0", true},
+		}
+		for _, test := range tests {
+			t.Run(test.description, func(t *testing.T) {
+				err := validateUpgradeSkew(semver.MustParse(test.wantVersion), semver.MustParse(test.currentVersion), semver.MustParse(test.preserve))
+				require.True(t, (err == nil) == test.result, "validateUpgradeSkew test failed: %v", err)
+			})
+		}
+	})
+}
+
+func TestMakeImageUpdateFunc(t *testing.T) {
+	newSts := func() *v1.StatefulSet {
+		sts := newTestStatefulSet(3)
+		sts.Spec.Template.Spec.Containers = append(sts.Spec.Template.Spec.Containers,
+			corev1.Container{Name: "log-collector", Image: "fluent/fluent-bit:1.8"})
+		return sts
+	}
+
+	t.Run("updates every named container", func(t *testing.T) {
+		sts, err := MakeImageUpdateFunc(map[string]string{
+			"db":            "cockroachdb/cockroach:v21.1.0",
+			"log-collector": "fluent/fluent-bit:1.9",
+		})(newSts())
+		require.NoError(t, err)
+		require.Equal(t, "cockroachdb/cockroach:v21.1.0", sts.Spec.Template.Spec.Containers[0].Image)
+		require.Equal(t, "fluent/fluent-bit:1.9", sts.Spec.Template.Spec.Containers[1].Image)
+	})
+
+	t.Run("returns error for a missing container", func(t *testing.T) {
+		sts := newSts()
+		_, err := MakeImageUpdateFunc(map[string]string{
+			"db":      "cockroachdb/cockroach:v21.1.0",
+			"missing": "missing:latest",
+		})(sts)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "missing")
+		require.Equal(t, "cockroachdb/cockroach:v20.2.0", sts.Spec.Template.Spec.Containers[0].Image, "no image must be changed")
+	})
+}
+
+func TestMakeUpdateCockroachVersionFunctionFindsContainerByName(t *testing.T) {
+	t.Run("updates the db container when it is not first", func(t *testing.T) {
+		sts := newTestStatefulSet(3)
+		sts.Annotations = map[string]string{}
+		sts.Spec.Template.Spec.Containers = append([]corev1.Container{
+			{Name: "log-collector", Image: "fluent/fluent-bit:1.8"},
+		}, sts.Spec.Template.Spec.Containers...)
+
+		sts, err := makeUpdateCockroachVersionFunction("cockroachdb/cockroach:v21.1.0", "v21.1.0", "v20.2.0")(sts)
+		require.NoError(t, err)
+		require.Equal(t, "fluent/fluent-bit:1.8", sts.Spec.Template.Spec.Containers[0].Image)
+		require.Equal(t, DBContainerName, sts.Spec.Template.Spec.Containers[1].Name)
+		require.Equal(t, "cockroachdb/cockroach:v21.1.0", sts.Spec.Template.Spec.Containers[1].Image)
+	})
+
+	t.Run("returns error without a db container", func(t *testing.T) {
+		sts := newTestStatefulSet(3)
+		sts.Annotations = map[string]string{}
+		sts.Spec.Template.Spec.Containers = []corev1.Container{{Name: "log-collector", Image: "fluent/fluent-bit:1.8"}}
+
+		_, err := makeUpdateCockroachVersionFunction("cockroachdb/cockroach:v21.1.0", "v21.1.0", "v20.2.0")(sts)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), DBContainerName)
+	})
+}
+
+func TestMakeResourceUpdateFunc(t *testing.T) {
+	newSts := func() *v1.StatefulSet {
+		sts := newTestStatefulSet(3)
+		sts.Spec.Template.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+			},
+		}
+		return sts
+	}
+
+	t.Run("merges the resources", func(t *testing.T) {
+		sts, err := MakeResourceUpdateFunc(DBContainerName,
+			corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")},
+			corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("8Gi")},
+		)(newSts())
+		require.NoError(t, err)
+
+		resources := sts.Spec.Template.Spec.Containers[0].Resources
+		require.True(t, resources.Requests.Cpu().Equal(resource.MustParse("2")), "the cpu request must be kept")
+		require.True(t, resources.Requests.Memory().Equal(resource.MustParse("8Gi")))
+		require.True(t, resources.Limits.Cpu().Equal(resource.MustParse("2")), "the cpu limit must be kept")
+		require.True(t, resources.Limits.Memory().Equal(resource.MustParse("8Gi")))
+	})
+
+	t.Run("sets resources of a container without any", func(t *testing.T) {
+		sts := newTestStatefulSet(3)
+		sts, err := MakeResourceUpdateFunc(DBContainerName, corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}, nil)(sts)
+		require.NoError(t, err)
+
+		resources := sts.Spec.Template.Spec.Containers[0].Resources
+		require.True(t, resources.Requests.Cpu().Equal(resource.MustParse("1")))
+		require.Nil(t, resources.Limits)
+	})
+
+	t.Run("returns error for a missing container", func(t *testing.T) {
+		_, err := MakeResourceUpdateFunc("missing", corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}, nil)(newSts())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "container missing not found")
+	})
+}
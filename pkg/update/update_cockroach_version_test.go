@@ -17,9 +17,12 @@ limitations under the License.
 package update
 
 import (
+	"context"
 	"testing"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	semver "github.com/Masterminds/semver/v3"
+	log "github.com/go-logr/logr/testing"
 	"github.com/stretchr/testify/require"
 )
 
@@ -72,3 +75,71 @@ func TestPerserveMatches(t *testing.T) {
 		})
 	}
 }
+
+func TestKindAndCheckPreserveDowngradeSetting(t *testing.T) {
+	tests := []struct {
+		description string
+		current     string
+		want        string
+		preserve    string
+		kind        string
+		wantErr     string
+	}{
+		{
+			description: "permitted rollback",
+			current:     "v23.1.0",
+			want:        "v22.2.0",
+			preserve:    "22.2",
+			kind:        "MAJOR_ROLLBACK",
+		},
+		{
+			description: "rollback without the preserve downgrade option",
+			current:     "v23.1.0",
+			want:        "v22.2.0",
+			kind:        "MAJOR_ROLLBACK",
+			wantErr:     "can't roll back unless the preserve downgrade option allows it",
+		},
+		{
+			description: "rollback older than the preserve downgrade option",
+			current:     "v23.1.0",
+			want:        "v22.1.0",
+			preserve:    "22.2",
+			kind:        "MAJOR_ROLLBACK",
+			wantErr:     "can't rollback since release already finalized",
+		},
+		{
+			description: "upgrade one major release",
+			current:     "v22.1.0",
+			want:        "v23.1.0",
+			kind:        "MAJOR_UPGRADE",
+		},
+		{
+			description: "upgrade more than one major release",
+			current:     "v22.1.0",
+			want:        "v23.2.0",
+			kind:        "MAJOR_UPGRADE",
+			wantErr:     "can't roll forward more than one major release at a time",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			require.NoError(t, err)
+			defer db.Close()
+			mock.
+				ExpectQuery("SHOW CLUSTER SETTING cluster.preserve_downgrade_option").
+				WillReturnRows(sqlmock.NewRows([]string{"cluster.preserve_downgrade_option"}).AddRow(test.preserve))
+
+			kind, err := kindAndCheckPreserveDowngradeSetting(context.Background(), semver.MustParse(test.want), semver.MustParse(test.current), db, log.NullLogger{})
+			require.Equal(t, test.kind, kind)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), test.wantErr)
+			}
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
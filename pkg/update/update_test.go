@@ -0,0 +1,2034 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	testStsName      = "cockroachdb"
+	testStsNamespace = "testns"
+)
+
+// fakeHealthChecker records every probe and fails once failAfter probes have
+// succeeded. A negative failAfter never fails.
+type fakeHealthChecker struct {
+	mu        sync.Mutex
+	calls     []int
+	failAfter int
+}
+
+func (hc *fakeHealthChecker) Probe(_ context.Context, _ logr.Logger, _ string, partition int) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if hc.failAfter >= 0 && len(hc.calls) >= hc.failAfter {
+		hc.calls = append(hc.calls, partition)
+		return errors.New("probe failed")
+	}
+	hc.calls = append(hc.calls, partition)
+	return nil
+}
+
+func newTestStatefulSet(replicas int32) *v1.StatefulSet {
+	return &v1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        testStsName,
+			Namespace:   testStsNamespace,
+			Annotations: map[string]string{},
+		},
+		Spec: v1.StatefulSetSpec{
+			Replicas: &replicas,
+			UpdateStrategy: v1.StatefulSetUpdateStrategy{
+				Type: v1.RollingUpdateStatefulSetStrategyType,
+			},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "db", Image: "cockroachdb/cockroach:v20.2.0"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newTestUpdate(t *testing.T, replicas int32, hc *fakeHealthChecker) (*fake.Clientset, *UpdateSts, *UpdateTimer) {
+	sts := newTestStatefulSet(replicas)
+	clientset := fake.NewSimpleClientset(sts)
+
+	updateSts := NewUpdateSts(context.Background(), clientset, sts.DeepCopy(), testStsName, testStsNamespace)
+	updateTimer, err := NewUpdateTimer(time.Second, 10*time.Millisecond, hc, func(context.Context, logr.Logger) error { return nil })
+	require.NoError(t, err)
+	return clientset, updateSts, updateTimer
+}
+
+// currentPartition returns the partition currently set on the StatefulSet, or
+// -1 if the partition has never been set.
+func currentPartition(t *testing.T, clientset *fake.Clientset) int32 {
+	sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+	require.NoError(t, err)
+
+	if sts.Spec.UpdateStrategy.RollingUpdate == nil || sts.Spec.UpdateStrategy.RollingUpdate.Partition == nil {
+		return -1
+	}
+	return *sts.Spec.UpdateStrategy.RollingUpdate.Partition
+}
+
+// updatedPartitions returns the partitions set on the StatefulSet, in the order
+// in which they were sent to the API server. Updates that don't move the
+// partition, such as recording a checkpoint, are left out.
+func updatedPartitions(clientset *fake.Clientset) []int32 {
+	var partitions []int32
+	for _, action := range clientset.Actions() {
+		update, ok := action.(k8stesting.UpdateAction)
+		if !ok || action.GetVerb() != "update" || action.GetResource().Resource != "statefulsets" {
+			continue
+		}
+		sts := update.GetObject().(*v1.StatefulSet)
+		ru := sts.Spec.UpdateStrategy.RollingUpdate
+		if ru == nil || ru.Partition == nil {
+			continue
+		}
+		partition := *ru.Partition
+		if n := len(partitions); n > 0 && partitions[n-1] == partition {
+			continue
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
+
+// partitionVerificationFunc simulates the StatefulSet controller: a pod is
+// considered updated once the partition has been lowered to (or below) it.
+func partitionVerificationFunc(clientset *fake.Clientset) func(*UpdateSts, int, logr.Logger) error {
+	return func(update *UpdateSts, podNumber int, _ logr.Logger) error {
+		sts, err := clientset.AppsV1().StatefulSets(update.namespace).Get(update.ctx, update.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		ru := sts.Spec.UpdateStrategy.RollingUpdate
+		if ru == nil || ru.Partition == nil || int(*ru.Partition) > podNumber {
+			return errors.New("pod not updated")
+		}
+		return nil
+	}
+}
+
+func TestPartitionedRollingUpdateStrategy(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+
+	skipSleep, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.False(t, skipSleep)
+	require.Equal(t, int32(0), currentPartition(t, clientset))
+	require.Equal(t, []int{2, 1, 0}, hc.calls)
+}
+
+func TestPartitionedRollingUpdateStrategyZeroReplicas(t *testing.T) {
+	tests := []struct {
+		name     string
+		replicas *int32
+		opts     []StrategyOption
+		isErr    bool
+	}{
+		{name: "nil replicas", isErr: true},
+		{name: "zero replicas", replicas: new(int32), isErr: true},
+		{name: "nil replicas allowed", opts: []StrategyOption{AllowZeroReplicas()}},
+		{name: "zero replicas allowed", replicas: new(int32), opts: []StrategyOption{AllowZeroReplicas()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, updateSts, updateTimer := newTestUpdate(t, 0, hc)
+			updateSts.sts.Spec.Replicas = tt.replicas
+
+			_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset), tt.opts...)(updateSts, updateTimer, log.NullLogger{})
+			if tt.isErr {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "refusing to update cockroachdb ns: testns, it has no replicas")
+			} else {
+				require.NoError(t, err)
+			}
+			require.Empty(t, updatedPartitions(clientset))
+			require.Empty(t, hc.calls)
+		})
+	}
+}
+
+func TestStrategiesNilReplicas(t *testing.T) {
+	verify := func(*UpdateSts, int, logr.Logger) error { return nil }
+	strategies := map[string]func(opts ...StrategyOption) func(*UpdateSts, *UpdateTimer, logr.Logger) (bool, error){
+		"partitioned": func(opts ...StrategyOption) func(*UpdateSts, *UpdateTimer, logr.Logger) (bool, error) {
+			return PartitionedRollingUpdateStrategy(verify, opts...)
+		},
+		"range": func(opts ...StrategyOption) func(*UpdateSts, *UpdateTimer, logr.Logger) (bool, error) {
+			return PartitionedRollingUpdateStrategyForRange(0, 0, verify, opts...)
+		},
+		"on delete": func(opts ...StrategyOption) func(*UpdateSts, *UpdateTimer, logr.Logger) (bool, error) {
+			return OnDeleteUpdateStrategy(verify, opts...)
+		},
+		"canary": func(opts ...StrategyOption) func(*UpdateSts, *UpdateTimer, logr.Logger) (bool, error) {
+			return CanaryUpdateStrategy(1, time.Millisecond, verify, opts...)
+		},
+	}
+
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, updateSts, updateTimer := newTestUpdate(t, 0, hc)
+			updateSts.sts.Spec.Replicas = nil
+
+			_, err := strategy()(updateSts, updateTimer, log.NullLogger{})
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "refusing to update cockroachdb ns: testns, it has no replicas")
+			require.Empty(t, updatedPartitions(clientset))
+			require.Empty(t, hc.calls)
+		})
+	}
+}
+
+func TestPartitionedRollingUpdateStrategySkipHealthProbe(t *testing.T) {
+	// The health checker fails every probe, so the update only succeeds if it
+	// is never probed.
+	hc := &fakeHealthChecker{failAfter: 0}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+	updateTimer.skipHealthProbe = true
+
+	verified := []int{}
+	verify := partitionVerificationFunc(clientset)
+	_, err := PartitionedRollingUpdateStrategy(func(update *UpdateSts, podNumber int, l logr.Logger) error {
+		if err := verify(update, podNumber, l); err != nil {
+			return err
+		}
+		verified = append(verified, podNumber)
+		return nil
+	})(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.Equal(t, []int32{2, 1, 0}, updatedPartitions(clientset))
+	require.Empty(t, hc.calls)
+	require.Subset(t, verified, []int{2, 1, 0})
+}
+
+func TestPartitionedRollingUpdateStrategyPreUpdateHook(t *testing.T) {
+	t.Run("runs before each partition is updated", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		var hooked []int
+		updateTimer.preUpdateHook = func(_ context.Context, partition int, _ logr.Logger) error {
+			// The pod must not have been updated yet.
+			require.Equal(t, len(hooked), len(updatedPartitions(clientset)))
+			hooked = append(hooked, partition)
+			return nil
+		}
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []int{2, 1, 0}, hooked)
+		require.Equal(t, []int32{2, 1, 0}, updatedPartitions(clientset))
+	})
+
+	t.Run("aborts the update when the hook fails", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		updateTimer.preUpdateHook = func(_ context.Context, partition int, _ logr.Logger) error {
+			if partition == 1 {
+				return errors.New("unable to drain connections")
+			}
+			return nil
+		}
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Equal(t, []int32{2}, updatedPartitions(clientset))
+	})
+}
+
+func TestPartitionedRollingUpdateStrategyPostUpdateHook(t *testing.T) {
+	t.Run("runs once per updated partition before the health probe", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		var hooked []int
+		updateTimer.postUpdateHook = func(_ context.Context, partition int, _ logr.Logger) error {
+			// The pod must have been updated but not probed yet.
+			require.Equal(t, len(hooked)+1, len(updatedPartitions(clientset)))
+			require.Len(t, hc.calls, len(hooked))
+			hooked = append(hooked, partition)
+			return nil
+		}
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []int{2, 1, 0}, hooked)
+	})
+
+	t.Run("does not run for partitions that are already updated", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		// Pods 2 and 1 were updated by a previous attempt.
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+		require.NoError(t, err)
+		partition := int32(1)
+		sts.Spec.UpdateStrategy.RollingUpdate = &v1.RollingUpdateStatefulSetStrategy{Partition: &partition}
+		_, err = clientset.AppsV1().StatefulSets(testStsNamespace).Update(context.Background(), sts, metav1.UpdateOptions{})
+		require.NoError(t, err)
+
+		var hooked []int
+		updateTimer.postUpdateHook = func(_ context.Context, partition int, _ logr.Logger) error {
+			hooked = append(hooked, partition)
+			return nil
+		}
+
+		_, err = PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []int{0}, hooked)
+	})
+
+	t.Run("aborts the update when the hook fails", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		updateTimer.postUpdateHook = func(context.Context, int, logr.Logger) error {
+			return errors.New("unable to enable connections")
+		}
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Equal(t, []int32{2}, updatedPartitions(clientset))
+		require.Empty(t, hc.calls)
+	})
+}
+
+// applyClientset records the options of the StatefulSet patches, which the fake
+// clientset doesn't keep.
+type applyClientset struct {
+	*fake.Clientset
+	opts *[]metav1.PatchOptions
+}
+
+func (c applyClientset) AppsV1() appsv1client.AppsV1Interface {
+	return applyAppsV1{AppsV1Interface: c.Clientset.AppsV1(), opts: c.opts}
+}
+
+type applyAppsV1 struct {
+	appsv1client.AppsV1Interface
+	opts *[]metav1.PatchOptions
+}
+
+func (a applyAppsV1) StatefulSets(namespace string) appsv1client.StatefulSetInterface {
+	return applyStatefulSets{StatefulSetInterface: a.AppsV1Interface.StatefulSets(namespace), opts: a.opts}
+}
+
+type applyStatefulSets struct {
+	appsv1client.StatefulSetInterface
+	opts *[]metav1.PatchOptions
+}
+
+func (s applyStatefulSets) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*v1.StatefulSet, error) {
+	*s.opts = append(*s.opts, opts)
+	return s.StatefulSetInterface.Patch(ctx, name, pt, data, opts, subresources...)
+}
+
+func TestPartitionedRollingUpdateStrategyServerSideApply(t *testing.T) {
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	var opts []metav1.PatchOptions
+	updateSts.clientset = applyClientset{Clientset: clientset, opts: &opts}
+
+	// The fake clientset doesn't support apply patches, set the partition of
+	// the patch on the tracked StatefulSet instead.
+	var patches []map[string]interface{}
+	clientset.PrependReactor("patch", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		require.Equal(t, types.ApplyPatchType, patch.GetPatchType())
+
+		var applied struct {
+			Spec v1.StatefulSetSpec `json:"spec"`
+		}
+		require.NoError(t, json.Unmarshal(patch.GetPatch(), &applied))
+		var raw map[string]interface{}
+		require.NoError(t, json.Unmarshal(patch.GetPatch(), &raw))
+		patches = append(patches, raw)
+
+		gvr := v1.SchemeGroupVersion.WithResource("statefulsets")
+		obj, err := clientset.Tracker().Get(gvr, patch.GetNamespace(), patch.GetName())
+		require.NoError(t, err)
+		sts := obj.(*v1.StatefulSet)
+		sts.Spec.UpdateStrategy = applied.Spec.UpdateStrategy
+		return true, sts, clientset.Tracker().Update(gvr, sts, patch.GetNamespace())
+	})
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset), WithServerSideApply("cockroach-operator"))(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), currentPartition(t, clientset))
+
+	force := true
+	require.Equal(t, []metav1.PatchOptions{
+		{FieldManager: "cockroach-operator", Force: &force},
+		{FieldManager: "cockroach-operator", Force: &force},
+		{FieldManager: "cockroach-operator", Force: &force},
+	}, opts)
+	require.Len(t, patches, 3)
+	for i, partition := range []float64{2, 1, 0} {
+		require.Equal(t, map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "StatefulSet",
+			"metadata":   map[string]interface{}{"name": testStsName, "namespace": testStsNamespace},
+			"spec": map[string]interface{}{
+				"updateStrategy": map[string]interface{}{
+					"type":          "RollingUpdate",
+					"rollingUpdate": map[string]interface{}{"partition": partition},
+				},
+			},
+		}, patches[i])
+	}
+}
+
+func TestPartitionedRollingUpdateStrategyEviction(t *testing.T) {
+	tooManyRequests := k8sErrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 10)
+
+	// newTestUpdateWithPods returns an update of 3 pods that all run the old
+	// revision.
+	newTestUpdateWithPods := func(t *testing.T) (*fake.Clientset, *UpdateSts, *UpdateTimer) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		for i := 0; i < 3; i++ {
+			_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(),
+				newTestPod(fmt.Sprintf("cockroachdb-%d", i), "cockroachdb-old"), metav1.CreateOptions{})
+			require.NoError(t, err)
+		}
+		return clientset, updateSts, updateTimer
+	}
+
+	// evictionsReactor simulates the StatefulSet controller recreating an
+	// evicted pod: on the new revision if the StatefulSet uses the OnDelete
+	// update strategy or the partition covers the pod, on the old revision
+	// otherwise. It records the evicted pods. The first len(errs) evictions
+	// return errs in order, the rest use last. A pod that is already gone is
+	// recreated all the same.
+	evictionsReactor := func(clientset *fake.Clientset, evicted *[]string, errs []error, last error) {
+		clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.GetSubresource() != "eviction" {
+				return false, nil, nil
+			}
+			eviction := action.(k8stesting.CreateAction).GetObject().(*policyv1beta1.Eviction)
+			*evicted = append(*evicted, eviction.Name)
+
+			err := last
+			if len(errs) > 0 {
+				err, errs = errs[0], errs[1:]
+			}
+			if err != nil && !k8sErrors.IsNotFound(err) {
+				return true, nil, err
+			}
+
+			// the tracker is read directly as the clientset is locked by reactors
+			tracker := clientset.Tracker()
+			obj, trackerErr := tracker.Get(v1.SchemeGroupVersion.WithResource("statefulsets"), testStsNamespace, testStsName)
+			require.NoError(t, trackerErr)
+			sts := obj.(*v1.StatefulSet)
+			podNumber, convErr := strconv.Atoi(strings.TrimPrefix(eviction.Name, testStsName+"-"))
+			require.NoError(t, convErr)
+			revision := "cockroachdb-old"
+			ru := sts.Spec.UpdateStrategy.RollingUpdate
+			if sts.Spec.UpdateStrategy.Type == v1.OnDeleteStatefulSetStrategyType || ru != nil && ru.Partition != nil && int(*ru.Partition) <= podNumber {
+				revision = "cockroachdb-new"
+			}
+			pods := corev1.SchemeGroupVersion.WithResource("pods")
+			require.NoError(t, tracker.Delete(pods, testStsNamespace, eviction.Name))
+			require.NoError(t, tracker.Create(pods, newTestPod(eviction.Name, revision), testStsNamespace))
+			return true, nil, err
+		})
+	}
+
+	// requireRevisions checks the revision of every pod.
+	requireRevisions := func(t *testing.T, clientset *fake.Clientset, revision string) {
+		for i := 0; i < 3; i++ {
+			pod, err := clientset.CoreV1().Pods(testStsNamespace).Get(context.Background(), fmt.Sprintf("cockroachdb-%d", i), metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, revision, pod.Labels[v1.ControllerRevisionHashLabelKey], pod.Name)
+		}
+	}
+
+	verify := func(clientset *fake.Clientset) func(*UpdateSts, int, logr.Logger) error {
+		return revisionVerificationFunc(clientset, "cockroachdb-new")
+	}
+
+	for _, maxConcurrent := range []int{1, 3} {
+		t.Run(fmt.Sprintf("evicts every pod once with batches of %d", maxConcurrent), func(t *testing.T) {
+			clientset, updateSts, updateTimer := newTestUpdateWithPods(t)
+			var evicted []string
+			evictionsReactor(clientset, &evicted, nil, nil)
+
+			_, err := PartitionedRollingUpdateStrategy(verify(clientset), WithEviction(), WithMaxConcurrent(maxConcurrent))(updateSts, updateTimer, log.NullLogger{})
+			require.NoError(t, err)
+			require.Equal(t, []string{testStsName + "-2", testStsName + "-1", testStsName + "-0"}, evicted)
+			requireRevisions(t, clientset, "cockroachdb-new")
+			// the controller never deleted a pod itself
+			require.Empty(t, deletedPods(clientset))
+			// the partition was only set once every pod was updated
+			require.Equal(t, []int32{0}, updatedPartitions(clientset))
+
+			sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, v1.RollingUpdateStatefulSetStrategyType, sts.Spec.UpdateStrategy.Type)
+		})
+	}
+
+	t.Run("retries while the pod disruption budget refuses the eviction", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdateWithPods(t)
+		var evicted []string
+		evictionsReactor(clientset, &evicted, []error{tooManyRequests, tooManyRequests}, nil)
+
+		_, err := PartitionedRollingUpdateStrategy(verify(clientset), WithEviction())(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []string{testStsName + "-2", testStsName + "-2", testStsName + "-2", testStsName + "-1", testStsName + "-0"}, evicted)
+		requireRevisions(t, clientset, "cockroachdb-new")
+	})
+
+	t.Run("fails when the pod disruption budget keeps refusing the eviction", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdateWithPods(t)
+		updateTimer.podUpdateTimeout = 50 * time.Millisecond
+		var evicted []string
+		evictionsReactor(clientset, &evicted, nil, tooManyRequests)
+
+		_, err := PartitionedRollingUpdateStrategy(verify(clientset), WithEviction())(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "pod disruption budget did not allow evicting pod "+testStsName+"-2")
+		requireRevisions(t, clientset, "cockroachdb-old")
+		require.Empty(t, updatedPartitions(clientset))
+	})
+
+	t.Run("treats a pod that is already gone as evicted", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdateWithPods(t)
+		var evicted []string
+		notFound := k8sErrors.NewNotFound(corev1.Resource("pods"), testStsName+"-2")
+		evictionsReactor(clientset, &evicted, []error{notFound}, nil)
+
+		_, err := PartitionedRollingUpdateStrategy(verify(clientset), WithEviction())(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		requireRevisions(t, clientset, "cockroachdb-new")
+	})
+
+	t.Run("evicts the canary pods as well", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdateWithPods(t)
+		var evicted []string
+		evictionsReactor(clientset, &evicted, nil, nil)
+
+		_, err := CanaryUpdateStrategy(1, 10*time.Millisecond, verify(clientset), WithEviction())(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []string{testStsName + "-2", testStsName + "-1", testStsName + "-0"}, evicted)
+		requireRevisions(t, clientset, "cockroachdb-new")
+		require.Equal(t, []int32{0}, updatedPartitions(clientset))
+	})
+
+	t.Run("does not evict by default", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		var evicted []string
+		evictionsReactor(clientset, &evicted, nil, nil)
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Empty(t, evicted)
+	})
+}
+
+func TestPartitionedRollingUpdateStrategyBatches(t *testing.T) {
+	tests := []struct {
+		name           string
+		replicas       int32
+		maxConcurrent  int
+		wantPartitions []int32
+		wantProbes     []int
+	}{
+		{
+			name:           "one at a time",
+			replicas:       6,
+			maxConcurrent:  1,
+			wantPartitions: []int32{5, 4, 3, 2, 1, 0},
+			wantProbes:     []int{5, 4, 3, 2, 1, 0},
+		},
+		{
+			name:           "batch of 3",
+			replicas:       6,
+			maxConcurrent:  3,
+			wantPartitions: []int32{3, 0},
+			wantProbes:     []int{3, 0},
+		},
+		{
+			name:           "batch of 3 with a partial last batch",
+			replicas:       5,
+			maxConcurrent:  3,
+			wantPartitions: []int32{2, 0},
+			wantProbes:     []int{2, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, updateSts, updateTimer := newTestUpdate(t, tt.replicas, hc)
+
+			var verified []int
+			verify := partitionVerificationFunc(clientset)
+			recordingVerify := func(update *UpdateSts, podNumber int, l logr.Logger) error {
+				err := verify(update, podNumber, l)
+				if err == nil {
+					verified = append(verified, podNumber)
+				}
+				return err
+			}
+
+			strategy := PartitionedRollingUpdateStrategy(recordingVerify, WithMaxConcurrent(tt.maxConcurrent))
+			_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+			require.NoError(t, err)
+			require.Equal(t, tt.wantPartitions, updatedPartitions(clientset))
+			require.Equal(t, tt.wantProbes, hc.calls)
+
+			// every pod is verified once it has been rolled
+			for pod := 0; pod < int(tt.replicas); pod++ {
+				require.Contains(t, verified, pod)
+			}
+		})
+	}
+}
+
+func TestPartitionedRollingUpdateStrategyRollback(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: 1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+
+	// simulate UpdateRegionStatefulSet capturing the pre-update state
+	// and then applying updateFunc
+	updateSts.preUpdateTemplate = updateSts.sts.Spec.Template.DeepCopy()
+	updateSts.preUpdateStrategy = updateSts.sts.Spec.UpdateStrategy.DeepCopy()
+	updateSts.sts.Spec.Template.Spec.Containers[0].Image = "cockroachdb/cockroach:v21.1.0"
+
+	strategy := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset), WithRollbackOnProbeFailure())
+	_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrRolledBack))
+	require.Equal(t, []int{2, 1}, hc.calls)
+
+	sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "cockroachdb/cockroach:v20.2.0", sts.Spec.Template.Spec.Containers[0].Image)
+	require.Nil(t, sts.Spec.UpdateStrategy.RollingUpdate)
+
+	t.Run("without the option the update is left in place", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: 1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+		updateSts.sts.Spec.Template.Spec.Containers[0].Image = "cockroachdb/cockroach:v21.1.0"
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrRolledBack))
+		require.Equal(t, int32(1), currentPartition(t, clientset))
+	})
+}
+
+func TestCanaryUpdateStrategy(t *testing.T) {
+	tests := []struct {
+		name          string
+		replicas      int32
+		canaryCount   int
+		failAfter     int
+		wantPartition int32
+		wantErr       bool
+	}{
+		{
+			name:          "single pod canary",
+			replicas:      3,
+			canaryCount:   1,
+			failAfter:     -1,
+			wantPartition: 0,
+		},
+		{
+			name:          "multi pod canary",
+			replicas:      4,
+			canaryCount:   2,
+			failAfter:     -1,
+			wantPartition: 0,
+		},
+		{
+			name:          "single pod canary fails soak",
+			replicas:      3,
+			canaryCount:   1,
+			failAfter:     2,
+			wantPartition: 2,
+			wantErr:       true,
+		},
+		{
+			name:          "multi pod canary fails soak",
+			replicas:      4,
+			canaryCount:   2,
+			failAfter:     3,
+			wantPartition: 2,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: tt.failAfter}
+			clientset, updateSts, updateTimer := newTestUpdate(t, tt.replicas, hc)
+
+			strategy := CanaryUpdateStrategy(tt.canaryCount, 50*time.Millisecond, partitionVerificationFunc(clientset))
+			_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, tt.wantPartition, currentPartition(t, clientset))
+			// one probe per canary, plus at least two while soaking
+			require.Greater(t, len(hc.calls), tt.canaryCount+1)
+		})
+	}
+}
+
+func TestCanaryUpdateStrategyOptions(t *testing.T) {
+	t.Run("rolls the pods in batches", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 5, hc)
+
+		strategy := CanaryUpdateStrategy(2, time.Millisecond, partitionVerificationFunc(clientset), WithMaxConcurrent(2))
+		_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []int32{3, 1, 0}, updatedPartitions(clientset))
+	})
+
+	for name, opt := range map[string]StrategyOption{
+		"ascending order":         WithPartitionOrder(Ascending),
+		"max pods per invocation": WithMaxPodsPerInvocation(1),
+	} {
+		t.Run("rejects "+name, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+
+			_, err := CanaryUpdateStrategy(1, time.Millisecond, partitionVerificationFunc(clientset), opt)(updateSts, updateTimer, log.NullLogger{})
+			require.Error(t, err)
+			require.Empty(t, updatedPartitions(clientset))
+		})
+	}
+}
+
+func TestUpdateRegionStatefulSet(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, _, _ := newTestUpdate(t, 3, hc)
+	waitFn := func(context.Context, logr.Logger) error { return nil }
+
+	newImage := "cockroachdb/cockroach:v21.1.0"
+	updateSuite := NewUpdateFunctionSuite(
+		func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+			sts.Spec.Template.Spec.Containers[0].Image = newImage
+			return sts, nil
+		},
+		PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset)),
+	)
+
+	_, err := UpdateRegionStatefulSet(
+		context.Background(),
+		clientset,
+		updateSuite,
+		log.NullLogger{},
+		WithName(testStsName),
+		WithNamespace(testStsNamespace),
+		WithTimeout(time.Second),
+		WithPollingInterval(10*time.Millisecond),
+		WithHealthChecker(hc),
+		WithWaitForPodsFunc(waitFn),
+	)
+	require.NoError(t, err)
+
+	sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, newImage, sts.Spec.Template.Spec.Containers[0].Image)
+	require.Equal(t, int32(0), currentPartition(t, clientset))
+
+	t.Run("returns an error when a required option is missing", func(t *testing.T) {
+		tests := []struct {
+			name string
+			opts []UpdateOption
+		}{
+			{name: "name", opts: []UpdateOption{WithNamespace(testStsNamespace), WithHealthChecker(hc), WithWaitForPodsFunc(waitFn)}},
+			{name: "namespace", opts: []UpdateOption{WithName(testStsName), WithHealthChecker(hc), WithWaitForPodsFunc(waitFn)}},
+			{name: "health checker", opts: []UpdateOption{WithName(testStsName), WithNamespace(testStsNamespace), WithWaitForPodsFunc(waitFn)}},
+			{name: "wait for pods func", opts: []UpdateOption{WithName(testStsName), WithNamespace(testStsNamespace), WithHealthChecker(hc)}},
+		}
+
+		for _, tt := range tests {
+			_, err := UpdateRegionStatefulSet(context.Background(), clientset, updateSuite, log.NullLogger{}, tt.opts...)
+			require.Error(t, err, tt.name)
+		}
+	})
+}
+
+func TestUpdateClusterRegionStatefulSetVerifyRevision(t *testing.T) {
+	for _, converged := range []bool{true, false} {
+		t.Run(fmt.Sprintf("converged %t", converged), func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, _, _ := newTestUpdate(t, 3, hc)
+			status := v1.StatefulSetStatus{Replicas: 3, UpdatedReplicas: 3, CurrentRevision: "rev-2", UpdateRevision: "rev-2"}
+			if !converged {
+				status.UpdatedReplicas = 2
+			}
+			setStatefulSetStatus(t, clientset, status)
+
+			updateSuite := NewUpdateFunctionSuite(
+				func(sts *v1.StatefulSet) (*v1.StatefulSet, error) { return sts, nil },
+				PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset)),
+			)
+			_, err := UpdateClusterRegionStatefulSet(
+				context.Background(),
+				clientset,
+				testStsName,
+				testStsNamespace,
+				updateSuite,
+				func(context.Context, logr.Logger) error { return nil },
+				time.Second,
+				10*time.Millisecond,
+				hc,
+				log.NullLogger{},
+				WithVerifyRevision(),
+				WithRollUnchanged(),
+			)
+			if converged {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "has 2 of 3 replicas")
+		})
+	}
+}
+
+// cancellingHealthChecker cancels the update context the first time it is
+// probed.
+type cancellingHealthChecker struct {
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (hc *cancellingHealthChecker) Probe(context.Context, logr.Logger, string, int) error {
+	hc.calls++
+	hc.cancel()
+	return nil
+}
+
+func TestPartitionedRollingUpdateStrategyCancellation(t *testing.T) {
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hc := &cancellingHealthChecker{cancel: cancel}
+	updateSts.ctx = ctx
+	updateTimer.healthChecker = hc
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+	require.True(t, errors.Is(err, context.Canceled))
+	require.Equal(t, 1, hc.calls)
+	require.Equal(t, []int32{2}, updatedPartitions(clientset))
+
+	t.Run("verification backoff stops when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+		updateTimer.podUpdateTimeout = time.Minute
+
+		attempts := 0
+		verify := func(*UpdateSts, int, logr.Logger) error {
+			attempts++
+			cancel()
+			return errors.New("pod not updated")
+		}
+
+		err := waitUntilPerPodVerificationFuncVerifies(ctx, updateSts, verify, 0, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Equal(t, 1, attempts)
+	})
+}
+
+// blockingHealthChecker blocks until the context of the probe is done and
+// records how long it was left to run.
+type blockingHealthChecker struct {
+	mu        sync.Mutex
+	remaining time.Duration
+	onProbe   func()
+}
+
+func (hc *blockingHealthChecker) Probe(ctx context.Context, _ logr.Logger, _ string, _ int) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		hc.mu.Lock()
+		hc.remaining = time.Until(deadline)
+		hc.mu.Unlock()
+	}
+	if hc.onProbe != nil {
+		hc.onProbe()
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPartitionedRollingUpdateStrategySharedPodBudget(t *testing.T) {
+	t.Run("a slow probe uses up the budget left by the verification", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+		hc := &blockingHealthChecker{}
+		updateTimer.healthChecker = hc
+		updateTimer.podUpdateTimeout = 200 * time.Millisecond
+
+		verify := func(updateSts *UpdateSts, partition int, l logr.Logger) error {
+			time.Sleep(100 * time.Millisecond)
+			return partitionVerificationFunc(clientset)(updateSts, partition, l)
+		}
+
+		start := time.Now()
+		_, err := PartitionedRollingUpdateStrategy(verify)(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "exceeded the update budget")
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+		require.Less(t, int64(hc.getRemaining()), int64(150*time.Millisecond), "the probe must only get what is left of the budget")
+		require.Less(t, int64(time.Since(start)), int64(time.Second))
+		require.Equal(t, []int32{2}, updatedPartitions(clientset))
+	})
+
+	t.Run("cancelling the update still interrupts the probe", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		updateSts.ctx = ctx
+		updateTimer.healthChecker = &blockingHealthChecker{onProbe: cancel}
+		updateTimer.podUpdateTimeout = time.Minute
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		var interrupted InterruptedError
+		require.True(t, errors.As(err, &interrupted), "got %v", err)
+	})
+}
+
+// getRemaining returns how long the last probe was left to run.
+func (hc *blockingHealthChecker) getRemaining() time.Duration {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return hc.remaining
+}
+
+// hangingHealthChecker never returns from Probe until the test ends, even
+// when its context is done.
+type hangingHealthChecker struct {
+	release chan struct{}
+}
+
+func (hc *hangingHealthChecker) Probe(context.Context, logr.Logger, string, int) error {
+	<-hc.release
+	return nil
+}
+
+func TestPartitionedRollingUpdateStrategyHealthProbeTimeout(t *testing.T) {
+	t.Run("a hung probe times out", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+		hc := &hangingHealthChecker{release: make(chan struct{})}
+		defer close(hc.release)
+		updateTimer.healthChecker = hc
+		updateTimer.healthProbeTimeout = 50 * time.Millisecond
+
+		start := time.Now()
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "health probe timed out after 50ms on partition 2")
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+		require.Less(t, int64(time.Since(start)), int64(time.Second))
+		require.Equal(t, []int32{2}, updatedPartitions(clientset))
+	})
+
+	t.Run("the probe doesn't share the budget of the verification", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+		hc := &blockingHealthChecker{}
+		updateTimer.healthChecker = hc
+		updateTimer.podUpdateTimeout = 200 * time.Millisecond
+		updateTimer.healthProbeTimeout = 150 * time.Millisecond
+
+		verify := func(updateSts *UpdateSts, partition int, l logr.Logger) error {
+			time.Sleep(100 * time.Millisecond)
+			return partitionVerificationFunc(clientset)(updateSts, partition, l)
+		}
+
+		_, err := PartitionedRollingUpdateStrategy(verify)(updateSts, updateTimer, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "health probe timed out after 150ms")
+		require.Greater(t, int64(hc.getRemaining()), int64(120*time.Millisecond), "the probe must get its whole timeout")
+	})
+}
+
+// capturingLogger records the messages logged through Info at any verbosity.
+type capturingLogger struct {
+	log.NullLogger
+	messages *[]string
+}
+
+func (l capturingLogger) Info(msg string, _ ...interface{}) {
+	*l.messages = append(*l.messages, msg)
+}
+
+func (l capturingLogger) V(int) logr.Logger { return l }
+
+func (l capturingLogger) WithValues(...interface{}) logr.Logger { return l }
+
+func (l capturingLogger) WithName(string) logr.Logger { return l }
+
+func TestWaitUntilPerPodVerificationFuncVerifiesLogsAttempts(t *testing.T) {
+	_, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	updateTimer.initialInterval = time.Millisecond
+
+	attempts := 0
+	verify := func(*UpdateSts, int, logr.Logger) error {
+		attempts++
+		if attempts <= 2 {
+			return errors.New("pod not updated")
+		}
+		return nil
+	}
+
+	var messages []string
+	l := capturingLogger{messages: &messages}
+	require.NoError(t, waitUntilPerPodVerificationFuncVerifies(context.Background(), updateSts, verify, 0, updateTimer, l))
+	require.Equal(t, 3, attempts)
+	require.Equal(t, []string{"verification attempt failed", "verification attempt failed"}, messages)
+}
+
+func TestPartitionedRollingUpdateStrategyInterrupted(t *testing.T) {
+	t.Run("stops between partitions", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		updateSts.ctx = ctx
+		updateTimer.healthChecker = &cancellingHealthChecker{cancel: cancel}
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		var interruptedErr InterruptedError
+		require.True(t, errors.As(err, &interruptedErr))
+		require.Equal(t, 2, interruptedErr.LastCompletedPartition)
+		require.True(t, errors.Is(err, context.Canceled))
+		require.Equal(t, []int32{2}, updatedPartitions(clientset))
+	})
+
+	// interruptingVerificationFunc cancels the update the first time pod 1 is
+	// verified after it has been updated.
+	interruptingVerificationFunc := func(clientset *fake.Clientset, cancel context.CancelFunc) func(*UpdateSts, int, logr.Logger) error {
+		verify := partitionVerificationFunc(clientset)
+		interrupted := false
+		return func(update *UpdateSts, podNumber int, l logr.Logger) error {
+			if err := verify(update, podNumber, l); err != nil {
+				return err
+			}
+			if podNumber == 1 && !interrupted {
+				interrupted = true
+				cancel()
+				return errors.New("pod not ready yet")
+			}
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name                  string
+		gracePeriod           time.Duration
+		wantLastCompleted     int
+		wantUpdatedPartitions []int32
+	}{
+		{
+			name:                  "finishes verifying the current partition within the grace period",
+			gracePeriod:           time.Minute,
+			wantLastCompleted:     1,
+			wantUpdatedPartitions: []int32{2, 1},
+		},
+		{
+			name:                  "stops verifying right away without a grace period",
+			wantLastCompleted:     2,
+			wantUpdatedPartitions: []int32{2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			updateSts.ctx = ctx
+			updateTimer.shutdownGracePeriod = tt.gracePeriod
+			updateTimer.initialInterval = time.Millisecond
+
+			_, err := PartitionedRollingUpdateStrategy(interruptingVerificationFunc(clientset, cancel))(updateSts, updateTimer, log.NullLogger{})
+			var interruptedErr InterruptedError
+			require.True(t, errors.As(err, &interruptedErr))
+			require.Equal(t, tt.wantLastCompleted, interruptedErr.LastCompletedPartition)
+			require.Equal(t, tt.wantUpdatedPartitions, updatedPartitions(clientset))
+		})
+	}
+}
+
+func TestPartitionedRollingUpdateStrategyEvents(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: 1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 2, hc)
+	recorder := record.NewFakeRecorder(10)
+	updateSts.eventRecorder = recorder
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+	require.Error(t, err)
+
+	close(recorder.Events)
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+
+	require.Len(t, events, 5)
+	require.Equal(t, "Normal PodUpdateStarted Updating pod 1 of cockroachdb", events[0])
+	require.Equal(t, "Normal PodUpdateCompleted Pod 1 of cockroachdb updated", events[1])
+	require.Equal(t, "Normal PodUpdateStarted Updating pod 0 of cockroachdb", events[2])
+	require.Equal(t, "Normal PodUpdateCompleted Pod 0 of cockroachdb updated", events[3])
+	require.Contains(t, events[4], "Warning HealthProbeFailed Health probe failed after updating partition 0 of cockroachdb")
+
+	t.Run("already updated partitions", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 2, hc)
+		strategy := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))
+		_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+
+		recorder := record.NewFakeRecorder(10)
+		updateSts.eventRecorder = recorder
+		skipSleep, err := strategy(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.True(t, skipSleep)
+
+		close(recorder.Events)
+		var events []string
+		for e := range recorder.Events {
+			events = append(events, e)
+		}
+		require.Equal(t, []string{
+			"Normal PartitionAlreadyUpdated Partition 1 of cockroachdb already updated",
+			"Normal PartitionAlreadyUpdated Partition 0 of cockroachdb already updated",
+		}, events)
+	})
+
+	t.Run("no recorder is nil-safe", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 2, hc)
+
+		_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+	})
+}
+
+func TestUpdateMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+
+	hc := &fakeHealthChecker{failAfter: 2}
+	clientset, _, _ := newTestUpdate(t, 3, hc)
+	updateSuite := NewUpdateFunctionSuite(
+		func(sts *v1.StatefulSet) (*v1.StatefulSet, error) { return sts, nil },
+		PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset)),
+	)
+
+	_, err := UpdateRegionStatefulSet(
+		context.Background(),
+		clientset,
+		updateSuite,
+		log.NullLogger{},
+		WithName(testStsName),
+		WithNamespace(testStsNamespace),
+		WithTimeout(time.Second),
+		WithPollingInterval(10*time.Millisecond),
+		WithHealthChecker(hc),
+		WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+		WithMetrics(metrics),
+		WithRollUnchanged(),
+	)
+	require.Error(t, err)
+
+	// the duration is recorded once per updated partition
+	require.Equal(t, 1, promtestutil.CollectAndCount(metrics.PodUpdateDuration))
+	require.Equal(t, float64(1), promtestutil.ToFloat64(metrics.UpdateFailures.WithLabelValues(failureReasonHealthProbe)))
+	require.Equal(t, float64(0), promtestutil.ToFloat64(metrics.UpdateInProgress))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == "crdb_operator_pod_update_duration_seconds" {
+			require.Equal(t, uint64(3), f.GetMetric()[0].GetHistogram().GetSampleCount())
+		}
+	}
+}
+
+func TestUpdateRegionStatefulSetDryRun(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, _, _ := newTestUpdate(t, 3, hc)
+	updateSuite := NewUpdateFunctionSuite(
+		func(sts *v1.StatefulSet) (*v1.StatefulSet, error) {
+			sts.Spec.Template.Spec.Containers[0].Image = "cockroachdb/cockroach:v21.1.0"
+			return sts, nil
+		},
+		PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset)),
+	)
+
+	skipSleep, err := UpdateRegionStatefulSet(
+		context.Background(),
+		clientset,
+		updateSuite,
+		log.NullLogger{},
+		WithName(testStsName),
+		WithNamespace(testStsNamespace),
+		WithHealthChecker(hc),
+		WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+		WithDryRun(),
+	)
+	require.NoError(t, err)
+	require.True(t, skipSleep)
+	require.Empty(t, updatedPartitions(clientset))
+	require.Empty(t, hc.calls)
+
+	sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "cockroachdb/cockroach:v20.2.0", sts.Spec.Template.Spec.Containers[0].Image)
+
+	t.Run("skips the preflight checks", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, _, _ := newTestUpdate(t, 3, hc)
+
+		skipSleep, err := UpdateRegionStatefulSet(
+			context.Background(),
+			clientset,
+			updateSuite,
+			log.NullLogger{},
+			WithName(testStsName),
+			WithNamespace(testStsNamespace),
+			WithHealthChecker(hc),
+			WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+			WithDryRun(),
+			WithPreflight(),
+		)
+		require.NoError(t, err)
+		require.True(t, skipSleep)
+		require.Empty(t, hc.calls, "a dry run must not probe the cluster")
+		for _, action := range clientset.Actions() {
+			require.NotEqual(t, "pods", action.GetResource().Resource, "a dry run must not read the pods")
+		}
+	})
+}
+
+func TestUpdateRegionStatefulSetUnchanged(t *testing.T) {
+	noop := func(sts *v1.StatefulSet) (*v1.StatefulSet, error) { return sts, nil }
+	for _, tc := range []struct {
+		name          string
+		status        v1.StatefulSetStatus
+		opts          []UpdateOption
+		expectRolled  bool
+		expectSkipped bool
+	}{
+		{
+			name:          "skips the update",
+			status:        v1.StatefulSetStatus{CurrentRevision: "rev-1", UpdateRevision: "rev-1"},
+			expectSkipped: true,
+		},
+		{
+			name:         "resumes an unfinished rollout",
+			status:       v1.StatefulSetStatus{CurrentRevision: "rev-1", UpdateRevision: "rev-2"},
+			expectRolled: true,
+		},
+		{
+			name:         "rolls when asked to",
+			status:       v1.StatefulSetStatus{CurrentRevision: "rev-1", UpdateRevision: "rev-1"},
+			opts:         []UpdateOption{WithRollUnchanged()},
+			expectRolled: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, _, _ := newTestUpdate(t, 3, hc)
+			setStatefulSetStatus(t, clientset, tc.status)
+
+			strategyCalled := false
+			strategy := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))
+			updateSuite := NewUpdateFunctionSuite(noop, func(updateSts *UpdateSts, timer *UpdateTimer, l logr.Logger) (bool, error) {
+				strategyCalled = true
+				return strategy(updateSts, timer, l)
+			})
+
+			opts := append([]UpdateOption{
+				WithName(testStsName),
+				WithNamespace(testStsNamespace),
+				WithTimeout(time.Second),
+				WithPollingInterval(10 * time.Millisecond),
+				WithHealthChecker(hc),
+				WithWaitForPodsFunc(func(context.Context, logr.Logger) error { return nil }),
+			}, tc.opts...)
+			skipSleep, err := UpdateRegionStatefulSet(context.Background(), clientset, updateSuite, log.NullLogger{}, opts...)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectRolled, strategyCalled)
+			if tc.expectSkipped {
+				require.True(t, skipSleep)
+				require.Empty(t, updatedPartitions(clientset))
+				require.Empty(t, hc.calls)
+			}
+		})
+	}
+}
+
+func TestDiffStatefulSet(t *testing.T) {
+	before := newTestStatefulSet(3)
+	after := before.DeepCopy()
+	require.Empty(t, DiffStatefulSet(before, after))
+
+	after.Spec.Template.Spec.Containers[0].Image = "cockroachdb/cockroach:v21.1.0"
+	diff := DiffStatefulSet(before, after)
+	require.Contains(t, diff, "--- before\n+++ after\n")
+	require.Contains(t, diff, "\n-      - image: cockroachdb/cockroach:v20.2.0\n")
+	require.Contains(t, diff, "\n+      - image: cockroachdb/cockroach:v21.1.0\n")
+	require.NotContains(t, diff, "replicas")
+}
+
+func TestUpdateTimerBackOff(t *testing.T) {
+	t.Run("uses the library defaults when unset", func(t *testing.T) {
+		b := (&UpdateTimer{podUpdateTimeout: time.Minute, podMaxPollingInterval: time.Second}).newBackOff()
+		require.Equal(t, backoff.DefaultInitialInterval, b.InitialInterval)
+		require.Equal(t, backoff.DefaultMultiplier, b.Multiplier)
+		require.Equal(t, time.Minute, b.MaxElapsedTime)
+		require.Equal(t, time.Second, b.MaxInterval)
+		require.Equal(t, backoff.DefaultRandomizationFactor, b.RandomizationFactor)
+	})
+
+	t.Run("sets the randomization factor from the polling jitter", func(t *testing.T) {
+		b := (&UpdateTimer{podUpdateTimeout: time.Minute, podMaxPollingInterval: time.Second, pollingJitter: 0.2}).newBackOff()
+		require.Equal(t, 0.2, b.RandomizationFactor)
+
+		b = (&UpdateTimer{podUpdateTimeout: time.Minute, podMaxPollingInterval: time.Second, pollingJitter: 3}).newBackOff()
+		require.Equal(t, 1.0, b.RandomizationFactor)
+	})
+
+	t.Run("a permanent error stops the backoff after one attempt", func(t *testing.T) {
+		for name, verifyErr := range map[string]error{
+			"permanent error":         backoff.Permanent(errors.New("pod not updated")),
+			"wrapped permanent error": errors.Wrap(backoff.Permanent(errors.New("pod not updated")), "verifying pod"),
+			"pod failed":              errors.Wrap(errors.Mark(errors.New("pod crashed"), ErrPodFailed), "verifying pod"),
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, updateSts, updateTimer := newTestUpdate(t, 1, nil)
+				updateTimer.podUpdateTimeout = time.Minute
+
+				attempts := 0
+				verify := func(*UpdateSts, int, logr.Logger) error {
+					attempts++
+					return verifyErr
+				}
+				err := waitUntilPerPodVerificationFuncVerifies(context.Background(), updateSts, verify, 0, updateTimer, log.NullLogger{})
+				require.Error(t, err)
+				require.Equal(t, 1, attempts)
+				require.Equal(t, verifyErr.Error(), err.Error())
+			})
+		}
+	})
+
+	t.Run("a larger multiplier results in fewer attempts", func(t *testing.T) {
+		attempts := func(multiplier float64) int {
+			_, updateSts, updateTimer := newTestUpdate(t, 1, nil)
+			updateTimer.podUpdateTimeout = 300 * time.Millisecond
+			updateTimer.podMaxPollingInterval = time.Second
+			updateTimer.initialInterval = 5 * time.Millisecond
+			updateTimer.multiplier = multiplier
+
+			n := 0
+			verify := func(*UpdateSts, int, logr.Logger) error {
+				n++
+				return errors.New("pod not updated")
+			}
+			require.Error(t, waitUntilPerPodVerificationFuncVerifies(context.Background(), updateSts, verify, 0, updateTimer, log.NullLogger{}))
+			return n
+		}
+
+		require.Less(t, attempts(4), attempts(1.2))
+	})
+}
+
+// newObservedLogger returns a logger that records every entry, at every level.
+func newObservedLogger() (logr.Logger, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.Level(-128))
+	return zapr.NewLogger(zap.New(core)), logs
+}
+
+// requireLogFields asserts that the entry has the fields, with the same values.
+func requireLogFields(t *testing.T, entry observer.LoggedEntry, fields map[string]interface{}) {
+	t.Helper()
+	got := entry.ContextMap()
+	for key, value := range fields {
+		require.Contains(t, got, key, entry.Message)
+		require.EqualValues(t, value, got[key], key)
+	}
+}
+
+func TestUpdateLogFields(t *testing.T) {
+	l, logs := newObservedLogger()
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+
+	_, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, l)
+	require.NoError(t, err)
+
+	waiting := logs.FilterMessage("waiting until partition done updating").All()
+	require.Len(t, waiting, 3)
+	for i, entry := range waiting {
+		requireLogFields(t, entry, map[string]interface{}{logKeyPartition: 2 - i})
+	}
+
+	updateSts.sts.Annotations[PauseUpdateAnnotation] = "true"
+	_, err = PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, l)
+	require.NoError(t, err)
+	paused := logs.FilterMessage("update paused, not updating any more pods").All()
+	require.Len(t, paused, 1)
+	requireLogFields(t, paused[0], map[string]interface{}{
+		logKeyStsName:   testStsName,
+		logKeyNamespace: testStsNamespace,
+		logKeyPartition: 2,
+	})
+	require.NotContains(t, paused[0].ContextMap(), "namspace")
+}
+
+func TestHandleStsError(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "statefulsets"}
+
+	tests := []struct {
+		name          string
+		err           error
+		wantRetryable bool
+		wantFatal     bool
+		wantConflict  bool
+	}{
+		{name: "server timeout", err: k8sErrors.NewServerTimeout(gr, "get", 1), wantRetryable: true},
+		{name: "too many requests", err: k8sErrors.NewTooManyRequests("slow down", 1), wantRetryable: true},
+		{name: "internal error", err: k8sErrors.NewInternalError(errors.New("boom")), wantRetryable: true},
+		{name: "forbidden", err: k8sErrors.NewForbidden(gr, testStsName, errors.New("nope")), wantFatal: true},
+		{name: "unauthorized", err: k8sErrors.NewUnauthorized("who are you"), wantFatal: true},
+		{name: "not found", err: k8sErrors.NewNotFound(gr, testStsName)},
+		{name: "conflict", err: k8sErrors.NewConflict(gr, testStsName, errors.New("conflict")), wantConflict: true},
+		{name: "other error", err: errors.New("boom")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, logs := newObservedLogger()
+			err := handleStsError(tt.err, l, testStsName, testStsNamespace)
+			require.Error(t, err)
+			requireLogFields(t, logs.All()[0], map[string]interface{}{
+				logKeyStsName:   testStsName,
+				logKeyNamespace: testStsNamespace,
+			})
+			require.True(t, errors.Is(err, tt.err))
+
+			var retryable RetryableError
+			require.Equal(t, tt.wantRetryable, errors.As(err, &retryable))
+
+			var fatal FatalError
+			require.Equal(t, tt.wantFatal, errors.As(err, &fatal))
+
+			require.Equal(t, tt.wantConflict, errors.Is(err, ErrConflictRetriesExhausted))
+		})
+	}
+}
+
+func TestUpdateStatefulSetConflictRetriesExhausted(t *testing.T) {
+	clientset, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	gr := schema.GroupResource{Group: "apps", Resource: "statefulsets"}
+	updates := 0
+	clientset.PrependReactor("update", "statefulsets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		return true, nil, k8sErrors.NewConflict(gr, testStsName, errors.New("object has been modified"))
+	})
+
+	err := updateStatefulSet(updateSts, updateSts.sts, func(sts *v1.StatefulSet) {
+		sts.Spec.UpdateStrategy.Type = v1.OnDeleteStatefulSetStrategyType
+	}, log.NullLogger{})
+	require.True(t, errors.Is(err, ErrConflictRetriesExhausted))
+	require.Equal(t, 1+retry.DefaultRetry.Steps, updates)
+
+	var fatal FatalError
+	require.False(t, errors.As(err, &fatal))
+}
+
+func TestUpdateStatefulSetConflictRetry(t *testing.T) {
+	gr := schema.GroupResource{Group: "apps", Resource: "statefulsets"}
+	// conflictNTimes makes the first n updates of the StatefulSet conflict.
+	conflictNTimes := func(clientset *fake.Clientset, n int) *int {
+		updates := 0
+		clientset.PrependReactor("update", "statefulsets", func(k8stesting.Action) (bool, runtime.Object, error) {
+			updates++
+			if updates <= n {
+				return true, nil, k8sErrors.NewConflict(gr, testStsName, errors.New("object has been modified"))
+			}
+			return false, nil, nil
+		})
+		return &updates
+	}
+	mutate := func(sts *v1.StatefulSet) {
+		sts.Spec.UpdateStrategy.Type = v1.OnDeleteStatefulSetStrategyType
+	}
+	conflicts := retry.DefaultRetry.Steps + 1
+
+	t.Run("default backoff gives up", func(t *testing.T) {
+		clientset, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		conflictNTimes(clientset, conflicts)
+
+		err := updateStatefulSet(updateSts, updateSts.sts, mutate, log.NullLogger{})
+		require.True(t, errors.Is(err, ErrConflictRetriesExhausted))
+	})
+
+	t.Run("custom backoff with more steps succeeds", func(t *testing.T) {
+		clientset, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		updates := conflictNTimes(clientset, conflicts)
+		WithConflictRetry(wait.Backoff{Steps: 2 * conflicts, Duration: time.Millisecond, Factor: 1.5}).apply(&updateOptions{updateSts: updateSts})
+
+		err := updateStatefulSet(updateSts, updateSts.sts, mutate, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, conflicts+1, *updates)
+
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, v1.OnDeleteStatefulSetStrategyType, sts.Spec.UpdateStrategy.Type)
+	})
+
+	t.Run("gives up after the max duration with steps left", func(t *testing.T) {
+		clock := newFakeClock()
+		clientset, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+		updateSts.ctx = withClock(updateSts.ctx, clock)
+		for _, opt := range []UpdateOption{
+			WithConflictRetry(wait.Backoff{Steps: 100, Duration: time.Millisecond}),
+			WithConflictRetryMaxDuration(3 * time.Second),
+		} {
+			opt.apply(&updateOptions{updateSts: updateSts})
+		}
+		// Every conflicting update takes a second.
+		updates := 0
+		clientset.PrependReactor("update", "statefulsets", func(k8stesting.Action) (bool, runtime.Object, error) {
+			updates++
+			clock.Advance(time.Second)
+			return true, nil, k8sErrors.NewConflict(gr, testStsName, errors.New("object has been modified"))
+		})
+
+		err := updateStatefulSet(updateSts, updateSts.sts, mutate, log.NullLogger{})
+		require.True(t, errors.Is(err, ErrConflictRetriesExhausted))
+		// The first update, then the retries until 3 seconds have elapsed.
+		require.Equal(t, 4, updates)
+	})
+}
+
+// pausingHealthChecker sets the pause annotation on the StatefulSet the first
+// time it is probed.
+type pausingHealthChecker struct {
+	clientset *fake.Clientset
+	calls     int
+}
+
+func (hc *pausingHealthChecker) Probe(ctx context.Context, _ logr.Logger, _ string, _ int) error {
+	hc.calls++
+	sts, err := hc.clientset.AppsV1().StatefulSets(testStsNamespace).Get(ctx, testStsName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	sts.Annotations[PauseUpdateAnnotation] = "true"
+	_, err = hc.clientset.AppsV1().StatefulSets(testStsNamespace).Update(ctx, sts, metav1.UpdateOptions{})
+	return err
+}
+
+func TestPartitionedRollingUpdateStrategyPause(t *testing.T) {
+	setPaused := func(t *testing.T, clientset *fake.Clientset, updateSts *UpdateSts, paused bool) {
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+		require.NoError(t, err)
+		if paused {
+			sts.Annotations[PauseUpdateAnnotation] = "true"
+		} else {
+			delete(sts.Annotations, PauseUpdateAnnotation)
+		}
+		sts, err = clientset.AppsV1().StatefulSets(testStsNamespace).Update(context.Background(), sts, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		updateSts.sts = sts
+	}
+
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+	strategy := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))
+
+	// paused: nothing is updated
+	setPaused(t, clientset, updateSts, true)
+	skipSleep, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.True(t, skipSleep)
+	require.Equal(t, int32(-1), currentPartition(t, clientset))
+	require.Empty(t, hc.calls)
+
+	// resumed: the update runs to completion
+	setPaused(t, clientset, updateSts, false)
+	skipSleep, err = strategy(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.False(t, skipSleep)
+	require.Equal(t, int32(0), currentPartition(t, clientset))
+
+	t.Run("pausing mid update stops before the next pod", func(t *testing.T) {
+		clientset, updateSts, updateTimer := newTestUpdate(t, 3, nil)
+		hc := &pausingHealthChecker{clientset: clientset}
+		updateTimer.healthChecker = hc
+
+		skipSleep, err := PartitionedRollingUpdateStrategy(partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.True(t, skipSleep)
+		require.Equal(t, 1, hc.calls)
+		require.Equal(t, int32(2), currentPartition(t, clientset))
+	})
+}
+
+func newTestPod(name, revision string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testStsNamespace,
+			Labels:    map[string]string{},
+		},
+	}
+	if revision != "" {
+		pod.Labels[v1.ControllerRevisionHashLabelKey] = revision
+	}
+	return pod
+}
+
+func TestIsPodOnUpdateRevision(t *testing.T) {
+	sts := newTestStatefulSet(3)
+	sts.Status.UpdateRevision = "cockroachdb-new"
+
+	clientset := fake.NewSimpleClientset(
+		sts,
+		newTestPod("cockroachdb-2", "cockroachdb-new"),
+		newTestPod("cockroachdb-1", "cockroachdb-old"),
+		newTestPod("cockroachdb-0", ""),
+	)
+	updateSts := NewUpdateSts(context.Background(), clientset, sts, sts.Name, sts.Namespace)
+
+	updated, err := isPodOnUpdateRevision(updateSts, sts, 2)
+	require.NoError(t, err)
+	require.True(t, updated)
+
+	updated, err = isPodOnUpdateRevision(updateSts, sts, 1)
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	_, err = isPodOnUpdateRevision(updateSts, sts, 0)
+	require.Error(t, err)
+
+	_, err = isPodOnUpdateRevision(updateSts, sts, 5)
+	require.Error(t, err)
+}
+
+func TestPartitionedRollingUpdateStrategyRevisions(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+
+	// A previous attempt applied the template and updated pod 2 only.
+	updateSts.preUpdateTemplate = updateSts.sts.Spec.Template.DeepCopy()
+	updateSts.sts.Status.UpdateRevision = "cockroachdb-new"
+	for _, pod := range []*corev1.Pod{
+		newTestPod("cockroachdb-2", "cockroachdb-new"),
+		newTestPod("cockroachdb-1", "cockroachdb-old"),
+		newTestPod("cockroachdb-0", "cockroachdb-old"),
+	} {
+		_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(), pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	var verifiedBeforeUpdate []int
+	verify := partitionVerificationFunc(clientset)
+	falsePositiveVerify := func(update *UpdateSts, podNumber int, l logr.Logger) error {
+		if len(updatedPartitions(clientset)) == 0 {
+			verifiedBeforeUpdate = append(verifiedBeforeUpdate, podNumber)
+			// pretend every pod looks updated, the revision must win
+			return nil
+		}
+		return verify(update, podNumber, l)
+	}
+
+	_, err := PartitionedRollingUpdateStrategy(falsePositiveVerify)(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.Empty(t, verifiedBeforeUpdate)
+	require.Equal(t, []int32{1, 0}, updatedPartitions(clientset))
+}
+
+// deletedPods returns the names of the deleted pods, in the order in which they
+// were deleted.
+func deletedPods(clientset *fake.Clientset) []string {
+	var pods []string
+	for _, action := range clientset.Actions() {
+		del, ok := action.(k8stesting.DeleteAction)
+		if !ok || action.GetVerb() != "delete" || action.GetResource().Resource != "pods" {
+			continue
+		}
+		pods = append(pods, del.GetName())
+	}
+	return pods
+}
+
+// deletionVerificationFunc simulates the StatefulSet controller for the
+// OnDelete update strategy: a pod is considered updated once it was deleted.
+func deletionVerificationFunc(clientset *fake.Clientset) func(*UpdateSts, int, logr.Logger) error {
+	return func(update *UpdateSts, podNumber int, _ logr.Logger) error {
+		podName := update.PodName(podNumber)
+		for _, deleted := range deletedPods(clientset) {
+			if deleted == podName {
+				return nil
+			}
+		}
+		return errors.New("pod not updated")
+	}
+}
+
+func TestPartitionedRollingUpdateStrategyAscending(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+
+	var strategies []v1.StatefulSetUpdateStrategyType
+	clientset.PrependReactor("update", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sts := action.(k8stesting.UpdateAction).GetObject().(*v1.StatefulSet)
+		strategies = append(strategies, sts.Spec.UpdateStrategy.Type)
+		return false, nil, nil
+	})
+
+	strategy := PartitionedRollingUpdateStrategy(deletionVerificationFunc(clientset), WithPartitionOrder(Ascending))
+	skipSleep, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.False(t, skipSleep)
+
+	// pods are replaced bottom-up while the controller is kept from rolling
+	// them on its own, then the rolling update strategy is restored
+	require.Equal(t, []string{"cockroachdb-0", "cockroachdb-1", "cockroachdb-2"}, deletedPods(clientset))
+	require.Equal(t, []v1.StatefulSetUpdateStrategyType{
+		v1.OnDeleteStatefulSetStrategyType,
+		v1.OnDeleteStatefulSetStrategyType,
+		v1.OnDeleteStatefulSetStrategyType,
+		v1.RollingUpdateStatefulSetStrategyType,
+	}, strategies)
+	require.Equal(t, int32(0), currentPartition(t, clientset))
+	require.Equal(t, []int{0, 1, 2}, hc.calls)
+}
+
+func TestPodBatches(t *testing.T) {
+	require.Equal(t, []podBatch{{4, 3}, {2, 1}, {0, 0}}, descendingBatches(4, 0, 2))
+	require.Equal(t, []podBatch{{4, 4}, {3, 3}}, descendingBatches(4, 3, 1))
+	require.Equal(t, []podBatch{{1, 0}, {3, 2}, {4, 4}}, ascendingBatches(0, 4, 2))
+	require.Equal(t, []podBatch{{0, 0}, {1, 1}, {2, 2}}, ascendingBatches(0, 2, 1))
+	require.Empty(t, descendingBatches(-1, 0, 1))
+}
+
+func TestPartitionedRollingUpdateStrategyRegionTimeout(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 5, hc)
+	updateTimer.regionUpdateTimeout = 100 * time.Millisecond
+
+	verify := partitionVerificationFunc(clientset)
+	slowVerify := func(update *UpdateSts, podNumber int, l logr.Logger) error {
+		time.Sleep(30 * time.Millisecond)
+		return verify(update, podNumber, l)
+	}
+
+	_, err := PartitionedRollingUpdateStrategy(slowVerify)(updateSts, updateTimer, log.NullLogger{})
+	require.Error(t, err)
+
+	var timeoutErr RegionUpdateTimeoutError
+	require.True(t, errors.As(err, &timeoutErr))
+	require.Equal(t, testStsName, timeoutErr.StatefulSet)
+	require.Equal(t, 100*time.Millisecond, timeoutErr.Timeout)
+	require.Greater(t, timeoutErr.CompletedPartitions, 0)
+	require.Less(t, timeoutErr.CompletedPartitions, 5)
+	// the remaining pods were left untouched
+	require.Greater(t, currentPartition(t, clientset), int32(0))
+}
+
+func TestNewUpdateSts(t *testing.T) {
+	sts := newTestStatefulSet(3)
+	updateSts := NewUpdateSts(context.Background(), fake.NewSimpleClientset(sts), sts, testStsName, testStsNamespace)
+
+	require.Equal(t, testStsName, updateSts.Name())
+	require.Equal(t, testStsNamespace, updateSts.Namespace())
+	require.Same(t, sts, updateSts.StatefulSet())
+}
+
+func TestPodName(t *testing.T) {
+	tests := []struct {
+		name        string
+		replicas    int32
+		nilReplicas bool
+		partition   int
+		want        string
+	}{
+		{name: "first pod", replicas: 3, partition: 0, want: testStsName + "-0"},
+		{name: "last pod", replicas: 3, partition: 2, want: testStsName + "-2"},
+		{name: "partition past the last pod", replicas: 3, partition: 3, want: ""},
+		{name: "negative partition", replicas: 3, partition: -1, want: ""},
+		{name: "zero replicas", replicas: 0, partition: 0, want: ""},
+		{name: "nil replicas", nilReplicas: true, partition: 0, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := newTestStatefulSet(tt.replicas)
+			if tt.nilReplicas {
+				sts.Spec.Replicas = nil
+			}
+			require.Equal(t, tt.want, PodName(sts, tt.partition))
+		})
+	}
+}
+
+func TestNewUpdateTimer(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	waitFn := func(context.Context, logr.Logger) error { return nil }
+
+	t.Run("returns a timer with valid inputs", func(t *testing.T) {
+		updateTimer, err := NewUpdateTimer(time.Minute, time.Second, hc, waitFn)
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, updateTimer.podUpdateTimeout)
+		require.Equal(t, time.Second, updateTimer.podMaxPollingInterval)
+	})
+
+	t.Run("returns error when the timeout is less than the polling interval", func(t *testing.T) {
+		_, err := NewUpdateTimer(time.Second, time.Minute, hc, waitFn)
+		require.Error(t, err)
+	})
+
+	t.Run("returns error without a health checker", func(t *testing.T) {
+		_, err := NewUpdateTimer(time.Minute, time.Second, nil, waitFn)
+		require.Error(t, err)
+	})
+}
+
+func TestPartitionedRollingUpdateStrategyProgress(t *testing.T) {
+	type progress struct{ completed, total, partition int }
+
+	for _, test := range []struct {
+		description string
+		order       PartitionOrder
+		batchSize   int
+		expected    []progress
+	}{
+		{
+			"descending",
+			Descending,
+			1,
+			[]progress{{1, 3, 2}, {2, 3, 1}, {3, 3, 0}},
+		},
+		{
+			"descending in batches",
+			Descending,
+			2,
+			[]progress{{2, 3, 1}, {3, 3, 0}},
+		},
+		{
+			"ascending",
+			Ascending,
+			1,
+			[]progress{{1, 3, 0}, {2, 3, 1}, {3, 3, 2}},
+		},
+	} {
+		t.Run(test.description, func(t *testing.T) {
+			hc := &fakeHealthChecker{failAfter: -1}
+			clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+
+			var got []progress
+			updateTimer.progressFunc = func(completed, total, partition int) {
+				got = append(got, progress{completed, total, partition})
+			}
+
+			verify := partitionVerificationFunc(clientset)
+			if test.order == Ascending {
+				verify = deletionVerificationFunc(clientset)
+			}
+			strategy := PartitionedRollingUpdateStrategy(verify, WithPartitionOrder(test.order), WithMaxConcurrent(test.batchSize))
+			_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+			require.NoError(t, err)
+			require.Equal(t, test.expected, got)
+		})
+	}
+}
+
+// recreatePodsOnDelete simulates the StatefulSet controller for the OnDelete
+// update strategy: deleted pods are recreated on the given revision.
+func recreatePodsOnDelete(clientset *fake.Clientset, revision string) {
+	clientset.PrependReactor("delete", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.DeleteAction).GetName()
+		tracker := clientset.Tracker()
+		if err := tracker.Delete(action.GetResource(), action.GetNamespace(), name); err != nil {
+			return true, nil, err
+		}
+		return true, nil, tracker.Create(action.GetResource(), newTestPod(name, revision), action.GetNamespace())
+	})
+}
+
+// revisionVerificationFunc considers a pod updated once it runs revision.
+func revisionVerificationFunc(clientset *fake.Clientset, revision string) func(*UpdateSts, int, logr.Logger) error {
+	return func(update *UpdateSts, podNumber int, _ logr.Logger) error {
+		podName := update.PodName(podNumber)
+		pod, err := clientset.CoreV1().Pods(update.namespace).Get(update.ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pod.Labels[v1.ControllerRevisionHashLabelKey] != revision {
+			return errors.Newf("pod %s not updated", podName)
+		}
+		return nil
+	}
+}
+
+func TestPartitionedRollingUpdateStrategyForRange(t *testing.T) {
+	t.Run("only updates the pods of the range", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 6, hc)
+		for i := 0; i < 6; i++ {
+			_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(),
+				newTestPod(fmt.Sprintf("cockroachdb-%d", i), "cockroachdb-old"), metav1.CreateOptions{})
+			require.NoError(t, err)
+		}
+		recreatePodsOnDelete(clientset, "cockroachdb-new")
+
+		strategy := PartitionedRollingUpdateStrategyForRange(3, 4, revisionVerificationFunc(clientset, "cockroachdb-new"))
+		_, err := strategy(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{"cockroachdb-4", "cockroachdb-3"}, deletedPods(clientset))
+		require.Equal(t, []int{4, 3}, hc.calls)
+
+		sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, v1.OnDeleteStatefulSetStrategyType, sts.Spec.UpdateStrategy.Type)
+	})
+
+	t.Run("uses partitions for a range up to the highest pod", func(t *testing.T) {
+		hc := &fakeHealthChecker{failAfter: -1}
+		clientset, updateSts, updateTimer := newTestUpdate(t, 6, hc)
+
+		_, err := PartitionedRollingUpdateStrategyForRange(3, 5, partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+		require.NoError(t, err)
+		require.Equal(t, []int32{5, 4, 3}, updatedPartitions(clientset))
+		require.Equal(t, []int{5, 4, 3}, hc.calls)
+		require.Empty(t, deletedPods(clientset))
+	})
+
+	for _, r := range [][2]int{{-1, 2}, {4, 6}, {4, 3}} {
+		t.Run(fmt.Sprintf("returns error for range %v", r), func(t *testing.T) {
+			clientset, updateSts, updateTimer := newTestUpdate(t, 6, &fakeHealthChecker{failAfter: -1})
+
+			_, err := PartitionedRollingUpdateStrategyForRange(r[0], r[1], partitionVerificationFunc(clientset))(updateSts, updateTimer, log.NullLogger{})
+			require.Error(t, err)
+			require.Empty(t, updatedPartitions(clientset))
+		})
+	}
+}
+
+func TestOnDeleteUpdateStrategy(t *testing.T) {
+	hc := &fakeHealthChecker{failAfter: -1}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, hc)
+	updateSts.sts.Spec.UpdateStrategy = v1.StatefulSetUpdateStrategy{Type: v1.OnDeleteStatefulSetStrategyType}
+	for i := 0; i < 3; i++ {
+		_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(),
+			newTestPod(fmt.Sprintf("cockroachdb-%d", i), "cockroachdb-old"), metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	recreatePodsOnDelete(clientset, "cockroachdb-new")
+
+	strategy := OnDeleteUpdateStrategy(revisionVerificationFunc(clientset, "cockroachdb-new"))
+	skipSleep, err := strategy(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.False(t, skipSleep)
+
+	require.Equal(t, []string{"cockroachdb-2", "cockroachdb-1", "cockroachdb-0"}, deletedPods(clientset))
+	require.Equal(t, []int{2, 1, 0}, hc.calls)
+
+	sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, v1.OnDeleteStatefulSetStrategyType, sts.Spec.UpdateStrategy.Type)
+
+	// running the update again does not delete any more pods
+	_, err = strategy(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.Len(t, deletedPods(clientset), 3)
+}
+
+// ctxHealthChecker records the context of every probe.
+type ctxHealthChecker struct {
+	ctxs []context.Context
+}
+
+func (hc *ctxHealthChecker) Probe(ctx context.Context, _ logr.Logger, _ string, _ int) error {
+	hc.ctxs = append(hc.ctxs, ctx)
+	return nil
+}
+
+func TestPartitionedRollingUpdateStrategyReleasesBatchContexts(t *testing.T) {
+	hc := &ctxHealthChecker{}
+	clientset, updateSts, updateTimer := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	updateTimer.healthChecker = hc
+
+	var verifyCtxs []context.Context
+	verify := func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		// The contexts of the previous batches are released once they are
+		// done, rather than when the whole update is.
+		for _, ctx := range append(verifyCtxs[:len(verifyCtxs):len(verifyCtxs)], hc.ctxs...) {
+			require.Error(t, ctx.Err())
+		}
+		if !updateSts.rolledAt.IsZero() {
+			verifyCtxs = append(verifyCtxs, updateSts.ctx)
+		}
+		return partitionVerificationFunc(clientset)(updateSts, podNumber, l)
+	}
+
+	_, err := PartitionedRollingUpdateStrategy(verify)(updateSts, updateTimer, log.NullLogger{})
+	require.NoError(t, err)
+	require.Len(t, verifyCtxs, 3)
+	require.Len(t, hc.ctxs, 3)
+}
@@ -0,0 +1,398 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	"go.uber.org/zap/zapcore"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nodeVersionQuery returns the version of the binary that the node serving the
+// connection is running, e.g. v21.1.0.
+const nodeVersionQuery = "SELECT value FROM crdb_internal.node_build_info WHERE field = 'Version'"
+
+// VersionVerificationFunc returns a perPodVerificationFunc that connects to the
+// updated pod and checks that it is running expectedVersion of CockroachDB. A
+// pod can report Ready before the new binary is serving, so it returns an error
+// until the versions match, which keeps the update polling the pod.
+func VersionVerificationFunc(expectedVersion string, sqlConn SQLConnFactory) func(*UpdateSts, int, logr.Logger) error {
+	want := normalizeVersion(expectedVersion)
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		podName := updateSts.PodName(podNumber)
+		db, err := sqlConn.Open(updateSts.ctx, updateSts.namespace, podName)
+		if err != nil {
+			return errors.Wrapf(err, "error connecting to pod %s", podName)
+		}
+		defer db.Close()
+
+		var version string
+		if err := db.QueryRowContext(updateSts.ctx, nodeVersionQuery).Scan(&version); err != nil {
+			return errors.Wrapf(err, "error getting version of pod %s", podName)
+		}
+
+		l.V(int(zapcore.DebugLevel)).Info("checking pod version", "podName", podName, "version", version, "expected", expectedVersion)
+		if normalizeVersion(version) != want {
+			return errors.Newf("pod %s is running %s, waiting for %s", podName, version, expectedVersion)
+		}
+		return nil
+	}
+}
+
+// normalizeVersion strips the leading v, if any, so that versions coming from
+// an image tag and from CockroachDB compare equal.
+func normalizeVersion(version string) string {
+	return strings.TrimPrefix(strings.TrimSpace(version), "v")
+}
+
+// selectOneQuery is the cheapest query a node only answers once it accepts SQL.
+const selectOneQuery = "SELECT 1"
+
+// SQLReadinessVerificationFunc returns a perPodVerificationFunc that connects to
+// the updated pod and runs SELECT 1. Kubernetes can mark a pod Ready before
+// CockroachDB accepts SQL, so it returns an error until the query succeeds,
+// which keeps the update polling the pod. The connection targets the DNS name
+// of the pod, <sts>-<n>.<svc>, where svc is the governing service of the
+// StatefulSet, which is passed to connFactory as the pod name. See
+// SQLConnFactory.Open.
+func SQLReadinessVerificationFunc(connFactory SQLConnFactory) func(*UpdateSts, int, logr.Logger) error {
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		host := podDNSName(updateSts, podNumber)
+		db, err := connFactory.Open(updateSts.ctx, updateSts.namespace, host)
+		if err != nil {
+			return errors.Wrapf(err, "error connecting to pod %s", host)
+		}
+		defer db.Close()
+
+		var one int
+		if err := db.QueryRowContext(updateSts.ctx, selectOneQuery).Scan(&one); err != nil {
+			return errors.Wrapf(err, "pod %s is not accepting SQL yet", host)
+		}
+
+		l.V(int(zapcore.DebugLevel)).Info("pod accepts SQL", "podName", host)
+		return nil
+	}
+}
+
+// podDNSName returns the name under which the pod is reachable through the
+// governing service of the StatefulSet, or just the name of the pod if the
+// StatefulSet has no service.
+func podDNSName(updateSts *UpdateSts, podNumber int) string {
+	podName := updateSts.PodName(podNumber)
+	if svc := updateSts.sts.Spec.ServiceName; svc != "" {
+		return podName + "." + svc
+	}
+	return podName
+}
+
+// leaselessRangesQuery returns the number of ranges of the cluster that have no
+// leaseholder.
+const leaselessRangesQuery = "SELECT count(*) FROM crdb_internal.ranges WHERE lease_holder IS NULL"
+
+// NoLeaselessRangesVerificationFunc returns a perPodVerificationFunc that
+// connects to the updated pod and checks that every range of the cluster has a
+// leaseholder. A restarted node can leave ranges without a leaseholder for a
+// while, and queries on those ranges fail, so it returns an error until there
+// are none. It is meant to be combined with the verification of the pod itself
+// using CombineVerificationFuncs.
+func NoLeaselessRangesVerificationFunc(connFactory SQLConnFactory) func(*UpdateSts, int, logr.Logger) error {
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		podName := updateSts.PodName(podNumber)
+		db, err := connFactory.Open(updateSts.ctx, updateSts.namespace, podName)
+		if err != nil {
+			return errors.Wrapf(err, "error connecting to pod %s", podName)
+		}
+		defer db.Close()
+
+		var leaseless int
+		if err := db.QueryRowContext(updateSts.ctx, leaselessRangesQuery).Scan(&leaseless); err != nil {
+			return errors.Wrapf(err, "error getting ranges without a leaseholder from pod %s", podName)
+		}
+
+		l.V(int(zapcore.DebugLevel)).Info("ranges without a leaseholder", "podName", podName, "count", leaseless)
+		if leaseless > 0 {
+			return errors.Newf("%d ranges have no leaseholder after updating pod %s", leaseless, podName)
+		}
+		return nil
+	}
+}
+
+// nodeIsLiveQuery returns whether the node with the given ID is live according
+// to the liveness records gossiped to the node serving the connection.
+const nodeIsLiveQuery = "SELECT is_live FROM crdb_internal.gossip_liveness WHERE node_id = $1"
+
+// NodeIDResolver returns the ID of the CockroachDB node running in the pod of
+// the given partition.
+type NodeIDResolver func(updateSts *UpdateSts, podNumber int) (int, error)
+
+// NodeLiveVerificationFunc returns a perPodVerificationFunc that checks that the
+// node of the updated pod, whose ID is returned by resolve, is live. A pod can
+// be Ready while its peers still consider the node not live, so the liveness is
+// read from a peer, the pod of the next partition, and an error is returned
+// until is_live is true.
+func NodeLiveVerificationFunc(connFactory SQLConnFactory, resolve NodeIDResolver) func(*UpdateSts, int, logr.Logger) error {
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		podName := updateSts.PodName(podNumber)
+		nodeID, err := resolve(updateSts, podNumber)
+		if err != nil {
+			return errors.Wrapf(err, "error getting node id of pod %s", podName)
+		}
+
+		peer := podNumber
+		if replicas := int(replicasOf(updateSts.sts)); replicas > 1 {
+			peer = (podNumber + 1) % replicas
+		}
+		peerName := updateSts.PodName(peer)
+		db, err := connFactory.Open(updateSts.ctx, updateSts.namespace, peerName)
+		if err != nil {
+			return errors.Wrapf(err, "error connecting to pod %s", peerName)
+		}
+		defer db.Close()
+
+		var live bool
+		if err := db.QueryRowContext(updateSts.ctx, nodeIsLiveQuery, nodeID).Scan(&live); err != nil {
+			return errors.Wrapf(err, "error getting liveness of node %d from pod %s", nodeID, peerName)
+		}
+
+		l.V(int(zapcore.DebugLevel)).Info("checking node liveness", "podName", podName, "nodeID", nodeID, "live", live)
+		if !live {
+			return errors.Newf("node %d in pod %s is not live yet", nodeID, podName)
+		}
+		return nil
+	}
+}
+
+// liveNodesQuery returns the number of live nodes of the cluster that have not
+// been decommissioned.
+const liveNodesQuery = "SELECT count(*) FROM crdb_internal.gossip_liveness WHERE is_live AND membership != 'decommissioned'"
+
+// NoZombieNodesVerificationFunc returns a perPodVerificationFunc that connects
+// to the pod and checks that the cluster has exactly expectedNodeCount live
+// nodes that have not been decommissioned, usually the replicas of the
+// StatefulSet. After a scale down, nodes that were not removed properly linger
+// in the cluster, so it returns an error until the counts match. It is meant to
+// be used as a preflight check, see WithPreflightCheck.
+func NoZombieNodesVerificationFunc(connFactory SQLConnFactory, expectedNodeCount int) func(*UpdateSts, int, logr.Logger) error {
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		podName := updateSts.PodName(podNumber)
+		db, err := connFactory.Open(updateSts.ctx, updateSts.namespace, podName)
+		if err != nil {
+			return errors.Wrapf(err, "error connecting to pod %s", podName)
+		}
+		defer db.Close()
+
+		var nodes int
+		if err := db.QueryRowContext(updateSts.ctx, liveNodesQuery).Scan(&nodes); err != nil {
+			return errors.Wrapf(err, "error getting live nodes from pod %s", podName)
+		}
+
+		l.V(int(zapcore.DebugLevel)).Info("live nodes", "podName", podName, "count", nodes, "expected", expectedNodeCount)
+		if nodes != expectedNodeCount {
+			return errors.Newf("cluster has %d live nodes that are not decommissioned, expected %d", nodes, expectedNodeCount)
+		}
+		return nil
+	}
+}
+
+// CombineVerificationFuncs returns a perPodVerificationFunc that runs every one
+// of funcs in order, and returns the first error.
+func CombineVerificationFuncs(funcs ...func(*UpdateSts, int, logr.Logger) error) func(*UpdateSts, int, logr.Logger) error {
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		for _, f := range funcs {
+			if err := f(updateSts, podNumber, l); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// RestartedSinceVerificationFunc returns a perPodVerificationFunc that checks
+// that the db container of the updated pod has been running since after since,
+// and after the partition was lowered for the pod, so that a pod that was never
+// restarted is not treated as updated.
+func RestartedSinceVerificationFunc(since time.Time) func(*UpdateSts, int, logr.Logger) error {
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		after := since
+		if updateSts.rolledAt.After(after) {
+			after = updateSts.rolledAt
+		}
+
+		podName := updateSts.PodName(podNumber)
+		pod, err := updateSts.clientset.CoreV1().Pods(updateSts.namespace).Get(updateSts.ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "getting pod %s", podName)
+		}
+
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != DBContainerName {
+				continue
+			}
+			if err := crashLooping(status, podName); err != nil {
+				return err
+			}
+			if status.State.Running == nil {
+				return errors.Newf("container %s of pod %s is not running", DBContainerName, podName)
+			}
+			if startedAt := status.State.Running.StartedAt; !startedAt.Time.After(after) {
+				return errors.Newf("container %s of pod %s has been running since %s, before %s",
+					DBContainerName, podName, startedAt.UTC().Format(time.RFC3339), after.UTC().Format(time.RFC3339))
+			}
+			l.V(int(zapcore.DebugLevel)).Info("pod restarted", "podName", podName, "since", after)
+			return nil
+		}
+		return errors.Newf("container %s not found in pod %s", DBContainerName, podName)
+	}
+}
+
+// ImageVerificationFunc returns a perPodVerificationFunc that checks that the
+// container of the updated pod runs expectedImage. The image of the pod spec is
+// compared, as the image reported in the container status may have been
+// resolved by the runtime, e.g. to a digest.
+func ImageVerificationFunc(container, expectedImage string) func(*UpdateSts, int, logr.Logger) error {
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		podName := updateSts.PodName(podNumber)
+		pod, err := updateSts.clientset.CoreV1().Pods(updateSts.namespace).Get(updateSts.ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "getting pod %s", podName)
+		}
+
+		found := false
+		for _, c := range pod.Spec.Containers {
+			if c.Name != container {
+				continue
+			}
+			if c.Image != expectedImage {
+				return errors.Newf("container %s of pod %s has image %s, expected %s", container, podName, c.Image, expectedImage)
+			}
+			found = true
+		}
+		if !found {
+			return errors.Newf("container %s not found in pod %s", container, podName)
+		}
+
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != container {
+				continue
+			}
+			if err := crashLooping(status, podName); err != nil {
+				return err
+			}
+			if status.State.Running == nil {
+				return errors.Newf("container %s of pod %s is not running", container, podName)
+			}
+			l.V(int(zapcore.DebugLevel)).Info("pod runs the expected image", "podName", podName, "image", expectedImage)
+			return nil
+		}
+		return errors.Newf("container %s of pod %s has no status yet", container, podName)
+	}
+}
+
+// crashLoopBackOffReason is the reason a container waits with after crashing
+// repeatedly.
+const crashLoopBackOffReason = "CrashLoopBackOff"
+
+// crashLooping returns an error marked with ErrPodFailed if the container keeps
+// crashing, and nil otherwise.
+func crashLooping(status corev1.ContainerStatus, podName string) error {
+	if status.State.Waiting == nil || status.State.Waiting.Reason != crashLoopBackOffReason {
+		return nil
+	}
+	return errors.Mark(errors.Newf("container %s of pod %s is in %s after %d restarts: %s",
+		status.Name, podName, crashLoopBackOffReason, status.RestartCount, status.State.Waiting.Message), ErrPodFailed)
+}
+
+// StableForVerificationFunc returns a perPodVerificationFunc that only passes
+// once inner has passed continuously for stableFor, so that a pod that is Ready
+// but crash-looping is not trusted. It relies on being retried until it passes,
+// like every perPodVerificationFunc: the pod is stable from the first time inner
+// passes, and a failure of inner or a roll of the pod starts over. clock may be
+// nil.
+func StableForVerificationFunc(inner func(*UpdateSts, int, logr.Logger) error, stableFor time.Duration, clock Clock) func(*UpdateSts, int, logr.Logger) error {
+	if clock == nil {
+		clock = defaultClock
+	}
+
+	// stability is when inner started passing for a pod, since it was last
+	// rolled at rolledAt.
+	type stability struct {
+		since, rolledAt time.Time
+	}
+	var mu sync.Mutex
+	stableSince := map[string]stability{}
+
+	return func(updateSts *UpdateSts, podNumber int, l logr.Logger) error {
+		podName := updateSts.PodName(podNumber)
+		err := inner(updateSts, podNumber, l)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			delete(stableSince, podName)
+			return err
+		}
+
+		// The stability of the pod from before it was rolled, e.g. checked by
+		// batchAlreadyUpdated, says nothing about the new pod.
+		now := clock.Now()
+		s, ok := stableSince[podName]
+		if !ok || !s.rolledAt.Equal(updateSts.rolledAt) {
+			s = stability{since: now, rolledAt: updateSts.rolledAt}
+			stableSince[podName] = s
+		}
+		if stable := now.Sub(s.since); stable < stableFor {
+			return errors.Newf("pod %s stable for %s, waiting for %s", podName, stable, stableFor)
+		}
+
+		delete(stableSince, podName)
+		l.V(int(zapcore.DebugLevel)).Info("pod stable", "podName", podName, "stableFor", stableFor)
+		return nil
+	}
+}
+
+// VerifyRegionAtRevision refetches the StatefulSet and returns an error unless
+// every pod has been updated, that is unless status.updatedReplicas equals
+// status.replicas and status.currentRevision equals status.updateRevision.
+func VerifyRegionAtRevision(ctx context.Context, updateSts *UpdateSts) error {
+	stsClient, err := updateSts.statefulSets(ctx)
+	if err != nil {
+		return err
+	}
+	sts, err := stsClient.Get(ctx, updateSts.name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "error getting sts %s ns: %s", updateSts.name, updateSts.namespace)
+	}
+
+	status := sts.Status
+	if status.UpdatedReplicas != status.Replicas {
+		return errors.Newf("sts %s ns: %s has %d of %d replicas at revision %s",
+			updateSts.name, updateSts.namespace, status.UpdatedReplicas, status.Replicas, status.UpdateRevision)
+	}
+	if status.CurrentRevision != status.UpdateRevision {
+		return errors.Newf("sts %s ns: %s is at revision %s, expected %s",
+			updateSts.name, updateSts.namespace, status.CurrentRevision, status.UpdateRevision)
+	}
+	return nil
+}
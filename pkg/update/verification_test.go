@@ -0,0 +1,436 @@
+/*
+Copyright 2024 The Cockroach Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package update
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cockroachdb/errors"
+	"github.com/go-logr/logr"
+	log "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestSQLConn returns a SQLConnFactory that hands out a new mocked
+// connection each time it is opened, set up by the next of expectations, and
+// records the pods it was asked to connect to.
+func newTestSQLConn(t *testing.T, expectations ...func(sqlmock.Sqlmock)) (SQLConnFactory, *[]string) {
+	var pods []string
+	factory := SQLConnFactoryFunc(func(_ context.Context, namespace, podName string) (*sql.DB, error) {
+		require.Equal(t, testStsNamespace, namespace)
+		require.Less(t, len(pods), len(expectations), "unexpected connection to %s", podName)
+
+		db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+		require.NoError(t, err)
+		expectations[len(pods)](mock)
+		mock.ExpectClose()
+		t.Cleanup(func() { require.NoError(t, mock.ExpectationsWereMet()) })
+
+		pods = append(pods, podName)
+		return db, nil
+	})
+	return factory, &pods
+}
+
+// expectVersion expects the node version to be queried and returns version.
+func expectVersion(version string) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(nodeVersionQuery).WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(version))
+	}
+}
+
+func TestVersionVerificationFunc(t *testing.T) {
+	_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+
+	t.Run("returns an error until the pod runs the expected version", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectVersion("v20.2.0"), expectVersion("v21.1.0"))
+		verify := VersionVerificationFunc("v21.1.0", sqlConn)
+
+		require.Error(t, verify(updateSts, 2, log.NullLogger{}))
+		require.NoError(t, verify(updateSts, 2, log.NullLogger{}))
+		require.Equal(t, []string{"cockroachdb-2", "cockroachdb-2"}, *pods)
+	})
+
+	t.Run("ignores the leading v of the version", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectVersion("v21.1.0"))
+
+		require.NoError(t, VersionVerificationFunc("21.1.0", sqlConn)(updateSts, 0, log.NullLogger{}))
+	})
+
+	t.Run("returns an error when the pod can't be queried", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(nodeVersionQuery).WillReturnError(errors.New("connection refused"))
+		})
+
+		err := VersionVerificationFunc("v21.1.0", sqlConn)(updateSts, 1, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "cockroachdb-1")
+	})
+}
+
+func TestSQLReadinessVerificationFunc(t *testing.T) {
+	_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	updateSts.sts.Spec.ServiceName = "cockroachdb"
+
+	t.Run("returns an error until the pod accepts SQL", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t,
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectOneQuery).WillReturnError(errors.New("server is not accepting clients"))
+			},
+			func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectOneQuery).WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+			},
+		)
+		verify := SQLReadinessVerificationFunc(sqlConn)
+
+		err := verify(updateSts, 2, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "cockroachdb-2.cockroachdb")
+		require.NoError(t, verify(updateSts, 2, log.NullLogger{}))
+		require.Equal(t, []string{"cockroachdb-2.cockroachdb", "cockroachdb-2.cockroachdb"}, *pods)
+	})
+
+	t.Run("returns an error when the connection can't be opened", func(t *testing.T) {
+		sqlConn := SQLConnFactoryFunc(func(context.Context, string, string) (*sql.DB, error) {
+			return nil, errors.New("connection refused")
+		})
+
+		require.Error(t, SQLReadinessVerificationFunc(sqlConn)(updateSts, 0, log.NullLogger{}))
+	})
+}
+
+// expectLeaseless expects the number of ranges without a leaseholder to be
+// queried and returns count.
+func expectLeaseless(count int) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(leaselessRangesQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	}
+}
+
+func TestNoLeaselessRangesVerificationFunc(t *testing.T) {
+	_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+
+	t.Run("returns an error until every range has a leaseholder", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectLeaseless(4), expectLeaseless(0))
+		verify := NoLeaselessRangesVerificationFunc(sqlConn)
+
+		err := verify(updateSts, 1, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "4 ranges have no leaseholder")
+		require.NoError(t, verify(updateSts, 1, log.NullLogger{}))
+		require.Equal(t, []string{"cockroachdb-1", "cockroachdb-1"}, *pods)
+	})
+
+	t.Run("combined with another verification", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectVersion("v21.1.0"), expectLeaseless(2))
+		verify := CombineVerificationFuncs(VersionVerificationFunc("v21.1.0", sqlConn), NoLeaselessRangesVerificationFunc(sqlConn))
+
+		require.Error(t, verify(updateSts, 0, log.NullLogger{}))
+	})
+
+	t.Run("the gate is not checked until the pod is verified", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectVersion("v20.2.0"))
+		verify := CombineVerificationFuncs(VersionVerificationFunc("v21.1.0", sqlConn), NoLeaselessRangesVerificationFunc(sqlConn))
+
+		require.Error(t, verify(updateSts, 0, log.NullLogger{}))
+		require.Len(t, *pods, 1)
+	})
+}
+
+// expectNodeLive expects the liveness of nodeID to be queried and returns live.
+func expectNodeLive(nodeID int, live bool) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(nodeIsLiveQuery).WithArgs(nodeID).WillReturnRows(sqlmock.NewRows([]string{"is_live"}).AddRow(live))
+	}
+}
+
+func TestNodeLiveVerificationFunc(t *testing.T) {
+	_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	resolve := func(_ *UpdateSts, podNumber int) (int, error) { return podNumber + 1, nil }
+
+	t.Run("returns an error until the node is live", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectNodeLive(2, false), expectNodeLive(2, true))
+		verify := NodeLiveVerificationFunc(sqlConn, resolve)
+
+		err := verify(updateSts, 1, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "node 2 in pod cockroachdb-1 is not live yet")
+		require.NoError(t, verify(updateSts, 1, log.NullLogger{}))
+		require.Equal(t, []string{"cockroachdb-2", "cockroachdb-2"}, *pods)
+	})
+
+	t.Run("the liveness of the last pod is read from pod 0", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectNodeLive(3, true))
+
+		require.NoError(t, NodeLiveVerificationFunc(sqlConn, resolve)(updateSts, 2, log.NullLogger{}))
+		require.Equal(t, []string{"cockroachdb-0"}, *pods)
+	})
+
+	t.Run("fails when the node id can't be resolved", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t)
+		verify := NodeLiveVerificationFunc(sqlConn, func(*UpdateSts, int) (int, error) {
+			return 0, errors.New("no node id")
+		})
+
+		err := verify(updateSts, 0, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "error getting node id of pod cockroachdb-0: no node id")
+		require.Empty(t, *pods)
+	})
+}
+
+// expectLiveNodes expects the live nodes to be counted and returns count.
+func expectLiveNodes(count int) func(sqlmock.Sqlmock) {
+	return func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(liveNodesQuery).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(count))
+	}
+}
+
+func TestNoZombieNodesVerificationFunc(t *testing.T) {
+	_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+
+	t.Run("passes when the counts match", func(t *testing.T) {
+		sqlConn, pods := newTestSQLConn(t, expectLiveNodes(3))
+
+		require.NoError(t, NoZombieNodesVerificationFunc(sqlConn, 3)(updateSts, 0, log.NullLogger{}))
+		require.Equal(t, []string{"cockroachdb-0"}, *pods)
+	})
+
+	t.Run("fails when nodes linger", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectLiveNodes(4))
+
+		err := NoZombieNodesVerificationFunc(sqlConn, 3)(updateSts, 0, log.NullLogger{})
+		require.EqualError(t, err, "cluster has 4 live nodes that are not decommissioned, expected 3")
+	})
+
+	t.Run("fails when nodes are missing", func(t *testing.T) {
+		sqlConn, _ := newTestSQLConn(t, expectLiveNodes(2))
+
+		require.Error(t, NoZombieNodesVerificationFunc(sqlConn, 3)(updateSts, 0, log.NullLogger{}))
+	})
+}
+
+// setStatefulSetStatus sets the status of the test StatefulSet.
+func setStatefulSetStatus(t *testing.T, clientset *fake.Clientset, status v1.StatefulSetStatus) {
+	sts, err := clientset.AppsV1().StatefulSets(testStsNamespace).Get(context.Background(), testStsName, metav1.GetOptions{})
+	require.NoError(t, err)
+	sts.Status = status
+	_, err = clientset.AppsV1().StatefulSets(testStsNamespace).UpdateStatus(context.Background(), sts, metav1.UpdateOptions{})
+	require.NoError(t, err)
+}
+
+func TestRestartedSinceVerificationFunc(t *testing.T) {
+	clientset, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	since := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	addPod := func(podNumber int, startedAt time.Time) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: updateSts.PodName(podNumber), Namespace: testStsNamespace},
+			Status: corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "init"},
+					{Name: DBContainerName, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(startedAt)}}},
+				},
+			},
+		}
+		_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(), pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	addPod(0, since.Add(-time.Hour))
+	addPod(1, since.Add(time.Minute))
+
+	verify := RestartedSinceVerificationFunc(since)
+
+	err := verify(updateSts, 0, log.NullLogger{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "container db of pod cockroachdb-0 has been running since 2021-01-01T11:00:00Z, before 2021-01-01T12:00:00Z")
+	require.NoError(t, verify(updateSts, 1, log.NullLogger{}))
+
+	t.Run("the pod must restart after it was rolled", func(t *testing.T) {
+		rolled := *updateSts
+		rolled.rolledAt = since.Add(2 * time.Minute)
+		require.Error(t, verify(&rolled, 1, log.NullLogger{}))
+		require.NoError(t, verify(updateSts, 1, log.NullLogger{}))
+	})
+
+	t.Run("the pod is missing", func(t *testing.T) {
+		require.Error(t, verify(updateSts, 2, log.NullLogger{}))
+	})
+}
+
+func TestImageVerificationFunc(t *testing.T) {
+	clientset, updateSts, _ := newTestUpdate(t, 4, &fakeHealthChecker{failAfter: -1})
+	addPod := func(podNumber int, image string, running bool) {
+		status := corev1.ContainerStatus{Name: DBContainerName}
+		if running {
+			status.State.Running = &corev1.ContainerStateRunning{}
+		} else {
+			status.State.Waiting = &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: updateSts.PodName(podNumber), Namespace: testStsNamespace},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "init", Image: "busybox"},
+					{Name: DBContainerName, Image: image},
+				},
+			},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{Name: "init"}, status}},
+		}
+		_, err := clientset.CoreV1().Pods(testStsNamespace).Create(context.Background(), pod, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+	addPod(0, "cockroachdb/cockroach:v21.1.0", true)
+	addPod(1, "cockroachdb/cockroach:v20.2.0", true)
+	addPod(2, "cockroachdb/cockroach:v21.1.0", false)
+
+	verify := ImageVerificationFunc(DBContainerName, "cockroachdb/cockroach:v21.1.0")
+
+	require.NoError(t, verify(updateSts, 0, log.NullLogger{}))
+
+	err := verify(updateSts, 1, log.NullLogger{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "container db of pod cockroachdb-1 has image cockroachdb/cockroach:v20.2.0, expected cockroachdb/cockroach:v21.1.0")
+
+	err = verify(updateSts, 2, log.NullLogger{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "container db of pod cockroachdb-2 is not running")
+
+	t.Run("the pod is missing", func(t *testing.T) {
+		require.Error(t, verify(updateSts, 3, log.NullLogger{}))
+	})
+
+	t.Run("the container is missing", func(t *testing.T) {
+		err := ImageVerificationFunc("other", "cockroachdb/cockroach:v21.1.0")(updateSts, 0, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "container other not found in pod cockroachdb-0")
+	})
+
+	t.Run("the container is crash looping", func(t *testing.T) {
+		pod, err := clientset.CoreV1().Pods(testStsNamespace).Get(context.Background(), updateSts.PodName(2), metav1.GetOptions{})
+		require.NoError(t, err)
+		pod.Status.ContainerStatuses[1].RestartCount = 5
+		pod.Status.ContainerStatuses[1].State.Waiting = &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off 5m0s"}
+		_, err = clientset.CoreV1().Pods(testStsNamespace).Update(context.Background(), pod, metav1.UpdateOptions{})
+		require.NoError(t, err)
+
+		err = verify(updateSts, 2, log.NullLogger{})
+		require.True(t, errors.Is(err, ErrPodFailed))
+		require.Contains(t, err.Error(), "container db of pod cockroachdb-2 is in CrashLoopBackOff after 5 restarts: back-off 5m0s")
+	})
+}
+
+func TestStableForVerificationFunc(t *testing.T) {
+	_, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+	clock := newFakeClock()
+
+	// results are returned by the inner func, one per call.
+	var results []error
+	inner := func(*UpdateSts, int, logr.Logger) error {
+		err := results[0]
+		results = results[1:]
+		return err
+	}
+	notReady := errors.New("pod not ready")
+	verify := StableForVerificationFunc(inner, 30*time.Second, clock)
+
+	results = []error{nil, nil, notReady, nil, nil, nil}
+	// The pod is ready, then flaps after 20s.
+	require.Error(t, verify(updateSts, 1, log.NullLogger{}))
+	clock.Advance(20 * time.Second)
+	require.Error(t, verify(updateSts, 1, log.NullLogger{}))
+	clock.Advance(20 * time.Second)
+	require.Equal(t, notReady, verify(updateSts, 1, log.NullLogger{}))
+
+	// The stability timer starts over once the pod is ready again.
+	require.Error(t, verify(updateSts, 1, log.NullLogger{}))
+	clock.Advance(20 * time.Second)
+	err := verify(updateSts, 1, log.NullLogger{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pod cockroachdb-1 stable for 20s, waiting for 30s")
+	clock.Advance(10 * time.Second)
+	require.NoError(t, verify(updateSts, 1, log.NullLogger{}))
+	require.Empty(t, results)
+
+	t.Run("pods are tracked separately", func(t *testing.T) {
+		results = []error{nil, nil, nil}
+		require.Error(t, verify(updateSts, 2, log.NullLogger{}))
+		clock.Advance(30 * time.Second)
+		require.Error(t, verify(updateSts, 0, log.NullLogger{}))
+		require.NoError(t, verify(updateSts, 2, log.NullLogger{}))
+	})
+
+	t.Run("the timer starts over when the pod is rolled", func(t *testing.T) {
+		results = []error{nil, nil, nil}
+		// The old pod passes before it is rolled.
+		require.Error(t, verify(updateSts, 1, log.NullLogger{}))
+		clock.Advance(30 * time.Second)
+
+		rolled := *updateSts
+		rolled.rolledAt = clock.Now()
+		err := verify(&rolled, 1, log.NullLogger{})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "pod cockroachdb-1 stable for 0s, waiting for 30s")
+		clock.Advance(30 * time.Second)
+		require.NoError(t, verify(&rolled, 1, log.NullLogger{}))
+	})
+}
+
+func TestVerifyRegionAtRevision(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  v1.StatefulSetStatus
+		wantErr string
+	}{
+		{
+			name:   "converged",
+			status: v1.StatefulSetStatus{Replicas: 3, UpdatedReplicas: 3, CurrentRevision: "rev-2", UpdateRevision: "rev-2"},
+		},
+		{
+			name:    "pods not updated yet",
+			status:  v1.StatefulSetStatus{Replicas: 3, UpdatedReplicas: 2, CurrentRevision: "rev-1", UpdateRevision: "rev-2"},
+			wantErr: "has 2 of 3 replicas at revision rev-2",
+		},
+		{
+			name:    "current revision not updated yet",
+			status:  v1.StatefulSetStatus{Replicas: 3, UpdatedReplicas: 3, CurrentRevision: "rev-1", UpdateRevision: "rev-2"},
+			wantErr: "is at revision rev-1, expected rev-2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset, updateSts, _ := newTestUpdate(t, 3, &fakeHealthChecker{failAfter: -1})
+			setStatefulSetStatus(t, clientset, tt.status)
+
+			err := VerifyRegionAtRevision(context.Background(), updateSts)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}